@@ -0,0 +1,369 @@
+package homework2
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versioned JSON API over the image index, for tools that shouldn't scrape the HTML
+// page. The routes and schemas are described by openapi.json, served from the binary
+// at /api/v1/openapi.json.
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const (
+	defaultAPILimit = 50
+	maxAPILimit     = defaultSearchLimit
+)
+
+func registerAPI(mux *http.ServeMux, store *indexedStore, crawls *CrawlManager) {
+	mux.HandleFunc("GET /api/v1/images", func(w http.ResponseWriter, r *http.Request) {
+		apiImages(w, r, store)
+	})
+	mux.HandleFunc("GET /api/v1/images/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "id: want an integer")
+			return
+		}
+		im, err := store.Get(r.Context(), id)
+		if errors.Is(err, ErrImageNotFound) {
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("api: get %d: %v", id, err)
+			apiError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIImage(im))
+	})
+	mux.HandleFunc("GET /api/v1/crawls", func(w http.ResponseWriter, r *http.Request) {
+		list := []apiCrawl{}
+		for _, c := range crawls.List() {
+			list = append(list, toAPICrawl(c))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"crawls": list})
+	})
+	mux.HandleFunc("POST /api/v1/crawls", func(w http.ResponseWriter, r *http.Request) {
+		var req crawlRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, "body: "+err.Error())
+			return
+		}
+		cfg, err := req.config(crawls.Defaults())
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c := crawls.Start(req.URLs, cfg, nil, false)
+		st, _ := crawls.Status(c.ID)
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/crawls/%d", c.ID))
+		writeJSON(w, http.StatusCreated, toAPICrawl(st))
+	})
+	mux.HandleFunc("GET /api/v1/crawls/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "id: want an integer")
+			return
+		}
+		st, err := crawls.Status(id)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPICrawl(st))
+	})
+	mux.HandleFunc("POST /api/v1/crawls/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "id: want an integer")
+			return
+		}
+		action, ok := crawlActions(crawls)[r.PathValue("action")]
+		if !ok {
+			apiError(w, http.StatusNotFound, "no such action")
+			return
+		}
+		switch err := action(id); {
+		case errors.Is(err, ErrCrawlNotFound):
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, ErrCrawlEnded):
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+		st, _ := crawls.Status(id)
+		writeJSON(w, http.StatusOK, toAPICrawl(st))
+	})
+	mux.HandleFunc("GET /api/v1/events", serveEvents(crawls))
+	mux.HandleFunc("GET /api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		st := apiStats{Formats: map[string]int{}, SimilarityIndex: store.sim.Len(), TextIndex: store.text.Len()}
+		err := store.ForEach(r.Context(), func(im ImageMeta) error {
+			st.Images++
+			if im.DuplicateOf != 0 {
+				st.Duplicates++
+				return nil
+			}
+			st.Canonical++
+			st.Formats[im.Format]++
+			if im.Frames > 1 {
+				st.Animated++
+			}
+			if im.HasGPS {
+				st.WithGPS++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("api: stats: %v", err)
+			apiError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		for _, c := range crawls.List() {
+			if c.State == CrawlRunning || c.State == CrawlPaused {
+				st.CrawlsRunning++
+			}
+		}
+		writeJSON(w, http.StatusOK, st)
+	})
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+	// anything else under /api/ is a JSON 404, not the HTML search page
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, "no such endpoint")
+	})
+}
+
+// apiImages serves GET /api/v1/images: the filters of the search page plus limit and
+// cursor, see indexedStore.Page.
+func apiImages(w http.ResponseWriter, r *http.Request, store *indexedStore) {
+	q := r.URL.Query()
+	f, err := filterFromQuery(q)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := defaultAPILimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAPILimit {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("limit: want 1-%d", maxAPILimit))
+			return
+		}
+	}
+	imgs, next, err := store.Page(r.Context(), strings.TrimSpace(q.Get("q")), f, limit, q.Get("cursor"))
+	if errors.Is(err, errBadCursor) {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("api: search: %v", err)
+		apiError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	resp := apiImageList{Images: []apiImage{}, NextCursor: next}
+	for _, im := range imgs {
+		resp.Images = append(resp.Images, toAPIImage(im))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ---- responses ----
+
+type apiImageList struct {
+	Images     []apiImage `json:"images"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type apiImage struct {
+	ID           int64             `json:"id"`
+	URL          string            `json:"url"`
+	File         string            `json:"file"`
+	Thumbnail    string            `json:"thumbnail,omitempty"`
+	Thumbnails   map[string]string `json:"thumbnails,omitempty"`
+	Alt          string            `json:"alt,omitempty"`
+	Title        string            `json:"title,omitempty"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Format       string            `json:"format"`
+	CrawledAt    time.Time         `json:"crawled_at"`
+	Source       string            `json:"source,omitempty"`
+	Alternates   []string          `json:"alternates,omitempty"`
+	Frames       int               `json:"frames,omitempty"`
+	DurationMS   int64             `json:"duration_ms,omitempty"`
+	CameraMake   string            `json:"camera_make,omitempty"`
+	CameraModel  string            `json:"camera_model,omitempty"`
+	Lens         string            `json:"lens,omitempty"`
+	TakenAt      *time.Time        `json:"taken_at,omitempty"`
+	GPS          *apiGPS           `json:"gps,omitempty"`
+	Creator      string            `json:"creator,omitempty"`
+	Copyright    string            `json:"copyright,omitempty"`
+	Keywords     []string          `json:"keywords,omitempty"`
+	Palette      []apiColor        `json:"palette,omitempty"`
+	AvgColor     string            `json:"avg_color,omitempty"`
+	Colorfulness float64           `json:"colorfulness"`
+	PageURL      string            `json:"page_url,omitempty"`
+	PageTitle    string            `json:"page_title,omitempty"`
+	Caption      string            `json:"caption,omitempty"`
+	Context      string            `json:"context,omitempty"`
+	SHA256       string            `json:"sha256,omitempty"`
+	PHash        string            `json:"phash,omitempty"`
+	DuplicateOf  int64             `json:"duplicate_of,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	CheckedAt    *time.Time        `json:"checked_at,omitempty"`
+	StaleSince   *time.Time        `json:"stale_since,omitempty"`
+}
+
+type apiGPS struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type apiColor struct {
+	Color string  `json:"color"`
+	Share float64 `json:"share"`
+}
+
+type apiCrawl struct {
+	ID             int              `json:"id"`
+	StartURLs      []string         `json:"start_urls"`
+	Resumed        bool             `json:"resumed"`
+	State          string           `json:"state"`
+	Settings       apiCrawlSettings `json:"settings"`
+	StartedAt      time.Time        `json:"started_at"`
+	FinishedAt     *time.Time       `json:"finished_at,omitempty"`
+	PagesScheduled int              `json:"pages_scheduled"`
+	PagesPending   int              `json:"pages_pending"`
+	Queued         int              `json:"queued"`
+	Fetched        int              `json:"fetched"`
+	Errors         int              `json:"errors"`
+	Images         int              `json:"images"`
+	Duplicates     int              `json:"duplicates"`
+	Unchanged      int              `json:"unchanged"`
+}
+
+type apiCrawlSettings struct {
+	Workers         int    `json:"workers"`
+	MaxDepth        int    `json:"max_depth"`
+	MaxPages        int    `json:"max_pages"`
+	MaxPagesPerHost int    `json:"max_pages_per_host"`
+	FollowExternal  bool   `json:"follow_external"`
+	EnableJS        bool   `json:"enable_js"`
+	Sitemaps        bool   `json:"sitemaps"`
+	Feeds           bool   `json:"feeds"`
+	Timeout         string `json:"timeout"`
+}
+
+type apiStats struct {
+	Images          int            `json:"images"`
+	Canonical       int            `json:"canonical"`
+	Duplicates      int            `json:"duplicates"`
+	Formats         map[string]int `json:"formats"` // canonical images only
+	Animated        int            `json:"animated"`
+	WithGPS         int            `json:"with_gps"`
+	SimilarityIndex int            `json:"similarity_index"`
+	TextIndex       int            `json:"text_index"`
+	CrawlsRunning   int            `json:"crawls_running"`
+}
+
+// imageURL maps a file in -image-dir to its URL under /images/.
+func imageURL(p string) string {
+	if p == "" {
+		return ""
+	}
+	return "/images/" + url.PathEscape(filepath.Base(p))
+}
+
+func toAPIImage(im ImageMeta) apiImage {
+	a := apiImage{
+		ID: im.ID, URL: im.URL, File: imageURL(im.Filename), Thumbnail: imageURL(im.Thumbnail),
+		Alt: im.Alt, Title: im.Title, Width: im.Width, Height: im.Height, Format: im.Format,
+		CrawledAt: im.CrawledAt, Source: im.Source, Alternates: im.Alternates,
+		Frames: im.Frames, DurationMS: im.Duration.Milliseconds(),
+		CameraMake: im.CameraMake, CameraModel: im.CameraModel, Lens: im.Lens,
+		Creator: im.Creator, Copyright: im.Copyright, Keywords: im.Keywords,
+		AvgColor: im.AvgColor, Colorfulness: im.Colorfulness,
+		PageURL: im.PageURL, PageTitle: im.PageTitle, Caption: im.Caption, Context: im.Context,
+		SHA256: im.SHA256, DuplicateOf: im.DuplicateOf, ETag: im.ETag, LastModified: im.LastModified,
+	}
+	if len(im.Thumbnails) > 0 {
+		a.Thumbnails = make(map[string]string, len(im.Thumbnails))
+		for w, p := range im.Thumbnails {
+			a.Thumbnails[strconv.Itoa(w)] = imageURL(p)
+		}
+	}
+	if !im.TakenAt.IsZero() {
+		t := im.TakenAt
+		a.TakenAt = &t
+	}
+	if !im.CheckedAt.IsZero() {
+		t := im.CheckedAt
+		a.CheckedAt = &t
+	}
+	if !im.StaleSince.IsZero() {
+		t := im.StaleSince
+		a.StaleSince = &t
+	}
+	if im.HasGPS {
+		a.GPS = &apiGPS{Lat: im.GPSLat, Lon: im.GPSLon}
+	}
+	for _, c := range im.Palette {
+		a.Palette = append(a.Palette, apiColor{Color: c.Color, Share: c.Share})
+	}
+	if im.PHash != 0 {
+		a.PHash = fmt.Sprintf("%016x", im.PHash)
+	}
+	return a
+}
+
+func toAPICrawl(c CrawlStatus) apiCrawl {
+	cfg := c.Config
+	a := apiCrawl{
+		ID: c.ID, StartURLs: c.StartURLs, Resumed: c.Resumed, State: c.State,
+		Settings: apiCrawlSettings{
+			Workers: cfg.Workers, MaxDepth: cfg.Limits.MaxDepth, MaxPages: cfg.Limits.MaxPages,
+			MaxPagesPerHost: cfg.Limits.MaxPagesPerHost, FollowExternal: cfg.FollowExternal,
+			EnableJS: cfg.EnableJS, Sitemaps: cfg.Sitemaps, Feeds: cfg.Feeds, Timeout: cfg.Timeout.String(),
+		},
+		StartedAt:      c.StartedAt,
+		PagesScheduled: c.PagesScheduled, PagesPending: c.PagesPending, Queued: c.Queued,
+		Fetched: c.Fetched, Errors: c.Errors, Images: c.Images, Duplicates: c.Duplicates, Unchanged: c.Unchanged,
+	}
+	if a.StartURLs == nil {
+		a.StartURLs = []string{}
+	}
+	if !c.FinishedAt.IsZero() {
+		t := c.FinishedAt
+		a.FinishedAt = &t
+	}
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("api: write response: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
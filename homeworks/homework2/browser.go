@@ -0,0 +1,311 @@
+package homework2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/page"
+	cdpruntime "github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// JavaScript rendering: every Dispatcher with -enable-js starts one headless Chrome
+// the first time it needs it and renders pages in a bounded pool of reused tabs.
+// Without Chrome the crawl goes on with plain HTTP fetches.
+
+// Wait strategies: when a page counts as rendered.
+const (
+	WaitLoad        = "load"        // the load event
+	WaitNetworkIdle = "networkidle" // no network requests for 500ms
+	WaitSelector    = "selector"    // an element matching a CSS selector is in the DOM
+	WaitDelay       = "delay"       // a fixed time after the load event
+)
+
+// WaitStrategy says how long to wait before taking a rendered page's HTML.
+type WaitStrategy struct {
+	Kind     string
+	Selector string        // of WaitSelector
+	Delay    time.Duration // of WaitDelay
+}
+
+// parseWaitStrategy parses load, networkidle, selector=CSS or delay=DURATION.
+func parseWaitStrategy(s string) (WaitStrategy, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(s), "=")
+	w := WaitStrategy{Kind: kind}
+	switch kind {
+	case WaitLoad, WaitNetworkIdle:
+		if arg != "" {
+			return w, fmt.Errorf("%s takes no argument", kind)
+		}
+	case WaitSelector:
+		if arg == "" {
+			return w, errors.New("selector=CSS needs a selector")
+		}
+		w.Selector = arg
+	case WaitDelay:
+		d, err := time.ParseDuration(arg)
+		if err != nil || d < 0 {
+			return w, errors.New("delay=DURATION needs a duration, e.g. delay=2s")
+		}
+		w.Delay = d
+	default:
+		return w, fmt.Errorf("unknown wait strategy %q, want load, networkidle, selector=CSS or delay=DURATION", s)
+	}
+	return w, nil
+}
+
+func (w WaitStrategy) String() string {
+	switch w.Kind {
+	case WaitSelector:
+		return w.Kind + "=" + w.Selector
+	case WaitDelay:
+		return w.Kind + "=" + w.Delay.String()
+	}
+	return w.Kind
+}
+
+// RenderOptions configure the browser of a crawl.
+type RenderOptions struct {
+	Tabs    int // pages rendered at once
+	Wait    WaitStrategy
+	Timeout time.Duration // per page; if the wait takes longer the page is taken as it is
+	Scroll  bool          // scroll to the bottom so lazy-loaded images get their src
+}
+
+func DefaultRenderOptions() RenderOptions {
+	return RenderOptions{Tabs: 4, Wait: WaitStrategy{Kind: WaitNetworkIdle}, Timeout: 30 * time.Second, Scroll: true}
+}
+
+const (
+	captureTimeout = 15 * time.Second // scrolling and reading the DOM after the wait
+	maxScrollSteps = 50
+)
+
+// errNoBrowser is returned by Render when Chrome couldn't be started.
+var errNoBrowser = errors.New("no browser")
+
+// Browser is a lazily started headless Chrome with a pool of tabs.
+type Browser struct {
+	parent context.Context // the crawl; ending it closes the browser
+	opts   RenderOptions
+
+	once   sync.Once
+	err    error
+	ctx    context.Context // the browser, valid once started
+	cancel func()
+
+	idle  chan *tab     // open tabs that aren't rendering
+	slots chan struct{} // one per open tab
+}
+
+type tab struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newBrowser returns a browser for the crawl ctx. Chrome is started by the first Render.
+func newBrowser(ctx context.Context, opts RenderOptions) *Browser {
+	if opts.Tabs <= 0 {
+		opts.Tabs = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRenderOptions().Timeout
+	}
+	return &Browser{
+		parent: ctx,
+		opts:   opts,
+		idle:   make(chan *tab, opts.Tabs),
+		slots:  make(chan struct{}, opts.Tabs),
+	}
+}
+
+func (b *Browser) start() error {
+	b.once.Do(func() {
+		allocCtx, allocCancel := chromedp.NewExecAllocator(b.parent, chromedp.DefaultExecAllocatorOptions[:]...)
+		ctx, cancel := chromedp.NewContext(allocCtx)
+		// the first Run launches Chrome; it must not have a timeout, or that would end the browser
+		if err := chromedp.Run(ctx); err != nil {
+			cancel()
+			allocCancel()
+			log.Printf("browser: can't start Chrome (%v) - fetching pages without JavaScript", err)
+			b.err = errNoBrowser
+			return
+		}
+		log.Printf("browser: started with %d tabs, waiting for %s", b.opts.Tabs, b.opts.Wait)
+		b.ctx = ctx
+		b.cancel = func() {
+			tctx, tcancel := context.WithTimeout(ctx, 5*time.Second)
+			defer tcancel()
+			chromedp.Cancel(tctx)
+			cancel()
+			allocCancel()
+		}
+	})
+	return b.err
+}
+
+// Close shuts Chrome down. Render must not be running.
+func (b *Browser) Close() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// acquire returns an idle tab or opens a new one if the pool isn't full.
+func (b *Browser) acquire(ctx context.Context) (*tab, error) {
+	select {
+	case t := <-b.idle:
+		return t, nil
+	default:
+	}
+	select {
+	case t := <-b.idle:
+		return t, nil
+	case b.slots <- struct{}{}:
+		tctx, cancel := chromedp.NewContext(b.ctx)
+		if err := chromedp.Run(tctx, page.SetLifecycleEventsEnabled(true)); err != nil {
+			cancel()
+			<-b.slots
+			return nil, err
+		}
+		return &tab{ctx: tctx, cancel: cancel}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release puts t back in the pool, or closes it if it may be broken.
+func (b *Browser) release(t *tab, ok bool) {
+	if ok {
+		b.idle <- t
+		return
+	}
+	t.cancel()
+	<-b.slots
+}
+
+// Render loads pageURL in a tab, waits according to the wait strategy, scrolls and
+// returns the resulting HTML and the URL the page ended up at.
+func (b *Browser) Render(ctx context.Context, pageURL string) ([]byte, *url.URL, error) {
+	if err := b.start(); err != nil {
+		return nil, nil, err
+	}
+	t, err := b.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	html, final, err := b.render(ctx, t, pageURL)
+	b.release(t, err == nil)
+	return html, final, err
+}
+
+func (b *Browser) render(ctx context.Context, t *tab, pageURL string) ([]byte, *url.URL, error) {
+	// the first Run on t.ctx has happened in acquire, so these timeouts only end the page
+	runCtx, cancel := context.WithTimeout(t.ctx, b.opts.Timeout)
+	defer cancel()
+	defer context.AfterFunc(ctx, cancel)()
+
+	lifecycle := make(chan *page.EventLifecycleEvent, 64)
+	chromedp.ListenTarget(runCtx, func(ev any) {
+		if e, ok := ev.(*page.EventLifecycleEvent); ok {
+			select {
+			case lifecycle <- e:
+			default:
+			}
+		}
+	})
+	var frame cdp.FrameID
+	var loader cdp.LoaderID
+	err := chromedp.Run(runCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var errText string
+		var err error
+		frame, loader, errText, _, err = page.Navigate(pageURL).Do(ctx)
+		if err == nil && errText != "" {
+			err = errors.New(errText)
+		}
+		return err
+	}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("navigate: %w", err)
+	}
+
+	if err := b.wait(runCtx, lifecycle, frame, loader); err != nil {
+		if ctx.Err() != nil || !errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			return nil, nil, err
+		}
+		log.Printf("browser: %s not ready after %s - taking it as it is", pageURL, b.opts.Timeout)
+	}
+
+	capCtx, capCancel := context.WithTimeout(t.ctx, captureTimeout)
+	defer capCancel()
+	defer context.AfterFunc(ctx, capCancel)()
+	var html, location string
+	actions := []chromedp.Action{}
+	if b.opts.Scroll {
+		actions = append(actions, chromedp.Evaluate(scrollScript, nil, func(p *cdpruntime.EvaluateParams) *cdpruntime.EvaluateParams {
+			return p.WithAwaitPromise(true)
+		}))
+	}
+	actions = append(actions,
+		chromedp.Location(&location),
+		chromedp.OuterHTML("html", &html, chromedp.ByQuery),
+	)
+	if err := chromedp.Run(capCtx, actions...); err != nil {
+		return nil, nil, err
+	}
+	final, err := url.Parse(location)
+	if err != nil || final.Host == "" {
+		final, err = url.Parse(pageURL)
+	}
+	return []byte(html), final, err
+}
+
+// wait blocks until the page loaded by loader in frame is ready.
+func (b *Browser) wait(ctx context.Context, lifecycle <-chan *page.EventLifecycleEvent, frame cdp.FrameID, loader cdp.LoaderID) error {
+	want := "load"
+	if b.opts.Wait.Kind == WaitNetworkIdle {
+		want = "networkIdle"
+	}
+	for ready := false; !ready; {
+		select {
+		case e := <-lifecycle:
+			ready = e.FrameID == frame && e.LoaderID == loader && e.Name == want
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	switch b.opts.Wait.Kind {
+	case WaitSelector:
+		return chromedp.Run(ctx, chromedp.WaitReady(b.opts.Wait.Selector, chromedp.ByQuery))
+	case WaitDelay:
+		select {
+		case <-time.After(b.opts.Wait.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// scrollScript scrolls down a screen at a time until the page stops growing, so
+// images loaded on scroll (loading=lazy, IntersectionObserver) get their src.
+var scrollScript = fmt.Sprintf(`new Promise(resolve => {
+	let steps = 0;
+	const step = () => {
+		const el = document.scrollingElement || document.documentElement;
+		if (steps++ >= %d || window.innerHeight + window.scrollY >= el.scrollHeight) {
+			resolve(steps);
+			return;
+		}
+		window.scrollBy(0, window.innerHeight);
+		setTimeout(step, 150);
+	};
+	step();
+})`, maxScrollSteps)
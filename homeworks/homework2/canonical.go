@@ -0,0 +1,244 @@
+package homework2
+
+import (
+	"hash/fnv"
+	"io"
+	"math/bits"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// trackingParams are query parameters that never change page content.
+var trackingParams = map[string]bool{
+	"gclid": true, "dclid": true, "fbclid": true, "msclkid": true, "yclid": true,
+	"mc_cid": true, "mc_eid": true, "_ga": true, "_gl": true, "igshid": true,
+	"ref_src": true, "spm": true,
+}
+
+// canonicalizeURL normalizes u in place: lower-case scheme and host, no default port,
+// no fragment, no tracking parameters and resolved dot segments. Nothing that may
+// change the resource is touched: escapes in the path, a trailing slash and the order
+// and spelling of the remaining query parameters are kept.
+func canonicalizeURL(u *url.URL) {
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimSuffix(host, ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.User = nil
+
+	// on the escaped path, so that /a%2Fb stays one segment
+	p := removeDotSegments(u.EscapedPath())
+	if p == "" {
+		p = "/"
+	}
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		u.Path, u.RawPath = unescaped, p
+	}
+
+	if u.RawQuery != "" {
+		// by hand, not with url.Values: Encode would rewrite ?q as ?q= and Query drops
+		// parameters containing ';'
+		params := strings.Split(u.RawQuery, "&")
+		kept := make([]string, 0, len(params))
+		for _, param := range params {
+			k, _, _ := strings.Cut(param, "=")
+			if k, err := url.QueryUnescape(k); err == nil && isTrackingParam(k) {
+				continue
+			}
+			kept = append(kept, param)
+		}
+		if len(kept) < len(params) {
+			u.RawQuery = strings.Join(kept, "&")
+		}
+	}
+	u.ForceQuery = false
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
+
+// removeDotSegments resolves the "." and ".." segments of an absolute path as in
+// RFC 3986 section 5.2.4. A path ending in one of them keeps its trailing slash.
+func removeDotSegments(p string) string {
+	segs := strings.Split(p, "/")
+	out := make([]string, 0, len(segs))
+	for i, s := range segs {
+		last := i == len(segs)-1
+		switch s {
+		case ".":
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+			continue
+		}
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// canonicalURL parses and canonicalizes raw. It returns "" for non-http(s) URLs.
+func canonicalURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	canonicalizeURL(u)
+	return u.String()
+}
+
+// urlKey is the dedup key of a canonical URL: http and https variants of the same
+// page share a key.
+func urlKey(canonical string) string {
+	if i := strings.Index(canonical, "://"); i >= 0 {
+		return canonical[i+3:]
+	}
+	return canonical
+}
+
+// ---- near-duplicate pages ----
+
+const (
+	simhashShingle   = 3  // words per shingle
+	simhashMinTokens = 20 // shorter pages are too small to fingerprint reliably
+)
+
+// pageText returns the visible text of an HTML document (script and style are skipped)
+// and the src and alt of its images, so gallery pages that differ only in their
+// images don't look the same.
+func pageText(r io.Reader) string {
+	z := html.NewTokenizer(r)
+	var sb strings.Builder
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if s := string(name); s == "script" || s == "style" || s == "noscript" {
+				// <script/> too: like browsers, the tokenizer reads on to </script>
+				skip++
+			} else if s == "img" && skip == 0 {
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if k := string(key); k == "src" || k == "alt" {
+						sb.Write(val)
+						sb.WriteByte(' ')
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if s := string(name); (s == "script" || s == "style" || s == "noscript") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(z.Text())
+				sb.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// simhash computes the 64-bit SimHash of text over word shingles. ok is false if
+// the text is too short to give a meaningful fingerprint.
+func simhash(text string) (fp uint64, ok bool) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) < simhashMinTokens {
+		return 0, false
+	}
+	var v [64]int
+	h := fnv.New64a()
+	for i := 0; i+simhashShingle <= len(words); i++ {
+		h.Reset()
+		h.Write([]byte(strings.Join(words[i:i+simhashShingle], " ")))
+		x := h.Sum64()
+		for b := 0; b < 64; b++ {
+			if x&(1<<uint(b)) != 0 {
+				v[b]++
+			} else {
+				v[b]--
+			}
+		}
+	}
+	for b := 0; b < 64; b++ {
+		if v[b] > 0 {
+			fp |= 1 << uint(b)
+		}
+	}
+	return fp, true
+}
+
+// simhashIndex finds fingerprints within a Hamming distance of at most 3. The
+// fingerprint is split into four 16-bit blocks; two fingerprints that differ in at
+// most 3 bits must agree exactly on at least one block, so only those candidates
+// are compared.
+type simhashIndex struct {
+	mu     sync.Mutex
+	blocks [4]map[uint16][]simhashEntry
+}
+
+type simhashEntry struct {
+	fp  uint64
+	url string
+}
+
+const maxSimhashDistance = 3
+
+func newSimhashIndex() *simhashIndex {
+	x := &simhashIndex{}
+	for i := range x.blocks {
+		x.blocks[i] = make(map[uint16][]simhashEntry)
+	}
+	return x
+}
+
+// addOrMatch returns the URL of a page within maxDist bits of fp, or records fp for
+// pageURL and returns "". maxDist is capped at maxSimhashDistance.
+func (x *simhashIndex) addOrMatch(fp uint64, pageURL string, maxDist int) string {
+	if maxDist > maxSimhashDistance {
+		maxDist = maxSimhashDistance
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i := range x.blocks {
+		for _, e := range x.blocks[i][uint16(fp>>(16*uint(i)))] {
+			if bits.OnesCount64(e.fp^fp) <= maxDist {
+				return e.url
+			}
+		}
+	}
+	e := simhashEntry{fp: fp, url: pageURL}
+	for i := range x.blocks {
+		k := uint16(fp >> (16 * uint(i)))
+		x.blocks[i][k] = append(x.blocks[i][k], e)
+	}
+	return ""
+}
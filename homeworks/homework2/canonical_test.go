@@ -0,0 +1,87 @@
+package homework2
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"HTTP://Example.COM:80/a/./b/../c#top", "http://example.com/a/c"},
+		{"https://example.com:443", "https://example.com/"},
+		{"https://example.com:8443/", "https://example.com:8443/"},
+		{"http://user:pw@Example.com./", "http://example.com/"},
+		{"http://[::1]:8080/a", "http://[::1]:8080/a"},
+		{"mailto:someone@example.com", ""},
+		{"/relative/path", ""},
+
+		// escapes and trailing slashes name different resources
+		{"http://example.com/a%2Fb/c", "http://example.com/a%2Fb/c"},
+		{"http://example.com/%7Euser/", "http://example.com/%7Euser/"},
+		{"http://example.com/gallery/", "http://example.com/gallery/"},
+		{"http://example.com/gallery", "http://example.com/gallery"},
+		{"http://example.com/a/b/../", "http://example.com/a/"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/a/.", "http://example.com/a/"},
+		{"http://example.com/../../x", "http://example.com/x"},
+		{"http://example.com/..", "http://example.com/"},
+		{"http://example.com/a.b/c..d", "http://example.com/a.b/c..d"},
+
+		// the query is only rewritten to drop tracking parameters
+		{"http://example.com/x?q", "http://example.com/x?q"},
+		{"http://example.com/x?a=1;b=2", "http://example.com/x?a=1;b=2"},
+		{"http://example.com/x?b=2&a=1", "http://example.com/x?b=2&a=1"},
+		{"http://example.com/x?b=2&utm_source=news&a=%20", "http://example.com/x?b=2&a=%20"},
+		{"http://example.com/x?UTM_Medium=mail&fbclid=abc", "http://example.com/x"},
+		{"http://example.com/x?", "http://example.com/x"},
+	}
+	for _, tt := range tests {
+		if got := canonicalURL(tt.in); got != tt.want {
+			t.Errorf("canonicalURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPageText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`<p>Hello <b>world</b></p>`, "Hello  world "},
+		{`<script>var x</script><style>p{}</style><p>kept</p>`, "kept "},
+		{`<img src="/a.jpg" alt="A cat"><img src="/b.jpg"/>`, "/a.jpg A cat /b.jpg "},
+		{`<noscript><img src="/hidden.jpg"></noscript>`, ""},
+		{`<script/><p>swallowed</p>`, ""},
+	}
+	for _, tt := range tests {
+		if got := pageText(strings.NewReader(tt.in)); got != tt.want {
+			t.Errorf("pageText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSimhashGalleryPages(t *testing.T) {
+	// pages of a gallery share their text and differ in their images
+	boilerplate := strings.Repeat("<p>Our holiday photos from the seaside, page after page of them</p>", 3)
+	page := func(n int) uint64 {
+		var b strings.Builder
+		b.WriteString(boilerplate)
+		for i := 0; i < 12; i++ {
+			fmt.Fprintf(&b, `<img src="/photos/p%d-%d.jpg" alt="Beach photo %d">`, n, i, n*100+i)
+		}
+		fp, ok := simhash(pageText(strings.NewReader(b.String())))
+		if !ok {
+			t.Fatalf("page %d is too short to fingerprint", n)
+		}
+		return fp
+	}
+	// 3 is the default of -near-dup-distance
+	if d := hamming(page(1), page(2)); d <= 3 {
+		t.Errorf("gallery pages 1 and 2 are %d bits apart, near-duplicates", d)
+	}
+	if d := hamming(page(1), page(1)); d != 0 {
+		t.Errorf("the same page is %d bits apart", d)
+	}
+}
@@ -0,0 +1,261 @@
+package homework2
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Color statistics of raster images: a median-cut palette, the average color and the
+// Hasler-Süsstrunk colorfulness, plus the CIELAB distance used by the color filter.
+
+// PaletteColor is one dominant color and the share of (opaque) pixels it represents.
+type PaletteColor struct {
+	Color string  // #rrggbb
+	Share float64 // 0..1
+}
+
+const (
+	paletteSize    = 5
+	colorSampleMax = 64 // images are area-averaged to at most 64x64 before analysis
+)
+
+type rgb struct{ r, g, b float64 }
+
+// colorStats computes the palette (most common first), average color and
+// colorfulness of img. Fully transparent images have no colors.
+func colorStats(img image.Image) (palette []PaletteColor, avg string, colorfulness float64) {
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	if w == 0 || h == 0 {
+		return nil, "", 0
+	}
+	if w > colorSampleMax || h > colorSampleMax {
+		s := math.Min(float64(colorSampleMax)/float64(w), float64(colorSampleMax)/float64(h))
+		src = resample(src, int(math.Max(1, float64(w)*s)), int(math.Max(1, float64(h)*s)), resampleFilters["area"])
+	}
+
+	var px []rgb
+	var sum rgb
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		a := float64(src.Pix[i+3])
+		if a < 128 { // mostly transparent pixels are background, not the image's colors
+			continue
+		}
+		// un-premultiply
+		c := rgb{float64(src.Pix[i]) * 255 / a, float64(src.Pix[i+1]) * 255 / a, float64(src.Pix[i+2]) * 255 / a}
+		px = append(px, c)
+		sum.r += c.r
+		sum.g += c.g
+		sum.b += c.b
+	}
+	if len(px) == 0 {
+		return nil, "", 0
+	}
+	n := float64(len(px))
+	avg = hexColor(rgb{sum.r / n, sum.g / n, sum.b / n})
+	colorfulness = haslerColorfulness(px)
+	palette = medianCut(px, paletteSize)
+	return palette, avg, colorfulness
+}
+
+// medianCut splits the pixels into at most k boxes, always cutting the box with the
+// widest channel range at its median, and returns the boxes' mean colors.
+func medianCut(px []rgb, k int) []PaletteColor {
+	boxes := [][]rgb{px}
+	for len(boxes) < k {
+		best, bestRange, bestCh := -1, 0.0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			ch, r := widestChannel(b)
+			if r > bestRange {
+				best, bestRange, bestCh = i, r, ch
+			}
+		}
+		if best < 0 || bestRange < 8 { // remaining boxes are practically one color
+			break
+		}
+		b := boxes[best]
+		sort.Slice(b, func(i, j int) bool { return channel(b[i], bestCh) < channel(b[j], bestCh) })
+		// don't cut through a run of equal values: one flat color would end up in two boxes
+		mid := len(b) / 2
+		v := channel(b[mid], bestCh)
+		for mid > 0 && channel(b[mid-1], bestCh) == v {
+			mid--
+		}
+		if mid == 0 {
+			for mid < len(b) && channel(b[mid], bestCh) == v {
+				mid++
+			}
+		}
+		boxes[best] = b[:mid]
+		boxes = append(boxes, b[mid:])
+	}
+	total := float64(len(px))
+	out := make([]PaletteColor, 0, len(boxes))
+	for _, b := range boxes {
+		var s rgb
+		for _, c := range b {
+			s.r += c.r
+			s.g += c.g
+			s.b += c.b
+		}
+		n := float64(len(b))
+		out = append(out, PaletteColor{Color: hexColor(rgb{s.r / n, s.g / n, s.b / n}), Share: n / total})
+	}
+	// boxes of an almost flat image can end up with the same mean
+	merged := out[:0]
+	for _, c := range out {
+		dup := false
+		for i := range merged {
+			if merged[i].Color == c.Color {
+				merged[i].Share += c.Share
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			merged = append(merged, c)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Share > merged[j].Share })
+	return merged
+}
+
+func widestChannel(b []rgb) (ch int, r float64) {
+	lo := rgb{255, 255, 255}
+	var hi rgb
+	for _, c := range b {
+		lo = rgb{math.Min(lo.r, c.r), math.Min(lo.g, c.g), math.Min(lo.b, c.b)}
+		hi = rgb{math.Max(hi.r, c.r), math.Max(hi.g, c.g), math.Max(hi.b, c.b)}
+	}
+	ranges := []float64{hi.r - lo.r, hi.g - lo.g, hi.b - lo.b}
+	for i, v := range ranges {
+		if v > r {
+			ch, r = i, v
+		}
+	}
+	return ch, r
+}
+
+func channel(c rgb, ch int) float64 {
+	switch ch {
+	case 0:
+		return c.r
+	case 1:
+		return c.g
+	}
+	return c.b
+}
+
+// haslerColorfulness is the metric of Hasler and Süsstrunk (2003): roughly 0 for gray
+// images, 15 slightly, 33 moderately, 59 quite and 82+ extremely colorful.
+func haslerColorfulness(px []rgb) float64 {
+	var sumRG, sumYB, sqRG, sqYB float64
+	for _, c := range px {
+		rg := c.r - c.g
+		yb := (c.r+c.g)/2 - c.b
+		sumRG += rg
+		sumYB += yb
+		sqRG += rg * rg
+		sqYB += yb * yb
+	}
+	n := float64(len(px))
+	mRG, mYB := sumRG/n, sumYB/n
+	varRG := math.Max(0, sqRG/n-mRG*mRG)
+	varYB := math.Max(0, sqYB/n-mYB*mYB)
+	return math.Sqrt(varRG+varYB) + 0.3*math.Sqrt(mRG*mRG+mYB*mYB)
+}
+
+func hexColor(c rgb) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round(c.r)), uint8(math.Round(c.g)), uint8(math.Round(c.b)))
+}
+
+// parseHexColor parses "#rrggbb" or "#rgb".
+func parseHexColor(s string) (rgb, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return rgb{}, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return rgb{}, false
+	}
+	return rgb{float64(v >> 16), float64(v >> 8 & 0xFF), float64(v & 0xFF)}, true
+}
+
+// lab converts an sRGB color to CIELAB (D65 white point).
+func (c rgb) lab() (l, a, b float64) {
+	lin := func(v float64) float64 {
+		v /= 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	r, g, bl := lin(c.r), lin(c.g), lin(c.b)
+	x := (0.4124*r + 0.3576*g + 0.1805*bl) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*bl
+	z := (0.0193*r + 0.1192*g + 0.9505*bl) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// deltaE is the CIE76 color difference: about 2.3 is just noticeable, 10-20 reads as
+// "the same color family".
+func deltaE(c1, c2 rgb) float64 {
+	l1, a1, b1 := c1.lab()
+	l2, a2, b2 := c2.lab()
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// colorCoverage returns the share of the image whose palette colors are within maxDE
+// of target.
+func colorCoverage(palette []PaletteColor, target rgb, maxDE float64) float64 {
+	cover := 0.0
+	for _, p := range palette {
+		if c, ok := parseHexColor(p.Color); ok && deltaE(c, target) <= maxDE {
+			cover += p.Share
+		}
+	}
+	return cover
+}
+
+// encodePalette stores a palette as "#rrggbb:0.420 #rrggbb:0.310 ..." (SQL column).
+func encodePalette(p []PaletteColor) string {
+	parts := make([]string, len(p))
+	for i, c := range p {
+		parts[i] = fmt.Sprintf("%s:%.3f", c.Color, c.Share)
+	}
+	return strings.Join(parts, " ")
+}
+
+func decodePalette(s string) []PaletteColor {
+	var out []PaletteColor
+	for _, f := range strings.Fields(s) {
+		col, share, ok := strings.Cut(f, ":")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(share, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, PaletteColor{Color: col, Share: v})
+	}
+	return out
+}
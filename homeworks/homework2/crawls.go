@@ -0,0 +1,393 @@
+package homework2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Crawl jobs: the command line crawl and every crawl started over HTTP run as a Crawl
+// with its own Dispatcher, frontier and settings, side by side on the shared store.
+
+// Crawl states as reported by CrawlStatus.State.
+const (
+	CrawlRunning   = "running"
+	CrawlPaused    = "paused"
+	CrawlFinished  = "finished"  // nothing left to crawl
+	CrawlTimeout   = "timeout"   // CrawlConfig.Timeout expired
+	CrawlCancelled = "cancelled" // by the user or on shutdown
+)
+
+// ErrCrawlNotFound is returned for unknown crawl ids.
+var ErrCrawlNotFound = errors.New("crawl not found")
+
+// ErrCrawlEnded is returned when pausing or resuming a crawl that has stopped.
+var ErrCrawlEnded = errors.New("crawl has ended")
+
+// Crawl is one run of a Dispatcher.
+type Crawl struct {
+	ID         int
+	StartURLs  []string
+	Resumed    bool // continues the frontier of an earlier run
+	Config     CrawlConfig
+	StartedAt  time.Time
+	FinishedAt time.Time // zero while running
+	EndReason  string    // CrawlFinished, CrawlTimeout or CrawlCancelled once ended
+
+	dispatcher *Dispatcher     // nil once ended, so its frontier and state can be freed
+	final      DispatcherStats // the dispatcher's last stats, once ended
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// Done is closed once the crawl has stopped and its workers have exited.
+func (c *Crawl) Done() <-chan struct{} {
+	return c.done
+}
+
+// CrawlStatus is a Crawl together with the progress of its dispatcher.
+type CrawlStatus struct {
+	Crawl
+	State string
+	DispatcherStats
+}
+
+// maxEndedCrawls is the number of ended crawls whose status is kept; older ones are
+// forgotten.
+const maxEndedCrawls = 100
+
+// CrawlManager starts crawls and keeps track of them for the web UI and the API.
+type CrawlManager struct {
+	ctx      context.Context // parent of every crawl
+	store    ImageStore
+	defaults CrawlConfig
+	events   *EventBus
+
+	mu     sync.Mutex
+	crawls []*Crawl
+	nextID int
+	wg     sync.WaitGroup
+}
+
+// NewCrawlManager returns a manager whose crawls write to store and stop when ctx
+// ends. defaults are the settings of crawls that don't override them.
+func NewCrawlManager(ctx context.Context, store ImageStore, defaults CrawlConfig) *CrawlManager {
+	return &CrawlManager{ctx: ctx, store: store, defaults: defaults, events: NewEventBus(), nextID: 1}
+}
+
+// Events returns the bus the crawls publish their progress on (events.go).
+func (m *CrawlManager) Events() *EventBus {
+	return m.events
+}
+
+func (m *CrawlManager) publish(c *Crawl, e Event) {
+	e.Crawl = c.ID
+	m.events.Publish(e)
+}
+
+// Defaults returns the settings a new crawl starts from.
+func (m *CrawlManager) Defaults() CrawlConfig {
+	return m.defaults
+}
+
+// Start runs a crawl of startURLs with cfg in the background. frontier may be nil
+// for a crawl that isn't persisted.
+func (m *CrawlManager) Start(startURLs []string, cfg CrawlConfig, frontier *Frontier, resumed bool) *Crawl {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(m.ctx, cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(m.ctx)
+	}
+	m.mu.Lock()
+	c := &Crawl{
+		ID:         m.nextID,
+		StartURLs:  append([]string(nil), startURLs...),
+		Resumed:    resumed,
+		Config:     cfg,
+		StartedAt:  time.Now(),
+		dispatcher: NewDispatcher(cfg, m.store, frontier),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	c.dispatcher.emit = func(e Event) { m.publish(c, e) }
+	m.nextID++
+	m.crawls = append(m.crawls, c)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go m.run(ctx, c)
+	return c
+}
+
+func (m *CrawlManager) run(ctx context.Context, c *Crawl) {
+	defer m.wg.Done()
+	defer close(c.done)
+	defer c.cancel()
+	d := c.dispatcher
+	log.Printf("crawl %d: started with %d start URLs", c.ID, len(c.StartURLs))
+	m.publish(c, Event{Type: EventCrawlStarted})
+
+	runDone := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(runDone)
+	}()
+	d.Seed(ctx, c.StartURLs)
+	d.FinishSeeding()
+
+	// wait until the frontier drains or the context ends
+	reason := CrawlFinished
+	select {
+	case <-d.Done():
+	case <-ctx.Done():
+		reason = CrawlCancelled
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = CrawlTimeout
+		}
+	}
+	log.Printf("crawl %d: %s - stopping dispatcher", c.ID, reason)
+	c.cancel()
+	d.Stop()
+	<-runDone
+
+	final := d.Stats()
+	m.mu.Lock()
+	c.FinishedAt = time.Now()
+	c.EndReason = reason
+	c.final, c.dispatcher = final, nil
+	m.forgetEndedLocked()
+	m.mu.Unlock()
+	m.publish(c, Event{Type: EventCrawlEnded, Reason: reason})
+}
+
+// forgetEndedLocked drops the oldest ended crawls beyond maxEndedCrawls.
+func (m *CrawlManager) forgetEndedLocked() {
+	ended := 0
+	for _, c := range m.crawls {
+		if !c.FinishedAt.IsZero() {
+			ended++
+		}
+	}
+	kept := m.crawls[:0]
+	for _, c := range m.crawls {
+		if ended > maxEndedCrawls && !c.FinishedAt.IsZero() {
+			ended--
+			continue
+		}
+		kept = append(kept, c)
+	}
+	clear(m.crawls[len(kept):])
+	m.crawls = kept
+}
+
+func (m *CrawlManager) get(id int) (*Crawl, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.crawls {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, ErrCrawlNotFound
+}
+
+// Pause stops crawl id from fetching new pages. The timeout keeps running.
+func (m *CrawlManager) Pause(id int) error {
+	c, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	d := m.running(c)
+	if d == nil {
+		return ErrCrawlEnded
+	}
+	d.Pause()
+	m.publish(c, Event{Type: EventCrawlPaused})
+	return nil
+}
+
+// Resume continues a paused crawl.
+func (m *CrawlManager) Resume(id int) error {
+	c, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	d := m.running(c)
+	if d == nil {
+		return ErrCrawlEnded
+	}
+	d.Resume()
+	m.publish(c, Event{Type: EventCrawlResumed})
+	return nil
+}
+
+// Cancel stops crawl id. Cancelling a crawl that has ended is a no-op.
+func (m *CrawlManager) Cancel(id int) error {
+	c, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	c.cancel()
+	return nil
+}
+
+// CancelAll stops every running crawl.
+func (m *CrawlManager) CancelAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.crawls {
+		c.cancel()
+	}
+}
+
+// Wait blocks until every crawl has stopped.
+func (m *CrawlManager) Wait() {
+	m.wg.Wait()
+}
+
+// running returns the dispatcher of c, nil if c has ended.
+func (m *CrawlManager) running(c *Crawl) *Dispatcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !c.FinishedAt.IsZero() {
+		return nil
+	}
+	return c.dispatcher
+}
+
+// Status returns the status of crawl id.
+func (m *CrawlManager) Status(id int) (CrawlStatus, error) {
+	c, err := m.get(id)
+	if err != nil {
+		return CrawlStatus{}, err
+	}
+	return m.status(c), nil
+}
+
+// List returns the status of every crawl, newest first.
+func (m *CrawlManager) List() []CrawlStatus {
+	m.mu.Lock()
+	crawls := append([]*Crawl(nil), m.crawls...)
+	m.mu.Unlock()
+	out := make([]CrawlStatus, 0, len(crawls))
+	for i := len(crawls) - 1; i >= 0; i-- {
+		out = append(out, m.status(crawls[i]))
+	}
+	return out
+}
+
+func (m *CrawlManager) status(c *Crawl) CrawlStatus {
+	var stats DispatcherStats
+	if d := m.running(c); d != nil {
+		stats = d.Stats()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !c.FinishedAt.IsZero() {
+		stats = c.final
+	}
+	s := CrawlStatus{Crawl: *c, DispatcherStats: stats}
+	switch {
+	case !c.FinishedAt.IsZero():
+		s.State = c.EndReason
+	case stats.Paused:
+		s.State = CrawlPaused
+	default:
+		s.State = CrawlRunning
+	}
+	return s
+}
+
+// Bounds of the per-job settings accepted over HTTP.
+const (
+	maxJobWorkers = 64
+	maxJobTimeout = 24 * time.Hour
+)
+
+// crawlRequest is a crawl job submitted over HTTP, by the API as JSON or by the web
+// UI as a form. Unset fields take the server's defaults; 0 limits mean unlimited and
+// a "0" timeout none at all.
+type crawlRequest struct {
+	URLs            []string `json:"urls"`
+	Workers         *int     `json:"workers,omitempty"`
+	MaxDepth        *int     `json:"max_depth,omitempty"`
+	MaxPages        *int     `json:"max_pages,omitempty"`
+	MaxPagesPerHost *int     `json:"max_pages_per_host,omitempty"`
+	FollowExternal  *bool    `json:"follow_external,omitempty"`
+	EnableJS        *bool    `json:"enable_js,omitempty"`
+	Sitemaps        *bool    `json:"sitemaps,omitempty"`
+	Feeds           *bool    `json:"feeds,omitempty"`
+	Timeout         string   `json:"timeout,omitempty"` // e.g. "10m"
+}
+
+// config validates r and applies it to defaults.
+func (r crawlRequest) config(defaults CrawlConfig) (CrawlConfig, error) {
+	cfg := defaults
+	if len(r.URLs) == 0 {
+		return cfg, errors.New("urls: at least one start URL is required")
+	}
+	for _, u := range r.URLs {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return cfg, fmt.Errorf("urls: %q is not an http(s) URL", u)
+		}
+	}
+	if r.Workers != nil {
+		if *r.Workers < 1 || *r.Workers > maxJobWorkers {
+			return cfg, fmt.Errorf("workers: want 1-%d", maxJobWorkers)
+		}
+		cfg.Workers = *r.Workers
+	}
+	for _, l := range []struct {
+		name string
+		v    *int
+		dst  *int
+	}{
+		{"max_depth", r.MaxDepth, &cfg.Limits.MaxDepth},
+		{"max_pages", r.MaxPages, &cfg.Limits.MaxPages},
+		{"max_pages_per_host", r.MaxPagesPerHost, &cfg.Limits.MaxPagesPerHost},
+	} {
+		if l.v == nil {
+			continue
+		}
+		if *l.v < 0 {
+			return cfg, fmt.Errorf("%s: want a non-negative integer", l.name)
+		}
+		*l.dst = *l.v
+	}
+	if r.FollowExternal != nil {
+		cfg.FollowExternal = *r.FollowExternal
+	}
+	if r.EnableJS != nil {
+		cfg.EnableJS = *r.EnableJS
+	}
+	if r.Sitemaps != nil {
+		cfg.Sitemaps = *r.Sitemaps
+	}
+	if r.Feeds != nil {
+		cfg.Feeds = *r.Feeds
+	}
+	if r.Timeout != "" {
+		d, err := time.ParseDuration(r.Timeout)
+		if err != nil || d < 0 || d > maxJobTimeout {
+			return cfg, fmt.Errorf("timeout: want a duration up to %s, e.g. 10m", maxJobTimeout)
+		}
+		cfg.Timeout = d
+	}
+	return cfg, nil
+}
+
+// crawlActions are the operations on a running crawl offered by the API and the web UI.
+func crawlActions(m *CrawlManager) map[string]func(id int) error {
+	return map[string]func(id int) error{
+		"pause":  m.Pause,
+		"resume": m.Resume,
+		"cancel": m.Cancel,
+	}
+}
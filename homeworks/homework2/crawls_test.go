@@ -0,0 +1,34 @@
+package homework2
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCrawlManagerForgetsEndedCrawls(t *testing.T) {
+	m := NewCrawlManager(context.Background(), NewMemoryStore(), CrawlConfig{Workers: 1})
+	for i := 0; i < maxEndedCrawls+5; i++ {
+		// no start URLs: the crawl finishes at once
+		c := m.Start(nil, m.Defaults(), nil, false)
+		<-c.Done()
+	}
+	m.Wait()
+	list := m.List()
+	if len(list) != maxEndedCrawls {
+		t.Fatalf("%d crawls listed, want %d", len(list), maxEndedCrawls)
+	}
+	if list[0].ID != maxEndedCrawls+5 || list[0].State != CrawlFinished {
+		t.Errorf("newest crawl is %d, %s", list[0].ID, list[0].State)
+	}
+	if _, err := m.Status(1); err != ErrCrawlNotFound {
+		t.Errorf("oldest crawl: %v, want ErrCrawlNotFound", err)
+	}
+	for _, s := range list {
+		if s.dispatcher != nil {
+			t.Fatalf("crawl %d still holds its dispatcher", s.ID)
+		}
+	}
+	if err := m.Pause(list[0].ID); err != ErrCrawlEnded {
+		t.Errorf("Pause of an ended crawl: %v, want ErrCrawlEnded", err)
+	}
+}
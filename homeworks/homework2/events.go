@@ -0,0 +1,229 @@
+package homework2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawl events: dispatchers and the CrawlManager publish what they do on an
+// EventBus, and GET /api/v1/events streams it to the browser as Server-Sent Events.
+
+// Event types.
+const (
+	EventCrawlStarted = "crawl_started"
+	EventCrawlPaused  = "crawl_paused"
+	EventCrawlResumed = "crawl_resumed"
+	EventCrawlEnded   = "crawl_ended"
+	EventPageFetched  = "page_fetched"
+	EventLinkEnqueued = "link_enqueued"
+	EventLinkDropped  = "link_dropped"
+	EventImageSaved   = "image_saved"
+	EventImageStale   = "image_stale"
+	EventImageSkipped = "image_skipped"
+	EventError        = "error"
+)
+
+var eventTypes = map[string]bool{
+	EventCrawlStarted: true, EventCrawlPaused: true, EventCrawlResumed: true, EventCrawlEnded: true,
+	EventPageFetched: true, EventLinkEnqueued: true, EventLinkDropped: true, EventImageSaved: true,
+	EventImageStale: true, EventImageSkipped: true, EventError: true,
+}
+
+// Event is one step of a crawl.
+type Event struct {
+	Seq    int64 // assigned by the bus, increasing from 1
+	Time   time.Time
+	Crawl  int
+	Type   string
+	URL    string     // the page, link or image
+	Depth  int        // of pages and links
+	Reason string     // why a link was dropped or an image skipped, how a crawl ended, or "unchanged" for a page
+	Err    string     // of EventError
+	Image  *ImageMeta // of EventImageSaved and EventImageStale
+}
+
+const (
+	eventHistory     = 1000 // events kept for clients that reconnect
+	subscriberBuffer = 256
+	eventKeepAlive   = 25 * time.Second
+)
+
+// EventBus fans events out to subscribers. A subscriber that falls behind by more
+// than its buffer is dropped; an SSE client then reconnects and catches up from the
+// history. Publishing on a nil bus does nothing.
+type EventBus struct {
+	mu      sync.Mutex
+	seq     int64
+	history []Event // the last eventHistory events, oldest first
+	subs    map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish numbers e and sends it to every subscriber without blocking.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	if len(b.history) == eventHistory {
+		b.history = b.history[1:]
+	}
+	b.history = append(b.history, e)
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the events after sequence number after that are still in the
+// history (none for after <= 0), and a channel of the events that follow. The
+// channel is closed by cancel or when the subscriber falls behind.
+func (b *EventBus) Subscribe(after int64) (backlog []Event, events <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if after > 0 {
+		for _, e := range b.history {
+			if e.Seq > after {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.subs[ch] = struct{}{}
+	return backlog, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+type apiEvent struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Crawl  int       `json:"crawl"`
+	Type   string    `json:"type"`
+	URL    string    `json:"url,omitempty"`
+	Depth  int       `json:"depth,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Image  *apiImage `json:"image,omitempty"`
+}
+
+func toAPIEvent(e Event) apiEvent {
+	out := apiEvent{
+		Seq: e.Seq, Time: e.Time, Crawl: e.Crawl, Type: e.Type,
+		URL: e.URL, Depth: e.Depth, Reason: e.Reason, Error: e.Err,
+	}
+	if e.Image != nil {
+		im := toAPIImage(*e.Image)
+		out.Image = &im
+	}
+	return out
+}
+
+// serveEvents streams the events of m's crawls as text/event-stream. type (a comma
+// separated list) and crawl select which ones; a reconnecting EventSource resumes
+// after its Last-Event-ID.
+func serveEvents(m *CrawlManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		types := make(map[string]bool)
+		for _, t := range strings.Split(q.Get("type"), ",") {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			if !eventTypes[t] {
+				apiError(w, http.StatusBadRequest, fmt.Sprintf("type: unknown event type %q", t))
+				return
+			}
+			types[t] = true
+		}
+		crawl := 0
+		if s := q.Get("crawl"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				apiError(w, http.StatusBadRequest, "crawl: want a crawl id")
+				return
+			}
+			crawl = n
+		}
+		after, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apiError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+
+		backlog, events, cancel := m.Events().Subscribe(after)
+		defer cancel()
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Accel-Buffering", "no") // don't let a reverse proxy buffer the stream
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		send := func(e Event) error {
+			if (len(types) > 0 && !types[e.Type]) || (crawl != 0 && e.Crawl != crawl) {
+				return nil
+			}
+			data, err := json.Marshal(toAPIEvent(e))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+			return err
+		}
+		for _, e := range backlog {
+			if send(e) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					// fell behind: end the stream and let the client catch up
+					return
+				}
+				if send(e) != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-m.ctx.Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package homework2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+)
+
+// Minimal EXIF reader: finds the APP1 "Exif" segment of a JPEG and walks the TIFF
+// structure inside it.
+
+// TIFF/EXIF tags read by exifOrientation and readEXIFMeta.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagArtist           = 0x013B
+	tagCopyright        = 0x8298
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTimeOrig   = 0x9011
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+
+	gpsLatitudeRef  = 1
+	gpsLatitude     = 2
+	gpsLongitudeRef = 3
+	gpsLongitude    = 4
+)
+
+var errNoEXIF = errors.New("exif: not found")
+
+// jpegEXIF returns the TIFF block of a JPEG's APP1 Exif segment.
+func jpegEXIF(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, errNoEXIF
+	}
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return nil, errNoEXIF
+		}
+		marker := b[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image: no more metadata
+			return nil, errNoEXIF
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil, errNoEXIF
+		}
+		seg := b[i+4 : i+2+n]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:], nil
+		}
+		i += 2 + n
+	}
+	return nil, errNoEXIF
+}
+
+// tiffReader reads IFDs from a TIFF/EXIF block.
+type tiffReader struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+// tiffEntry is one IFD field; Value holds Count values of Type, already resolved
+// from the offset if they didn't fit in the entry.
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+var tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+func newTIFFReader(b []byte) (*tiffReader, uint32, error) {
+	if len(b) < 8 {
+		return nil, 0, errNoEXIF
+	}
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, 0, errors.New("exif: bad byte order")
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return nil, 0, errors.New("exif: bad magic")
+	}
+	return t, t.bo.Uint32(b[4:]), nil
+}
+
+// ifd reads the directory at off and returns its entries by tag and the offset of
+// the next IFD (0 if none).
+func (t *tiffReader) ifd(off uint32) (map[uint16]tiffEntry, uint32, error) {
+	if off < 8 || int64(off)+2 > int64(len(t.b)) {
+		return nil, 0, errors.New("exif: bad IFD offset")
+	}
+	n := uint32(t.bo.Uint16(t.b[off:]))
+	end := int64(off) + 2 + int64(n)*12
+	if end+4 > int64(len(t.b)) {
+		return nil, 0, errors.New("exif: truncated IFD")
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := uint32(0); i < n; i++ {
+		e := t.b[off+2+i*12:]
+		typ := t.bo.Uint16(e[2:])
+		count := t.bo.Uint32(e[4:])
+		size, ok := tiffTypeSize[typ]
+		if !ok {
+			continue
+		}
+		total := int64(size) * int64(count)
+		var val []byte
+		if total <= 4 {
+			val = e[8 : 8+total]
+		} else {
+			p := int64(t.bo.Uint32(e[8:]))
+			if p+total > int64(len(t.b)) {
+				continue
+			}
+			val = t.b[p : p+total]
+		}
+		entries[t.bo.Uint16(e)] = tiffEntry{Type: typ, Count: count, Value: val}
+	}
+	return entries, t.bo.Uint32(t.b[end:]), nil
+}
+
+// uint returns value i of an integer entry (BYTE, SHORT or LONG).
+func (t *tiffReader) uint(e tiffEntry, i int) (uint32, bool) {
+	if i < 0 || uint32(i) >= e.Count {
+		return 0, false
+	}
+	switch e.Type {
+	case 1, 7:
+		return uint32(e.Value[i]), true
+	case 3:
+		return uint32(t.bo.Uint16(e.Value[2*i:])), true
+	case 4:
+		return t.bo.Uint32(e.Value[4*i:]), true
+	}
+	return 0, false
+}
+
+// string returns an ASCII entry without its NUL terminator and padding.
+func (t *tiffReader) string(e tiffEntry) string {
+	if e.Type != 2 {
+		return ""
+	}
+	s := e.Value
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(bytes.TrimSpace(s))
+}
+
+// rational returns value i of a RATIONAL entry as a float.
+func (t *tiffReader) rational(e tiffEntry, i int) (float64, bool) {
+	if e.Type != 5 || i < 0 || uint32(i) >= e.Count {
+		return 0, false
+	}
+	num := t.bo.Uint32(e.Value[8*i:])
+	den := t.bo.Uint32(e.Value[8*i+4:])
+	if den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG, 1 if unknown.
+func exifOrientation(b []byte) int {
+	raw, err := jpegEXIF(b)
+	if err != nil {
+		return 1
+	}
+	t, off, err := newTIFFReader(raw)
+	if err != nil {
+		return 1
+	}
+	ifd0, _, err := t.ifd(off)
+	if err != nil {
+		return 1
+	}
+	if v, ok := t.uint(ifd0[tagOrientation], 0); ok && v >= 1 && v <= 8 {
+		return int(v)
+	}
+	return 1
+}
+
+// applyOrientation returns img transformed so it displays upright for the given EXIF
+// orientation. Orientations 5-8 swap width and height.
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := sw, sh
+	if o >= 5 {
+		dw, dh = sh, sw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored
+				sx, sy = sw-1-x, y
+			case 3: // rotated 180
+				sx, sy = sw-1-x, sh-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, sh-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90 clockwise
+				sx, sy = y, sh-1-x
+			case 7: // transversed
+				sx, sy = sw-1-y, sh-1-x
+			case 8: // needs 90 counter-clockwise
+				sx, sy = sw-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+4*x:y*dst.Stride+4*x+4], src.Pix[sy*src.Stride+4*sx:])
+		}
+	}
+	return dst
+}
+
+// toRGBA returns img as an *image.RGBA with origin (0,0), converting if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if r, ok := img.(*image.RGBA); ok && r.Rect.Min == (image.Point{}) {
+		return r
+	}
+	b := img.Bounds()
+	r := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(r, r.Rect, img, b.Min, draw.Src)
+	return r
+}
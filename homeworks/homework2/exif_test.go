@@ -0,0 +1,200 @@
+package homework2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// exifField is an IFD entry for buildTIFF; sub, if set, makes it a LONG pointing at
+// IFD number sub.
+type exifField struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+	sub      int
+}
+
+func asciiField(tag uint16, s string) exifField {
+	return exifField{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func shortField(tag, v uint16) exifField {
+	return exifField{tag: tag, typ: 3, count: 1, data: binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func rationalField(tag uint16, v ...uint32) exifField {
+	var data []byte
+	for _, n := range v {
+		data = binary.LittleEndian.AppendUint32(data, n)
+	}
+	return exifField{tag: tag, typ: 5, count: uint32(len(v) / 2), data: data}
+}
+
+// buildTIFF lays out a little-endian TIFF block with ifds[0] as IFD0 and the others
+// reachable through sub fields.
+func buildTIFF(ifds ...[]exifField) []byte {
+	offsets := make([]int, len(ifds))
+	off := 8
+	for i, fields := range ifds {
+		offsets[i] = off
+		off += 2 + 12*len(fields) + 4
+		for _, f := range fields {
+			if len(f.data) > 4 {
+				off += len(f.data) + len(f.data)&1
+			}
+		}
+	}
+	b := []byte("II\x2a\x00\x08\x00\x00\x00")
+	for i, fields := range ifds {
+		extra := offsets[i] + 2 + 12*len(fields) + 4
+		var data []byte
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.LittleEndian.AppendUint16(b, f.tag)
+			if f.sub > 0 {
+				b = binary.LittleEndian.AppendUint16(b, 4)
+				b = binary.LittleEndian.AppendUint32(b, 1)
+				b = binary.LittleEndian.AppendUint32(b, uint32(offsets[f.sub]))
+				continue
+			}
+			b = binary.LittleEndian.AppendUint16(b, f.typ)
+			b = binary.LittleEndian.AppendUint32(b, f.count)
+			if len(f.data) <= 4 {
+				b = append(b, f.data...)
+				b = append(b, make([]byte, 4-len(f.data))...)
+				continue
+			}
+			b = binary.LittleEndian.AppendUint32(b, uint32(extra+len(data)))
+			data = append(data, f.data...)
+			if len(f.data)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+		b = append(b, 0, 0, 0, 0) // no next IFD
+		b = append(b, data...)
+	}
+	return b
+}
+
+// jpegSegment encodes a JPEG marker segment.
+func jpegSegment(marker byte, data []byte) []byte {
+	b := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)+2))
+	return append(b, data...)
+}
+
+// jpegWith wraps segments in SOI ... SOS so the readers stop at the image data.
+func jpegWith(segments ...[]byte) []byte {
+	b := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, 0xFF, 0xDA, 0, 2)
+}
+
+func exifJPEG(tiff []byte) []byte {
+	return jpegWith(jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...)))
+}
+
+func TestExifOrientation(t *testing.T) {
+	orientation := func(v uint16) []byte {
+		return exifJPEG(buildTIFF([]exifField{shortField(tagOrientation, v)}))
+	}
+	valid := orientation(6)
+	tests := []struct {
+		name string
+		in   []byte
+		want int
+	}{
+		{"rotated", valid, 6},
+		{"after other segments", jpegWith(jpegSegment(0xE0, []byte("JFIF\x00")), valid[2:len(valid)-4]), 6},
+		{"out of range", orientation(9), 1},
+		{"zero", orientation(0), 1},
+		{"wrong type", exifJPEG(buildTIFF([]exifField{asciiField(tagOrientation, "6")})), 1},
+		{"no exif", jpegWith(jpegSegment(0xE0, []byte("JFIF\x00"))), 1},
+		{"after the scan", append(jpegWith(), valid[2:]...), 1},
+		{"bad byte order", exifJPEG([]byte("XX\x2a\x00\x08\x00\x00\x00")), 1},
+		{"bad magic", exifJPEG([]byte("II\x2b\x00\x08\x00\x00\x00")), 1},
+		{"IFD past the end", exifJPEG([]byte("II\x2a\x00\xff\xff\xff\x7f")), 1},
+		{"IFD in the header", exifJPEG([]byte("II\x2a\x00\x00\x00\x00\x00\x00\x00")), 1},
+		{"huge entry count", exifJPEG([]byte("II\x2a\x00\x08\x00\x00\x00\xff\xff")), 1},
+		{"segment past the end", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E'}, 1},
+		{"segment length 0", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0, 0, 0}, 1},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.in); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	for n := range valid {
+		if got := exifOrientation(valid[:n]); got != 1 && got != 6 {
+			t.Errorf("exifOrientation(%d of %d bytes) = %d", n, len(valid), got)
+		}
+	}
+}
+
+func TestTIFFValueOutOfBounds(t *testing.T) {
+	// a LONG array and a string whose data offsets point past the block
+	b := buildTIFF([]exifField{
+		{tag: tagMake, typ: 2, count: 100, data: bytes.Repeat([]byte{'a'}, 100)},
+		{tag: tagOrientation, typ: 4, count: 0xFFFFFFFF, data: make([]byte, 8)},
+	})
+	binary.LittleEndian.PutUint32(b[8+2+8:], 0xFFFFFF00)
+	r, off, err := newTIFFReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifd, _, err := r.ifd(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifd) != 0 {
+		t.Errorf("ifd kept %d entries with out of bounds values", len(ifd))
+	}
+	if _, ok := r.uint(tiffEntry{Type: 3, Count: 1, Value: []byte{1, 0}}, 1); ok {
+		t.Error("uint read past Count")
+	}
+	if _, ok := r.rational(tiffEntry{Type: 5, Count: 1, Value: make([]byte, 8)}, 0); ok {
+		t.Error("rational divided by zero")
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// a 2x1 image, red then blue
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+	tests := []struct {
+		o          int
+		w, h       int
+		first, end color.RGBA // at (0,0) and (w-1,h-1)
+	}{
+		{1, 2, 1, red, blue},
+		{2, 2, 1, blue, red},
+		{3, 2, 1, blue, red},
+		{4, 2, 1, red, blue},
+		{5, 1, 2, red, blue},
+		{6, 1, 2, red, blue},
+		{7, 1, 2, blue, red},
+		{8, 1, 2, blue, red},
+		{9, 2, 1, red, blue},
+	}
+	for _, tt := range tests {
+		img := applyOrientation(src, tt.o)
+		b := img.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("applyOrientation(%d) is %dx%d, want %dx%d", tt.o, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if img.At(0, 0) != tt.first || img.At(tt.w-1, tt.h-1) != tt.end {
+			t.Errorf("applyOrientation(%d) = %v ... %v, want %v ... %v",
+				tt.o, img.At(0, 0), img.At(tt.w-1, tt.h-1), tt.first, tt.end)
+		}
+	}
+}
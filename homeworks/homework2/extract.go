@@ -0,0 +1,162 @@
+package homework2
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Discovery sources recorded in ImageRef.Source / ImageMeta.Source.
+const (
+	SourceImg          = "img"
+	SourceSrcset       = "srcset"
+	SourceDataSrc      = "data-src"
+	SourcePicture      = "picture"
+	SourceStyle        = "style"
+	SourceCSS          = "css"
+	SourceOpenGraph    = "og:image"
+	SourceTwitterImage = "twitter:image"
+)
+
+const (
+	maxStylesheetsPerPage = 10
+	maxStylesheetBytes    = 1 << 20
+)
+
+// srcsetCandidate is one entry of a srcset attribute.
+type srcsetCandidate struct {
+	URL     string
+	Width   int     // "480w" descriptor, 0 if absent
+	Density float64 // "2x" descriptor, 1 if absent
+}
+
+// parseSrcset splits a srcset attribute ("a.jpg 480w, b.jpg 2x") into candidates.
+func parseSrcset(s string) []srcsetCandidate {
+	var out []srcsetCandidate
+	i := 0
+	for i < len(s) {
+		// skip separators
+		for i < len(s) && (s[i] == ',' || isSpace(s[i])) {
+			i++
+		}
+		start := i
+		for i < len(s) && !isSpace(s[i]) {
+			i++
+		}
+		u := s[start:i]
+		descr := ""
+		if strings.HasSuffix(u, ",") {
+			// "a.jpg, b.jpg" - no descriptor
+			u = strings.TrimRight(u, ",")
+		} else {
+			start = i
+			for i < len(s) && s[i] != ',' {
+				i++
+			}
+			descr = strings.TrimSpace(s[start:i])
+		}
+		if u == "" {
+			continue
+		}
+		c := srcsetCandidate{URL: u, Density: 1}
+		for _, d := range strings.Fields(descr) {
+			switch {
+			case strings.HasSuffix(d, "w"):
+				if v, err := strconv.Atoi(strings.TrimSuffix(d, "w")); err == nil {
+					c.Width = v
+				}
+			case strings.HasSuffix(d, "x"):
+				if v, err := strconv.ParseFloat(strings.TrimSuffix(d, "x"), 64); err == nil {
+					c.Density = v
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// largestCandidate returns the index of the biggest srcset candidate: width
+// descriptors win over densities.
+func largestCandidate(cs []srcsetCandidate) int {
+	best := 0
+	for i, c := range cs {
+		b := cs[best]
+		if c.Width > b.Width || (c.Width == b.Width && c.Density > b.Density) {
+			best = i
+		}
+	}
+	return best
+}
+
+var cssURLRe = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+var cssImportRe = regexp.MustCompile(`(?i)@import\s+(?:url\()?\s*["']?([^"')\s;]+)`)
+
+// nonImageExt are url() targets in stylesheets that are never images (fonts, imports).
+var nonImageExt = map[string]bool{
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true, ".css": true,
+	".htc": true, ".cur": true,
+}
+
+// cssImageURLs returns the url(...) references of a stylesheet or style attribute
+// that can be images, resolved against base.
+func cssImageURLs(css string, base *url.URL) []string {
+	imports := map[string]bool{}
+	for _, m := range cssImportRe.FindAllStringSubmatch(css, -1) {
+		imports[m[1]] = true
+	}
+	var out []string
+	for _, m := range cssURLRe.FindAllStringSubmatch(css, -1) {
+		raw := m[1] + m[2] + m[3]
+		if raw == "" || imports[raw] {
+			continue
+		}
+		s := sanitizeURL(raw, base)
+		if s == "" {
+			continue
+		}
+		if u, err := url.Parse(s); err == nil && nonImageExt[strings.ToLower(path.Ext(u.Path))] {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// fetchStylesheetImages downloads a linked stylesheet and returns the images it references.
+func (d *Dispatcher) fetchStylesheetImages(ctx context.Context, cssURL string) ([]ImageRef, error) {
+	res, err := d.fetch(ctx, fetchRequest{
+		Kind: "stylesheet", URL: cssURL, MaxBytes: maxStylesheetBytes, Truncate: true,
+		Types: []string{"text/css", "text/plain"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var imgs []ImageRef
+	// url()s are relative to where the stylesheet ended up after redirects
+	for _, s := range cssImageURLs(string(res.Body), res.URL) {
+		imgs = append(imgs, ImageRef{Src: s, Source: SourceCSS})
+	}
+	return imgs, nil
+}
+
+// uniqueImages drops repeated image URLs, keeping the first discovery.
+func uniqueImages(in []ImageRef) []ImageRef {
+	seen := map[string]bool{}
+	out := make([]ImageRef, 0, len(in))
+	for _, im := range in {
+		if seen[im.Src] {
+			continue
+		}
+		seen[im.Src] = true
+		out = append(out, im)
+	}
+	return out
+}
@@ -0,0 +1,331 @@
+package homework2
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+)
+
+// Fetching: every page, stylesheet, image and sitemap is downloaded by one Fetcher
+// shared by all crawls, so connections to a host are kept alive and reused. A 5xx,
+// 429 or timeout is retried with exponential backoff and jitter (or after Retry-After,
+// if the server says how long), bodies are size limited and decompressed from gzip or
+// brotli, pages are converted to UTF-8 from their charset, and the redirects a
+// response went through are reported.
+
+// FetchOptions configure a Fetcher.
+type FetchOptions struct {
+	Timeout      time.Duration // of one attempt, body included
+	Retries      int           // attempts after the first one
+	Backoff      time.Duration // before the first retry, doubled for each further one
+	MaxBackoff   time.Duration // longest wait between attempts, Retry-After included
+	MaxBytes     int64         // body limit of requests that don't set their own
+	MaxRedirects int
+}
+
+func DefaultFetchOptions() FetchOptions {
+	return FetchOptions{
+		Timeout:      20 * time.Second,
+		Retries:      2,
+		Backoff:      500 * time.Millisecond,
+		MaxBackoff:   30 * time.Second,
+		MaxBytes:     32 << 20,
+		MaxRedirects: 10,
+	}
+}
+
+// Fetcher is the HTTP client of the crawler.
+type Fetcher struct {
+	opts   FetchOptions
+	client *http.Client
+}
+
+func NewFetcher(opts FetchOptions) *Fetcher {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 200
+	t.MaxIdleConnsPerHost = 16
+	t.IdleConnTimeout = 90 * time.Second
+	t.DisableCompression = true // Accept-Encoding is set and undone by fetch, br included
+	return &Fetcher{
+		opts: opts,
+		client: &http.Client{
+			Transport: t,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > opts.MaxRedirects {
+					return fmt.Errorf("stopped after %d redirects", opts.MaxRedirects)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// fetchRequest describes one download.
+type fetchRequest struct {
+	Kind         string // for the metrics: page, stylesheet, image, sitemap or robots
+	Method       string // GET if empty
+	URL          string
+	ETag         string // validators of an earlier response, to be answered with 304
+	LastModified string
+	MaxBytes     int64    // 0 = FetchOptions.MaxBytes
+	Truncate     bool     // keep the first MaxBytes of a longer body instead of failing
+	Types        []string // acceptable media types, patterns like text/*; empty = any
+	UTF8         bool     // convert the body to UTF-8 from its charset
+
+	// Wait, if set, is called before each retry, so retries respect the host's rate
+	// limit like the first attempt; usually Politeness.Wait.
+	Wait func(ctx context.Context) error
+}
+
+// fetchResponse is the result of a request that got a 200, or a 304 to a conditional
+// one.
+type fetchResponse struct {
+	StatusCode int
+	Header     http.Header
+	URL        *url.URL // after redirects
+	Redirects  []string // the URLs redirected from, the requested one first
+	Body       []byte   // decompressed
+	MediaType  string   // from Content-Type, else sniffed
+	Charset    string   // of the body as received, with UTF8
+}
+
+// errTooLarge is returned for bodies over the limit of the request.
+var errTooLarge = errors.New("body too large")
+
+// statusError is a response other than 200 or an expected 304.
+type statusError struct {
+	code       int
+	retryAfter time.Duration // 0 if not given
+}
+
+func (e *statusError) Error() string { return fmt.Sprintf("non-200: %d", e.code) }
+
+// Fetch downloads r.URL, retrying failures that may be temporary.
+func (f *Fetcher) Fetch(ctx context.Context, r fetchRequest) (*fetchResponse, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := f.fetchOnce(ctx, r)
+		if err == nil || attempt >= f.opts.Retries || ctx.Err() != nil {
+			return res, err
+		}
+		wait, ok := f.retryWait(err, attempt)
+		if !ok {
+			return res, err
+		}
+		metricRetries.Inc(r.Kind)
+		log.Printf("fetch: %s: %v - retry %d of %d in %v", r.URL, err, attempt+1, f.opts.Retries, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.Wait != nil {
+			if err := r.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryWait decides whether the failed attempt-th attempt is retried and how long to
+// wait before it: exponential backoff with jitter, or Retry-After if the server gave one
+// that isn't too long.
+func (f *Fetcher) retryWait(err error, attempt int) (time.Duration, bool) {
+	var se *statusError
+	var ne net.Error
+	switch {
+	case errors.As(err, &se):
+		if se.code != http.StatusTooManyRequests && se.code < 500 {
+			return 0, false
+		}
+	case errors.As(err, &ne) && ne.Timeout():
+	default:
+		return 0, false
+	}
+	wait := f.opts.Backoff << attempt
+	if wait <= 0 || wait > f.opts.MaxBackoff {
+		wait = f.opts.MaxBackoff
+	}
+	// "equal jitter": half the backoff plus a random part of the other half
+	wait = wait/2 + rand.N(wait/2+1)
+	if se != nil && se.retryAfter > 0 {
+		if se.retryAfter > f.opts.MaxBackoff {
+			return 0, false
+		}
+		wait = max(wait, se.retryAfter)
+	}
+	return wait, true
+}
+
+// parseRetryAfter parses a Retry-After header, delay-seconds or an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+func (f *Fetcher) fetchOnce(ctx context.Context, r fetchRequest) (*fetchResponse, error) {
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	conditional(req, r.ETag, r.LastModified)
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		observeFetch(r.Kind, start, nil, 0)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &fetchResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		URL:        resp.Request.URL,
+		Redirects:  redirectChain(resp),
+	}
+	if len(res.Redirects) > 0 {
+		metricRedirects.Add(float64(len(res.Redirects)), r.Kind)
+	}
+	conditionalReq := r.ETag != "" || r.LastModified != ""
+	switch {
+	case resp.StatusCode == http.StatusNotModified && conditionalReq:
+		observeFetch(r.Kind, start, resp, 0)
+		return res, nil
+	case resp.StatusCode != http.StatusOK:
+		observeFetch(r.Kind, start, resp, 0)
+		return res, &statusError{code: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	case method == http.MethodHead:
+		observeFetch(r.Kind, start, resp, 0)
+		return res, nil
+	}
+
+	res.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err := checkMediaType(r.Types, res.MediaType); err != nil {
+		observeFetch(r.Kind, start, resp, 0)
+		return res, err
+	}
+	limit := r.MaxBytes
+	if limit <= 0 {
+		limit = f.opts.MaxBytes
+	}
+	if resp.ContentLength > limit && !r.Truncate && resp.Header.Get("Content-Encoding") == "" {
+		observeFetch(r.Kind, start, resp, 0)
+		return res, fmt.Errorf("%w: %d bytes, limit %d", errTooLarge, resp.ContentLength, limit)
+	}
+	wire := &countingReader{r: resp.Body}
+	body, err := decompress(resp.Header.Get("Content-Encoding"), wire)
+	if err == nil {
+		// one byte more, to tell a body of exactly limit bytes from a longer one
+		res.Body, err = io.ReadAll(io.LimitReader(body, limit+1))
+	}
+	observeFetch(r.Kind, start, resp, int(wire.n))
+	if err != nil {
+		return res, err
+	}
+	if int64(len(res.Body)) > limit {
+		if !r.Truncate {
+			return res, fmt.Errorf("%w: limit %d", errTooLarge, limit)
+		}
+		res.Body = res.Body[:limit]
+	}
+	if res.MediaType == "" {
+		res.MediaType, _, _ = mime.ParseMediaType(http.DetectContentType(res.Body))
+		if err := checkMediaType(r.Types, res.MediaType); err != nil {
+			return res, err
+		}
+	}
+	if r.UTF8 {
+		enc, name, certain := charset.DetermineEncoding(res.Body, resp.Header.Get("Content-Type"))
+		if !certain && utf8.Valid(res.Body) {
+			// the guess only looks at the first 1KB, which may be all ASCII
+			name = "utf-8"
+		}
+		res.Charset = name
+		if name != "utf-8" {
+			if res.Body, err = enc.NewDecoder().Bytes(res.Body); err != nil {
+				return res, fmt.Errorf("charset %s: %v", name, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// checkMediaType checks the media type of a response against the acceptable ones.
+func checkMediaType(types []string, mediaType string) error {
+	if len(types) == 0 || mediaType == "" {
+		return nil
+	}
+	for _, t := range types {
+		if ok, _ := path.Match(t, mediaType); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected Content-Type %s", mediaType)
+}
+
+// decompress undoes the Content-Encoding of a body.
+func decompress(encoding string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+// redirectChain returns the URLs resp was redirected from, the requested one first.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		chain = append(chain, req.Response.Request.URL.String())
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// countingReader counts the bytes read through it, i.e. those on the wire.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,33 @@
+package homework2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFetchRetryWaits(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	waits := 0
+	res, err := testFetcher().Fetch(context.Background(), fetchRequest{
+		Kind: "page", URL: srv.URL,
+		Wait: func(context.Context) error { waits++; return nil },
+	})
+	if err != nil || string(res.Body) != "ok" {
+		t.Fatalf("Fetch = %v, %v", res, err)
+	}
+	// the caller waits before the first attempt, Fetch before each retry
+	if waits != 2 {
+		t.Errorf("waited %d times before retries, want 2", waits)
+	}
+}
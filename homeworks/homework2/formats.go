@@ -0,0 +1,383 @@
+package homework2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"time"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// Decoders beyond jpeg/png: gif from the standard library, bmp/tiff/webp from
+// golang.org/x/image and ico below. Animated GIF and WebP are reduced to their first
+// frame; frame count and total duration are reported separately.
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+}
+
+// maxImagePixels bounds the canvas an image may claim before anything is allocated
+// for it: a few bytes of header can ask for gigabytes.
+const maxImagePixels = 50_000_000
+
+// checkPixels rejects dimensions over maxImagePixels.
+func checkPixels(width, height int) error {
+	if int64(width)*int64(height) > maxImagePixels {
+		return fmt.Errorf("%dx%d is over the limit of %d pixels", width, height, maxImagePixels)
+	}
+	return nil
+}
+
+// decodeImage decodes b, whose format was reported by image.DecodeConfig. For
+// animations it returns the first frame composited on the full canvas, the number of
+// frames and the total duration of one loop; still images report 0 frames.
+func decodeImage(b []byte, format string) (img image.Image, frames int, dur time.Duration, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+		return nil, 0, 0, err
+	}
+	switch format {
+	case "gif":
+		// only the first frame is decoded: gif.DecodeAll would keep every frame of a
+		// long animation in memory at once
+		first, err := gif.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if frames, dur = gifFrames(b); frames < 2 {
+			frames, dur = 0, 0
+		}
+		// frames may cover only part of the logical screen, whose size cfg is
+		canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+		draw.Draw(canvas, first.Bounds(), first, first.Bounds().Min, draw.Over)
+		return canvas, frames, dur, nil
+	case "webp":
+		if info, ok := parseAnimatedWebP(b); ok {
+			img, err := info.firstFrame()
+			return img, info.frames, info.duration, err
+		}
+	}
+	img, _, err = image.Decode(bytes.NewReader(b))
+	return img, 0, 0, err
+}
+
+// gifFrames counts the frames of a GIF and adds up their delays by walking its blocks,
+// without decoding any pixels. A truncated file reports the frames found so far.
+func gifFrames(b []byte) (frames int, dur time.Duration) {
+	if len(b) < 13 {
+		return 0, 0
+	}
+	p := 13 // header and logical screen descriptor
+	if b[10]&0x80 != 0 {
+		p += 3 << (b[10]&7 + 1) // global color table
+	}
+	delay := 0
+	// skipSubBlocks returns the position after the data sub-blocks starting at p
+	skipSubBlocks := func(p int) int {
+		for p < len(b) && b[p] != 0 {
+			p += 1 + int(b[p])
+		}
+		return p + 1
+	}
+	for p < len(b) {
+		switch b[p] {
+		case 0x21: // extension
+			if p+1 >= len(b) {
+				return frames, dur
+			}
+			if b[p+1] == 0xF9 && p+7 < len(b) && b[p+2] == 4 {
+				// graphic control extension, delay in hundredths of a second
+				delay = int(b[p+4]) | int(b[p+5])<<8
+			}
+			p = skipSubBlocks(p + 2)
+		case 0x2C: // image descriptor
+			if p+10 > len(b) {
+				return frames, dur
+			}
+			packed := b[p+9]
+			p += 10
+			if packed&0x80 != 0 {
+				p += 3 << (packed&7 + 1) // local color table
+			}
+			p = skipSubBlocks(p + 1) // after the LZW minimum code size
+			frames++
+			dur += time.Duration(delay) * 10 * time.Millisecond
+			delay = 0
+		default: // 0x3B trailer, or garbage
+			return frames, dur
+		}
+	}
+	return frames, dur
+}
+
+// ---- animated WebP ----
+
+// webpAnimation describes an animated WebP (VP8X with the animation flag).
+type webpAnimation struct {
+	width, height int
+	frames        int
+	duration      time.Duration
+	first         []byte // payload of the first ANMF chunk
+}
+
+// parseAnimatedWebP walks the RIFF chunks of an extended WebP file. ok is false for
+// still images, which x/image/webp decodes directly.
+func parseAnimatedWebP(b []byte) (a webpAnimation, ok bool) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return a, false
+	}
+	animated := false
+	for p := 12; p+8 <= len(b); {
+		id := string(b[p : p+4])
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		data := b[p+8:]
+		if n < 0 || n > len(data) {
+			break
+		}
+		data = data[:n]
+		switch id {
+		case "VP8X":
+			if n < 10 {
+				return a, false
+			}
+			animated = data[0]&(1<<1) != 0
+			a.width = int(uint24(data[4:])) + 1
+			a.height = int(uint24(data[7:])) + 1
+		case "ANMF":
+			if n < 16 {
+				break
+			}
+			a.frames++
+			a.duration += time.Duration(uint24(data[12:])) * time.Millisecond
+			if a.first == nil {
+				a.first = data
+			}
+		}
+		p += 8 + n + n&1 // chunks are padded to even sizes
+	}
+	return a, animated && a.first != nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// firstFrame decodes the first ANMF frame by wrapping its bitstream chunks in a
+// still-image container, then places it on the canvas at its offset.
+func (a webpAnimation) firstFrame() (image.Image, error) {
+	f := a.first
+	x, y := int(uint24(f[0:]))*2, int(uint24(f[3:]))*2
+	w, h := int(uint24(f[6:]))+1, int(uint24(f[9:]))+1
+	chunks := f[16:]
+	for _, size := range [][2]int{{a.width, a.height}, {w, h}} {
+		if err := checkPixels(size[0], size[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if bytes.HasPrefix(chunks, []byte("ALPH")) {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 1 << 4 // alpha
+		putUint24(vp8x[4:], uint32(w-1))
+		putUint24(vp8x[7:], uint32(h-1))
+		body.WriteString("VP8X")
+		binary.Write(&body, binary.LittleEndian, uint32(len(vp8x)))
+		body.Write(vp8x)
+	}
+	body.Write(chunks)
+	var riff bytes.Buffer
+	riff.WriteString("RIFF")
+	binary.Write(&riff, binary.LittleEndian, uint32(body.Len()))
+	riff.Write(body.Bytes())
+
+	frame, err := webp.Decode(&riff)
+	if err != nil {
+		return nil, fmt.Errorf("webp first frame: %v", err)
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, a.width, a.height))
+	draw.Draw(canvas, image.Rect(x, y, x+w, y+h), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// ---- ICO ----
+
+// icoEntry is one ICONDIRENTRY.
+type icoEntry struct {
+	width, height int
+	bitCount      int
+	size, offset  uint32
+}
+
+var errICO = errors.New("ico: invalid format")
+
+func readICODir(b []byte) ([]icoEntry, error) {
+	if len(b) < 6 || binary.LittleEndian.Uint16(b[2:]) != 1 {
+		return nil, errICO
+	}
+	n := int(binary.LittleEndian.Uint16(b[4:]))
+	if n == 0 || len(b) < 6+16*n {
+		return nil, errICO
+	}
+	entries := make([]icoEntry, n)
+	for i := range entries {
+		e := b[6+16*i:]
+		w, h := int(e[0]), int(e[1])
+		if w == 0 {
+			w = 256
+		}
+		if h == 0 {
+			h = 256
+		}
+		entries[i] = icoEntry{
+			width: w, height: h,
+			bitCount: int(binary.LittleEndian.Uint16(e[6:])),
+			size:     binary.LittleEndian.Uint32(e[8:]),
+			offset:   binary.LittleEndian.Uint32(e[12:]),
+		}
+	}
+	return entries, nil
+}
+
+// bestICOEntry picks the largest, then deepest, icon.
+func bestICOEntry(entries []icoEntry) icoEntry {
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if e.width*e.height > best.width*best.height ||
+			(e.width*e.height == best.width*best.height && e.bitCount > best.bitCount) {
+			best = e
+		}
+	}
+	return best
+}
+
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	entries, err := readICODir(b)
+	if err != nil {
+		return image.Config{}, err
+	}
+	e := bestICOEntry(entries)
+	return image.Config{ColorModel: color.NRGBAModel, Width: e.width, Height: e.height}, nil
+}
+
+func decodeICO(r io.Reader) (image.Image, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readICODir(b)
+	if err != nil {
+		return nil, err
+	}
+	e := bestICOEntry(entries)
+	if int64(e.offset)+int64(e.size) > int64(len(b)) {
+		return nil, errICO
+	}
+	data := b[e.offset : e.offset+e.size]
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decodeICODIB(data)
+}
+
+// decodeICODIB decodes the headerless BMP used inside icons: a BITMAPINFOHEADER with
+// doubled height, the color bitmap (1/4/8/24/32 bpp, bottom-up) and a 1 bpp AND mask.
+func decodeICODIB(d []byte) (image.Image, error) {
+	if len(d) < 40 {
+		return nil, errICO
+	}
+	hdr := binary.LittleEndian.Uint32(d)
+	w := int(int32(binary.LittleEndian.Uint32(d[4:])))
+	h := int(int32(binary.LittleEndian.Uint32(d[8:]))) / 2
+	bpp := int(binary.LittleEndian.Uint16(d[14:]))
+	colors := int(binary.LittleEndian.Uint32(d[32:]))
+	if w <= 0 || h <= 0 || w > 1024 || h > 1024 || hdr < 40 || int(hdr) > len(d) {
+		return nil, errICO
+	}
+	p := int(hdr)
+	var palette []color.NRGBA
+	if bpp <= 8 {
+		if colors == 0 {
+			colors = 1 << bpp
+		}
+		if p+4*colors > len(d) {
+			return nil, errICO
+		}
+		for i := 0; i < colors; i++ {
+			c := d[p+4*i:]
+			palette = append(palette, color.NRGBA{c[2], c[1], c[0], 0xFF})
+		}
+		p += 4 * colors
+	}
+	stride := (w*bpp + 31) / 32 * 4
+	maskStride := (w + 31) / 32 * 4
+	if p+stride*h > len(d) {
+		return nil, errICO
+	}
+	hasMask := p+stride*h+maskStride*h <= len(d)
+	// old 32 bpp icons leave the alpha bytes zero and rely on the mask
+	useAlpha := false
+	if bpp == 32 {
+		for i := 3; i < stride*h; i += 4 {
+			if d[p+i] != 0 {
+				useAlpha = true
+				break
+			}
+		}
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := d[p+(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				idx := int(row[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if idx < len(palette) {
+					c = palette[idx]
+				}
+			case 24:
+				c = color.NRGBA{row[3*x+2], row[3*x+1], row[3*x], 0xFF}
+			case 32:
+				c = color.NRGBA{row[4*x+2], row[4*x+1], row[4*x], 0xFF}
+				if useAlpha {
+					c.A = row[4*x+3]
+				}
+			default:
+				return nil, fmt.Errorf("ico: unsupported bit depth %d", bpp)
+			}
+			// the AND mask carries transparency for icons without an alpha channel
+			if hasMask && !useAlpha {
+				mrow := d[p+stride*h+(h-1-y)*maskStride:]
+				if mrow[x/8]&(0x80>>(x%8)) != 0 {
+					c.A = 0
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
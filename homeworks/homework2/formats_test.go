@@ -0,0 +1,298 @@
+package homework2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"golang.org/x/image/bmp"
+)
+
+// animatedGIF encodes a GIF of n frames of w x h, each delayed delay hundredths.
+func animatedGIF(t *testing.T, w, h, n, delay int) []byte {
+	t.Helper()
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{Config: image.Config{ColorModel: pal, Width: w, Height: h}}
+	for i := 0; i < n; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), pal))
+		g.Delay = append(g.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrames(t *testing.T) {
+	anim := animatedGIF(t, 8, 4, 5, 7)
+	tests := []struct {
+		name   string
+		in     []byte
+		frames int
+		dur    time.Duration
+	}{
+		{"animation", anim, 5, 350 * time.Millisecond},
+		{"still", animatedGIF(t, 3, 3, 1, 0), 1, 0},
+		{"truncated", anim[:len(anim)/2], 2, 140 * time.Millisecond},
+		{"header only", anim[:13], 0, 0},
+		{"empty", nil, 0, 0},
+		{"garbage", []byte("GIF89a\x01\x00\x01\x00\xff\x00\x00"), 0, 0},
+	}
+	for _, tt := range tests {
+		frames, dur := gifFrames(tt.in)
+		if frames != tt.frames || dur != tt.dur {
+			t.Errorf("%s: gifFrames = %d, %v, want %d, %v", tt.name, frames, dur, tt.frames, tt.dur)
+		}
+	}
+}
+
+func TestDecodeImageGIF(t *testing.T) {
+	// a 4000x4000 logical screen is 16 MP, under the limit, and its 5 frames are
+	// never held in memory together
+	img, frames, dur, err := decodeImage(animatedGIF(t, 4000, 4000, 5, 10), "gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 4000, 4000) || frames != 5 || dur != 500*time.Millisecond {
+		t.Errorf("decodeImage = %v, %d frames, %v", img.Bounds(), frames, dur)
+	}
+	if _, frames, _, err := decodeImage(animatedGIF(t, 2, 2, 1, 0), "gif"); err != nil || frames != 0 {
+		t.Errorf("still GIF: %d frames, %v", frames, err)
+	}
+}
+
+func TestCheckPixels(t *testing.T) {
+	tests := []struct {
+		w, h int
+		ok   bool
+	}{
+		{1, 1, true},
+		{10000, 5000, true},
+		{10000, 5001, false},
+		{1 << 31, 1 << 31, false}, // doesn't overflow into a small product
+		{0, 1 << 40, true},
+	}
+	for _, tt := range tests {
+		if err := checkPixels(tt.w, tt.h); (err == nil) != tt.ok {
+			t.Errorf("checkPixels(%d, %d) = %v, want ok %v", tt.w, tt.h, err, tt.ok)
+		}
+	}
+}
+
+// icoFile builds an ICO with one entry per image, which are PNGs or raw DIBs.
+func icoFile(sizes [][2]int, images ...[]byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 1, 0, byte(len(images)), 0})
+	offset := 6 + 16*len(images)
+	for i, img := range images {
+		e := make([]byte, 16)
+		e[0], e[1] = byte(sizes[i][0]), byte(sizes[i][1])
+		binary.LittleEndian.PutUint16(e[6:], 32)
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(img)))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		b.Write(e)
+		offset += len(img)
+	}
+	for _, img := range images {
+		b.Write(img)
+	}
+	return b.Bytes()
+}
+
+// icoDIB builds the 24 bpp bitmap of an icon: one color, with an AND mask that makes
+// the top left pixel transparent.
+func icoDIB(w, h int, c color.NRGBA) []byte {
+	d := make([]byte, 40)
+	binary.LittleEndian.PutUint32(d, 40)
+	binary.LittleEndian.PutUint32(d[4:], uint32(w))
+	binary.LittleEndian.PutUint32(d[8:], uint32(2*h))
+	binary.LittleEndian.PutUint16(d[12:], 1)
+	binary.LittleEndian.PutUint16(d[14:], 24)
+	stride := (w*24 + 31) / 32 * 4
+	for y := 0; y < h; y++ {
+		row := make([]byte, stride)
+		for x := 0; x < w; x++ {
+			row[3*x], row[3*x+1], row[3*x+2] = c.B, c.G, c.R
+		}
+		d = append(d, row...)
+	}
+	maskStride := (w + 31) / 32 * 4
+	mask := make([]byte, maskStride*h)
+	mask[(h-1)*maskStride] = 0x80 // rows are bottom-up
+	return append(d, mask...)
+}
+
+func pngBytes(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeICO(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	dib := icoFile([][2]int{{4, 3}}, icoDIB(4, 3, red))
+	img, err := decodeICO(bytes.NewReader(dib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 4, 3) {
+		t.Errorf("DIB icon is %v", img.Bounds())
+	}
+	if got := color.NRGBAModel.Convert(img.At(1, 1)); got != red {
+		t.Errorf("DIB icon pixel = %v, want %v", got, red)
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Error("AND mask ignored")
+	}
+
+	// the largest icon is picked, and 0 means 256
+	both := icoFile([][2]int{{4, 3}, {0, 0}}, icoDIB(4, 3, red), pngBytes(t, 256, 256))
+	cfg, err := decodeICOConfig(bytes.NewReader(both))
+	if err != nil || cfg.Width != 256 || cfg.Height != 256 {
+		t.Errorf("decodeICOConfig = %+v, %v", cfg, err)
+	}
+	if img, err := decodeICO(bytes.NewReader(both)); err != nil || img.Bounds().Dx() != 256 {
+		t.Errorf("PNG icon: %v, %v", img, err)
+	}
+
+	badDepth := icoDIB(4, 3, red)
+	binary.LittleEndian.PutUint16(badDepth[14:], 7)
+	huge := icoDIB(4, 3, red)
+	binary.LittleEndian.PutUint32(huge[4:], 1<<30)
+	negative := icoDIB(4, 3, red)
+	binary.LittleEndian.PutUint32(negative[8:], 0xFFFFFFF0)
+	manyColors := icoDIB(4, 3, red)
+	binary.LittleEndian.PutUint16(manyColors[14:], 8)
+	binary.LittleEndian.PutUint32(manyColors[32:], 0xFFFFFFFF)
+	beyondEOF := icoFile([][2]int{{4, 3}}, icoDIB(4, 3, red))
+	binary.LittleEndian.PutUint32(beyondEOF[6+12:], 0xFFFFFFF0)
+	for name, b := range map[string][]byte{
+		"empty":       nil,
+		"not an icon": []byte("\x00\x00\x02\x00\x01\x00"),
+		"no entries":  []byte("\x00\x00\x01\x00\x00\x00"),
+		"short dir":   []byte("\x00\x00\x01\x00\x05\x00"),
+		"bad depth":   icoFile([][2]int{{4, 3}}, badDepth),
+		"huge":        icoFile([][2]int{{4, 3}}, huge),
+		"negative":    icoFile([][2]int{{4, 3}}, negative),
+		"palette":     icoFile([][2]int{{4, 3}}, manyColors),
+		"beyond EOF":  beyondEOF,
+		"bad PNG":     icoFile([][2]int{{4, 3}}, []byte("\x89PNG garbage")),
+	} {
+		if _, err := decodeICO(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+	// every truncation fails cleanly
+	for n := range dib {
+		decodeICO(bytes.NewReader(dib[:n]))
+	}
+}
+
+// riffChunk encodes a RIFF chunk, padded to an even size.
+func riffChunk(id string, data []byte) []byte {
+	b := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func riffFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	b := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	return append(b, body...)
+}
+
+func vp8x(flags byte, w, h int) []byte {
+	d := make([]byte, 10)
+	d[0] = flags
+	putUint24(d[4:], uint32(w-1))
+	putUint24(d[7:], uint32(h-1))
+	return riffChunk("VP8X", d)
+}
+
+func anmf(x, y, w, h, durMs int, frame []byte) []byte {
+	d := make([]byte, 16)
+	putUint24(d[0:], uint32(x/2))
+	putUint24(d[3:], uint32(y/2))
+	putUint24(d[6:], uint32(w-1))
+	putUint24(d[9:], uint32(h-1))
+	putUint24(d[12:], uint32(durMs))
+	return riffChunk("ANMF", append(d, frame...))
+}
+
+func TestParseAnimatedWebP(t *testing.T) {
+	const animated = 1 << 1
+	frame := riffChunk("VP8L", []byte("not really a bitstream"))
+	tests := []struct {
+		name     string
+		in       []byte
+		ok       bool
+		frames   int
+		duration time.Duration
+	}{
+		{"animation", riffFile(vp8x(animated, 100, 50), anmf(0, 0, 100, 50, 40, frame), anmf(10, 10, 20, 20, 60, frame)), true, 2, 100 * time.Millisecond},
+		{"odd chunk padded", riffFile(riffChunk("ICCP", []byte{1, 2, 3}), vp8x(animated, 8, 8), anmf(0, 0, 8, 8, 10, frame)), true, 1, 10 * time.Millisecond},
+		{"still", riffFile(vp8x(0, 8, 8), riffChunk("VP8L", []byte{1})), false, 0, 0},
+		{"animated without frames", riffFile(vp8x(animated, 8, 8)), false, 0, 0},
+		{"short VP8X", riffFile(riffChunk("VP8X", []byte{animated}), anmf(0, 0, 8, 8, 10, frame)), false, 0, 0},
+		{"short ANMF", riffFile(vp8x(animated, 8, 8), riffChunk("ANMF", []byte{1, 2, 3})), false, 0, 0},
+		{"chunk past EOF", riffFile(vp8x(animated, 8, 8), []byte("ANMF\xff\xff\xff\x7f")), false, 0, 0},
+		{"not RIFF", []byte("GIF89a"), false, 0, 0},
+		{"empty", nil, false, 0, 0},
+	}
+	for _, tt := range tests {
+		a, ok := parseAnimatedWebP(tt.in)
+		if ok != tt.ok || (ok && (a.frames != tt.frames || a.duration != tt.duration)) {
+			t.Errorf("%s: parseAnimatedWebP = %d frames, %v, %v, want %d, %v, %v",
+				tt.name, a.frames, a.duration, ok, tt.frames, tt.duration, tt.ok)
+		}
+	}
+
+	bad, _ := parseAnimatedWebP(riffFile(vp8x(animated, 8, 8), anmf(0, 0, 8, 8, 10, frame)))
+	if _, err := bad.firstFrame(); err == nil {
+		t.Error("firstFrame decoded a bogus bitstream")
+	}
+	huge, _ := parseAnimatedWebP(riffFile(vp8x(animated, 1<<24, 1<<24), anmf(0, 0, 8, 8, 10, frame)))
+	if _, err := huge.firstFrame(); err == nil {
+		t.Error("firstFrame allocated a 16777216x16777216 canvas")
+	}
+}
+
+func TestDecodeImageBMP(t *testing.T) {
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 5, 3))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if img, frames, _, err := decodeImage(b, "bmp"); err != nil || img.Bounds().Dx() != 5 || frames != 0 {
+		t.Errorf("decodeImage(bmp) = %v, %d frames, %v", img, frames, err)
+	}
+	// a 54 byte header claiming 100000x100000 pixels
+	huge := append([]byte(nil), b[:54]...)
+	binary.LittleEndian.PutUint32(huge[18:], 100000)
+	binary.LittleEndian.PutUint32(huge[22:], 100000)
+	if _, _, _, err := decodeImage(huge, "bmp"); err == nil {
+		t.Error("decoded a 100000x100000 BMP")
+	}
+	for n := range b {
+		if _, _, _, err := decodeImage(b[:n], "bmp"); err == nil && n < len(b) {
+			t.Errorf("decoded %d of %d bytes", n, len(b))
+		}
+	}
+}
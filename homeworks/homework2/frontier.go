@@ -0,0 +1,317 @@
+package homework2
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frontier is the crawl queue plus the set of URLs already scheduled. It is unbounded,
+// so discovered URLs are never dropped, and when backed by a file it survives restarts:
+// every scheduled and every completed URL is appended to a JSON lines log, and on resume
+// all scheduled-but-not-completed URLs are queued again. Jobs come out best score
+// first, see priority.go.
+type Frontier struct {
+	mu     sync.Mutex
+	rules  *ScoringRules
+	hosts  map[string]*hostQueue
+	active hostHeap              // the hosts with queued jobs
+	queued map[string]*queuedJob // keyed by urlKey, while waiting
+	seq    int64
+	seen   map[string]frontierEntry // keyed by urlKey
+	notify chan struct{}
+
+	f *os.File
+	w *bufio.Writer
+}
+
+type frontierEntry struct {
+	URL     string
+	Depth   int
+	Images  int
+	LastMod time.Time
+	Done    bool
+}
+
+// frontierRecord is one line of the frontier log.
+type frontierRecord struct {
+	Op     string `json:"op"` // "seen" or "done"
+	URL    string `json:"url"`
+	Depth  int    `json:"depth,omitempty"`
+	Images int    `json:"images,omitempty"`
+
+	LastMod time.Time `json:"lastmod,omitzero"`
+}
+
+// NewMemoryFrontier returns a frontier that is not persisted.
+func NewMemoryFrontier() *Frontier {
+	rules := DefaultScoringRules()
+	return &Frontier{
+		rules:  rules,
+		hosts:  make(map[string]*hostQueue),
+		active: hostHeap{weight: rules.Host},
+		queued: make(map[string]*queuedJob),
+		seen:   make(map[string]frontierEntry),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// OpenFrontier opens the frontier log at path. With resume the previous crawl state is
+// loaded from it, otherwise it is truncated.
+func OpenFrontier(path string, resume bool) (*Frontier, error) {
+	fr := NewMemoryFrontier()
+	order := []string{}
+	if resume {
+		b, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for i, line := range bytes.Split(b, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var rec frontierRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				// most likely the torn last line of a killed crawl
+				log.Printf("frontier: %s:%d: %v - skipped", path, i+1, err)
+				continue
+			}
+			key := urlKey(rec.URL)
+			switch rec.Op {
+			case "seen":
+				if _, ok := fr.seen[key]; !ok {
+					order = append(order, key)
+				}
+				fr.seen[key] = frontierEntry{URL: rec.URL, Depth: rec.Depth, Images: rec.Images, LastMod: rec.LastMod}
+			case "done":
+				if e, ok := fr.seen[key]; ok {
+					e.Done = true
+					fr.seen[key] = e
+				}
+			}
+		}
+	}
+
+	// rewrite the log compacted: one seen record per URL, one done record per completed URL
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	fr.f, fr.w = f, bufio.NewWriter(f)
+	for _, key := range order {
+		e := fr.seen[key]
+		if err := fr.appendLocked(frontierRecord{Op: "seen", URL: e.URL, Depth: e.Depth, Images: e.Images, LastMod: e.LastMod}); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if e.Done {
+			err = fr.appendLocked(frontierRecord{Op: "done", URL: e.URL})
+		} else {
+			fr.enqueueLocked(key, Job{URL: e.URL, Depth: e.Depth, Images: e.Images, LastMod: e.LastMod})
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if resume {
+		log.Printf("frontier: resumed %d urls, %d still queued", len(fr.seen), len(fr.queued))
+	}
+	return fr, nil
+}
+
+// SetRules changes how queued jobs are scored and reorders the queue.
+func (fr *Frontier) SetRules(r *ScoringRules) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.rules = r
+	for _, q := range fr.queued {
+		q.score = r.score(q.Job, q.inLinks)
+	}
+	for _, h := range fr.active.queues {
+		heap.Init(&h.jobs)
+	}
+	fr.active.weight = r.Host
+	heap.Init(&fr.active)
+}
+
+// Seen reports whether u (or its http/https twin) has already been scheduled.
+func (fr *Frontier) Seen(u string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	_, ok := fr.seen[urlKey(u)]
+	return ok
+}
+
+// Push schedules job unless its URL has been seen before.
+func (fr *Frontier) Push(job Job) (bool, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	key := urlKey(job.URL)
+	if _, ok := fr.seen[key]; ok {
+		return false, nil
+	}
+	if err := fr.appendLocked(frontierRecord{Op: "seen", URL: job.URL, Depth: job.Depth, Images: job.Images, LastMod: job.LastMod}); err != nil {
+		return false, err
+	}
+	fr.seen[key] = frontierEntry{URL: job.URL, Depth: job.Depth, Images: job.Images, LastMod: job.LastMod}
+	fr.enqueueLocked(key, job)
+	select {
+	case fr.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+func (fr *Frontier) enqueueLocked(key string, job Job) {
+	fr.seq++
+	q := &queuedJob{Job: job, inLinks: 1, seq: fr.seq}
+	q.score = fr.rules.score(job, q.inLinks)
+	host := hostOf(job.URL)
+	h := fr.hosts[host]
+	if h == nil {
+		h = &hostQueue{index: -1}
+		fr.hosts[host] = h
+	}
+	heap.Push(&h.jobs, q)
+	if h.index < 0 {
+		heap.Push(&fr.active, h)
+	} else {
+		heap.Fix(&fr.active, h.index)
+	}
+	fr.queued[key] = q
+}
+
+// Link records another link to job's URL. If it is still queued, it moves up by the
+// in-link weight, and takes job's image count if that is higher.
+func (fr *Frontier) Link(job Job) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	q, ok := fr.queued[urlKey(job.URL)]
+	if !ok {
+		return
+	}
+	q.inLinks++
+	if job.Images > q.Images {
+		q.Images = job.Images
+	}
+	if job.LastMod.After(q.LastMod) {
+		q.LastMod = job.LastMod
+	}
+	q.score = fr.rules.score(q.Job, q.inLinks)
+	h := fr.hosts[hostOf(q.URL)]
+	heap.Fix(&h.jobs, q.index)
+	heap.Fix(&fr.active, h.index)
+}
+
+// popLocked takes the best job of the host whose best job scores highest once the
+// host's share of the crawl so far is accounted for.
+func (fr *Frontier) popLocked() (Job, bool) {
+	if fr.active.Len() == 0 {
+		return Job{}, false
+	}
+	best := fr.active.queues[0]
+	q := heap.Pop(&best.jobs).(*queuedJob)
+	best.served++
+	if len(best.jobs) == 0 {
+		heap.Pop(&fr.active)
+	} else {
+		heap.Fix(&fr.active, 0)
+	}
+	delete(fr.queued, urlKey(q.URL))
+	return q.Job, true
+}
+
+// Pop blocks until a job is available or ctx is done.
+func (fr *Frontier) Pop(ctx context.Context) (Job, bool) {
+	for {
+		fr.mu.Lock()
+		if job, ok := fr.popLocked(); ok {
+			if len(fr.queued) > 0 {
+				// wake up the next waiter, if any
+				select {
+				case fr.notify <- struct{}{}:
+				default:
+				}
+			}
+			fr.mu.Unlock()
+			return job, true
+		}
+		fr.mu.Unlock()
+		select {
+		case <-fr.notify:
+		case <-ctx.Done():
+			return Job{}, false
+		}
+	}
+}
+
+// Complete records that job has been processed, so a resumed crawl won't repeat it.
+func (fr *Frontier) Complete(job Job) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	key := urlKey(job.URL)
+	e, ok := fr.seen[key]
+	if !ok || e.Done {
+		return nil
+	}
+	e.Done = true
+	fr.seen[key] = e
+	return fr.appendLocked(frontierRecord{Op: "done", URL: job.URL})
+}
+
+// Len returns the number of queued jobs.
+func (fr *Frontier) Len() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return len(fr.queued)
+}
+
+// forEachSeen calls fn for every scheduled URL, completed or not.
+func (fr *Frontier) forEachSeen(fn func(u string, depth int)) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for _, e := range fr.seen {
+		fn(e.URL, e.Depth)
+	}
+}
+
+func (fr *Frontier) appendLocked(rec frontierRecord) error {
+	if fr.w == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := fr.w.Write(b); err != nil {
+		return fmt.Errorf("frontier: %v", err)
+	}
+	return fr.w.Flush()
+}
+
+func (fr *Frontier) Close() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.f == nil {
+		return nil
+	}
+	if err := fr.w.Flush(); err != nil {
+		fr.f.Close()
+		return err
+	}
+	return fr.f.Close()
+}
@@ -0,0 +1,134 @@
+package homework2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// popAll pops every queued job of fr and returns their URLs.
+func popAll(t *testing.T, fr *Frontier) []string {
+	t.Helper()
+	var urls []string
+	for fr.Len() > 0 {
+		job, ok := fr.Pop(context.Background())
+		if !ok {
+			t.Fatal("Pop failed with jobs queued")
+		}
+		urls = append(urls, job.URL)
+	}
+	return urls
+}
+
+func TestFrontierOrder(t *testing.T) {
+	fr := NewMemoryFrontier()
+	for _, job := range []Job{
+		{URL: "http://a.com/1"},
+		{URL: "http://a.com/2"},
+		{URL: "http://b.com/deep", Depth: 1},
+		{URL: "http://c.com/deeper", Depth: 2},
+		{URL: "http://c.com/rich", Depth: 1, Images: 7},
+	} {
+		if ok, err := fr.Push(job); !ok || err != nil {
+			t.Fatalf("Push(%s) = %v, %v", job.URL, ok, err)
+		}
+	}
+	if ok, _ := fr.Push(Job{URL: "https://a.com/1"}); ok {
+		t.Error("the https twin of a seen URL was queued")
+	}
+	// two more links to c.com/deeper: -2 + log2(4) = 0
+	fr.Link(Job{URL: "http://c.com/deeper", Depth: 2})
+	fr.Link(Job{URL: "http://c.com/deeper", Depth: 2})
+
+	want := []string{
+		"http://c.com/rich",   // -1 + 1 + log2(8) = 3
+		"http://a.com/1",      // 1
+		"http://a.com/2",      // 1 - 0.1 for the page taken from a.com
+		"http://b.com/deep",   // 0
+		"http://c.com/deeper", // 0 - 0.1, and discovered later
+	}
+	if got := popAll(t, fr); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+
+	// a host that ran dry keeps its share of the crawl when it gets jobs again
+	fr.Push(Job{URL: "http://a.com/3"})
+	fr.Push(Job{URL: "http://d.com/1"})
+	want = []string{"http://d.com/1", "http://a.com/3"}
+	if got := popAll(t, fr); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+}
+
+func TestFrontierManyHosts(t *testing.T) {
+	fr := NewMemoryFrontier()
+	for i := 0; i < 1000; i++ {
+		fr.Push(Job{URL: fmt.Sprintf("http://host%d.com/", i)})
+	}
+	if got := popAll(t, fr); len(got) != 1000 || got[0] != "http://host0.com/" || got[999] != "http://host999.com/" {
+		t.Errorf("popped %d jobs, %s first and %s last", len(got), got[0], got[len(got)-1])
+	}
+	if n := fr.active.Len(); n != 0 {
+		t.Errorf("%d hosts without jobs are still active", n)
+	}
+}
+
+func TestFrontierResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	fr, err := OpenFrontier(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr.Push(Job{URL: "http://a.com/1"})
+	fr.Push(Job{URL: "http://a.com/2", Depth: 1})
+	job, _ := fr.Pop(context.Background())
+	fr.Complete(job)
+	fr.Close()
+
+	// a killed crawl may leave a torn last line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"op":"seen","url":"http://a.`)
+	f.Close()
+
+	fr, err = OpenFrontier(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	if got := popAll(t, fr); len(got) != 1 || got[0] != "http://a.com/2" {
+		t.Errorf("resumed %v, want [http://a.com/2]", got)
+	}
+	if !fr.Seen("http://a.com/1") {
+		t.Error("completed URL not seen after resume")
+	}
+}
+
+func TestFrontierLastMod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	fr, err := OpenFrontier(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// as a sitemap might list them, oldest first
+	fr.Push(Job{URL: "http://a.com/undated"})
+	fr.Push(Job{URL: "http://a.com/old", LastMod: now.AddDate(-1, 0, 0)})
+	fr.Push(Job{URL: "http://a.com/month", LastMod: now.AddDate(0, -1, 0)})
+	fr.Push(Job{URL: "http://a.com/new", LastMod: now.Add(-time.Hour)})
+	fr.Close()
+
+	// the dates survive a resume
+	if fr, err = OpenFrontier(path, true); err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	fr.SetRules(&ScoringRules{LastMod: 2})
+	want := []string{"http://a.com/new", "http://a.com/month", "http://a.com/old", "http://a.com/undated"}
+	if got := popAll(t, fr); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package homework2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// sha256Hex returns the hex SHA-256 of b, used to detect byte-identical images.
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hamming returns the number of differing bits between two perceptual hashes.
+func hamming(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// perceptualHashes computes the average, difference and DCT hashes of img.
+// All three are 64-bit and survive rescaling and recompression.
+func perceptualHashes(img image.Image) (aHash, dHash, pHash uint64) {
+	return averageHash(img), differenceHash(img), dctHash(img)
+}
+
+// averageHash: 8x8 grayscale, bit set where the pixel is brighter than the mean.
+func averageHash(img image.Image) uint64 {
+	px := grayscaleResize(img, 8, 8)
+	mean := 0.0
+	for _, v := range px {
+		mean += v
+	}
+	mean /= float64(len(px))
+	var h uint64
+	for i, v := range px {
+		if v > mean {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// differenceHash: 9x8 grayscale, bit set where a pixel is brighter than its right neighbour.
+func differenceHash(img image.Image) uint64 {
+	px := grayscaleResize(img, 9, 8)
+	var h uint64
+	bit := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if px[y*9+x] > px[y*9+x+1] {
+				h |= 1 << uint(bit)
+			}
+			bit++
+		}
+	}
+	return h
+}
+
+// dctHash: 32x32 grayscale, 2-D DCT, then the top-left 8x8 low frequencies compared
+// against their median (the DC term is excluded from the median).
+func dctHash(img image.Image) uint64 {
+	const n = 32
+	px := grayscaleResize(img, n, n)
+	coeffs := dct2D(px, n)
+	low := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			low = append(low, coeffs[y*n+x])
+		}
+	}
+	sorted := append([]float64(nil), low[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var h uint64
+	for i, v := range low {
+		if v > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+var dctCos [32][32]float64
+
+func init() {
+	for u := 0; u < 32; u++ {
+		for x := 0; x < 32; x++ {
+			dctCos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 64)
+		}
+	}
+}
+
+// dct2D computes the (unscaled) DCT-II of an n x n block, n <= 32, rows then columns.
+func dct2D(px []float64, n int) []float64 {
+	tmp := make([]float64, n*n)
+	out := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for u := 0; u < n; u++ {
+			s := 0.0
+			for x := 0; x < n; x++ {
+				s += px[y*n+x] * dctCos[u][x]
+			}
+			tmp[y*n+u] = s
+		}
+	}
+	for u := 0; u < n; u++ {
+		for v := 0; v < n; v++ {
+			s := 0.0
+			for y := 0; y < n; y++ {
+				s += tmp[y*n+u] * dctCos[v][y]
+			}
+			out[v*n+u] = s
+		}
+	}
+	return out
+}
+
+const hashSamples = 16
+
+// grayscaleResize averages img down to w x h luma values (row-major). Each target
+// cell is estimated from at most hashSamples x hashSamples evenly spaced pixels, which
+// keeps hashing cheap for very large images.
+func grayscaleResize(img image.Image, w, h int) []float64 {
+	b := img.Bounds()
+	out := make([]float64, w*h)
+	if b.Empty() {
+		return out
+	}
+	for ty := 0; ty < h; ty++ {
+		y0 := b.Min.Y + ty*b.Dy()/h
+		y1 := b.Min.Y + (ty+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for tx := 0; tx < w; tx++ {
+			x0 := b.Min.X + tx*b.Dx()/w
+			x1 := b.Min.X + (tx+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			sum, cnt := 0.0, 0
+			for sy := 0; sy < hashSamples; sy++ {
+				y := y0 + sy*(y1-y0)/hashSamples
+				if sy > 0 && y == y0+(sy-1)*(y1-y0)/hashSamples {
+					continue
+				}
+				for sx := 0; sx < hashSamples; sx++ {
+					x := x0 + sx*(x1-x0)/hashSamples
+					if sx > 0 && x == x0+(sx-1)*(x1-x0)/hashSamples {
+						continue
+					}
+					r, g, bl, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					cnt++
+				}
+			}
+			out[ty*w+tx] = sum / float64(cnt) / 257
+		}
+	}
+	return out
+}
@@ -6,28 +6,99 @@ package homework2
 //  - Recursive crawler starting from one or more URLs provided as command-line args
 //  - Worker pool (configurable size) implemented with goroutines and channels
 //  - Option to follow external links (flag -follow-external)
-//  - Crawling timeout (flag -timeout, default 2m)
+//  - Crawling timeout (flag -timeout, default 2m); the crawl also ends as soon as no pages are left
+//  - Crawl limits: -max-depth, -max-pages and -max-pages-per-host (0 = unlimited)
+//  - Crawl jobs (crawls.go): the command line crawl and crawls started from the /crawls page or
+//    POST /api/v1/crawls run side by side, each with its own Dispatcher and settings (workers,
+//    limits, follow-external, JS, timeout; the flags are the defaults), and can be paused,
+//    resumed and cancelled. With -serve-only the server runs until Ctrl-C and only crawls jobs.
+//  - Live progress (events.go): crawls publish page, link, image and error events that
+//    GET /api/v1/events streams as Server-Sent Events; the search page shows new thumbnails
+//    as they are saved and the crawls page updates its counters and an event log.
+//  - Metrics (metrics.go): GET /metrics serves fetch latencies, HTTP status codes, bytes
+//    downloaded, thumbnails, store insert errors and the job queue and semaphore usage of
+//    the running crawls in the Prometheus text format.
+//  - Seeding from sitemaps and feeds (seeds.go): start URLs that are sitemaps or RSS/Atom feeds
+//    are read instead of crawled, -sitemaps adds the sitemaps of the start hosts (robots.txt
+//    Sitemap: lines or /sitemap.xml, indexes and .gz files followed) and -feeds the feeds pages
+//    link to; listed pages are queued most recently modified first
+//  - Persistent frontier (frontier.go): the queue and seen set are logged to -frontier-file, so a
+//    crawl stopped by -timeout or Ctrl-C can be continued with -resume
+//  - Priority scheduling (priority.go): the frontier hands out the best scored page first -
+//    shallow, often linked, found on pages with many images, matching preferred URL patterns -
+//    while keeping hosts fair; the weights and patterns come from -priority-rules
+//  - URL canonicalization (canonical.go) before deduplication, and SimHash fingerprints of page
+//    text to skip the images of near-duplicate pages reachable under different URLs (flag -near-dup-distance)
 //  - Max concurrent goroutines limit (flag -max-goroutines)
-//  - Headless browser support via chromedp to render JS single-page apps (flag -enable-js)
-//  - Image extraction (raster formats and SVG). Raster thumbnails are generated (max width 200px).
-//  - SVG files are saved; rasterizing SVG to PNG thumbnails is optional via external tool (see notes).
-//  - Image metadata stored in MySQL (configurable via DSN flag)
-//  - Small HTTP server with HTML templates for searching and visualizing images
+//  - Headless browser support via chromedp to render JS single-page apps (flag -enable-js):
+//    one Chrome per crawl with a pool of tabs (-js-tabs), a wait strategy (-js-wait: load,
+//    networkidle, selector=CSS or delay=DURATION; -js-timeout) and scrolling to trigger lazy
+//    loading (-js-scroll) (browser.go); without Chrome pages are fetched over plain HTTP
+//  - Image extraction (raster formats and SVG) from <img src/srcset/data-src>, <picture><source>,
+//    inline and linked CSS url(...) and og:image / twitter:image (extract.go); each image records
+//    how it was discovered (source) and the other srcset candidates (alternates).
+//  - Thumbnails (thumbnail.go) in several widths (flag -thumb-sizes, default 100,200,400) resampled
+//    with an area, bilinear or Lanczos filter (-thumb-filter), upright according to the EXIF
+//    orientation (exif.go), as JPEG for photos and PNG for graphics and transparent images
+//  - Formats (formats.go): JPEG, PNG, GIF, WebP, BMP, TIFF and ICO are decoded for dimensions and
+//    thumbnails; animated GIF/WebP record their frame count and loop duration and are
+//    thumbnailed from the first frame
+//  - Embedded metadata (metadata.go): camera, lens, capture date and GPS from EXIF, creator,
+//    copyright and keywords from XMP and IPTC, for JPEG, PNG, WebP and TIFF; the UI can filter
+//    on "has GPS", "taken after" and "copyright contains"
+//  - Full-text search (textindex.go, q= parameter): alt and title text, the page URL and <title>,
+//    the nearest figcaption/caption and the text around each image are indexed in memory with
+//    English (Porter) and Bulgarian stemming and ranked with BM25; no MySQL FULLTEXT needed
+//  - Colors (color.go): a median-cut palette, the average color and a colorfulness score per
+//    image; the UI filters by a color swatch within a CIELAB ΔE threshold and can sort by
+//    colorfulness
+//  - Duplicate images (imagehash.go) are detected by SHA-256 and, for raster images, by pHash
+//    distance (flag -dup-distance). Duplicates are stored as rows pointing at the canonical
+//    record (duplicate_of) and reuse its file instead of being saved again.
+//  - SVG files are rasterized in pure Go (svg.go: basic shapes, paths, transforms, viewBox) to
+//    get their intrinsic size, PNG thumbnails and perceptual hashes.
+//  - Image metadata stored behind the ImageStore interface (store.go): MySQL (configurable via DSN
+//    flag), a pure-Go append-only file, or in memory - selected with -store=mysql|file|memory
+//  - Small HTTP server with html/template pages (templates/) for searching and visualizing images:
+//    60 per page with keyset pagination, sorting by relevance, date, size, format or colorfulness,
+//    a details page (/image?id=) with all metadata and every page the picture was found on, and
+//    "similar images" (/similar?id=) ranked by pHash Hamming distance from a BK-tree (similar.go)
+//  - JSON API (api.go) under /api/v1: images with the search filters and cursor pagination,
+//    single images, the crawls of this process (crawls.go) and index statistics; the OpenAPI
+//    document is embedded and served at /api/v1/openapi.json
+//  - Incremental re-crawls (recrawl.go): the ETag, Last-Modified and SHA-256 of every page and
+//    image are stored, crawling them again sends If-None-Match/If-Modified-Since, pages that
+//    answer 304 or hash the same are not parsed again (their stored links are followed), and
+//    image records are updated in place instead of inserted; images a page no longer has are
+//    marked stale and hidden from search unless stale= is given
+//  - Crawl scope (scope.go): a rules file (-crawl-rules) of allow/deny path globs and regexps,
+//    per host and for pages or images, decides which links are queued and which images are
+//    downloaded; images under -min-image-size (1x1 tracking pixels and spacers) or
+//    -min-image-bytes, over -max-image-bytes or not of an -image-types MIME type aren't kept
+//  - Fetching (fetcher.go): one HTTP client shared by all crawls keeps connections alive, retries
+//    5xx, 429 and timeouts with exponential backoff and jitter honoring Retry-After
+//    (-fetch-retries, -fetch-timeout), caps bodies at -max-body-bytes, checks Content-Type,
+//    decompresses gzip and brotli, converts pages to UTF-8 from their charset and records the
+//    redirects a page went through
+//  - Politeness (politeness.go): robots.txt Allow/Disallow and Crawl-delay for User-Agent
+//    GoImageCrawler/1.0, plus a per-host token bucket (flags -respect-robots, -host-rate, -host-burst)
 //
 // Limitations / Notes:
-//  - SVG rasterization is not implemented in pure go here: to generate PNG thumbnails from SVG
-//    you may provide an external rasterizer command (e.g. `rsvg-convert` or `inkscape`) via flag
-//    -svg-rasterize-cmd. If omitted, SVG thumbnails won't be raster-generated; the SVG file will
-//    still be saved and indexed.
+//  - The SVG renderer ignores text, embedded images, <use>, clipping, masks and filters, and fills
+//    gradients with their average color. For SVGs it cannot parse, an external rasterizer (e.g.
+//    `rsvg-convert` or `inkscape`) can be given with -svg-raster-cmd; it is run directly, not
+//    through a shell. Without it such SVGs are still saved and indexed, just without a thumbnail.
 //  - This is an example.go / reference implementation and includes minimal error handling for
-//    clarity. For production use, add robust error handling, logging, retries, politeness
-//    (robots.txt, rate-limiting), TLS verification options, etc.
+//    clarity. For production use, add robust error handling, logging,
+//    TLS verification options, etc.
 //
 // Dependencies (go get):
+//  go get github.com/andybalholm/brotli
 //  go get github.com/chromedp/chromedp
 //  go get github.com/go-sql-driver/mysql
 //  go get golang.org/x/net/html
 //  go get golang.org/x/net/publicsuffix
+//  go get golang.org/x/image
 //
 // Build:
 //  go build -o crawler main.go
@@ -36,6 +107,9 @@ package homework2
 //  ./crawler -workers=10 -timeout=2m -follow-external=false -enable-js=true -image-dir=images \
 //      -mysql-dsn="user:pass@tcp(localhost:3306)/imagedb?parseTime=true" https://example.com
 //
+// Without a database server:
+//  ./crawler -store=file -store-file=images/index.jsonl https://example.com
+//
 // Database schema (MySQL):
 //
 // CREATE DATABASE imagedb CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;
@@ -50,49 +124,99 @@ package homework2
 //   width INT,
 //   height INT,
 //   format VARCHAR(50),
-//   crawled_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+//   crawled_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+//   sha256 CHAR(64),
+//   ahash BIGINT UNSIGNED NOT NULL DEFAULT 0,
+//   dhash BIGINT UNSIGNED NOT NULL DEFAULT 0,
+//   phash BIGINT UNSIGNED NOT NULL DEFAULT 0,
+//   duplicate_of BIGINT NULL,
+//   source VARCHAR(32),
+//   alternates TEXT,
+//   thumbnails TEXT,
+//   frames INT NOT NULL DEFAULT 0,
+//   duration_ms INT NOT NULL DEFAULT 0,
+//   camera_make VARCHAR(255),
+//   camera_model VARCHAR(255),
+//   lens VARCHAR(255),
+//   taken_at DATETIME NULL,
+//   gps_lat DOUBLE NULL,
+//   gps_lon DOUBLE NULL,
+//   creator VARCHAR(1024),
+//   copyright VARCHAR(1024),
+//   keywords TEXT,
+//   page_url TEXT,
+//   page_title VARCHAR(1024),
+//   caption TEXT,
+//   context TEXT,
+//   palette VARCHAR(255),
+//   avg_color CHAR(7),
+//   colorfulness DOUBLE NOT NULL DEFAULT 0,
+//   etag VARCHAR(255),
+//   last_modified VARCHAR(64),
+//   checked_at DATETIME NULL,
+//   stale_since DATETIME NULL,
+//   INDEX idx_crawled_at (crawled_at, id),
+//   INDEX idx_duplicate_of (duplicate_of),
+//   INDEX idx_taken_at (taken_at),
+//   INDEX idx_sha256 (sha256),
+//   INDEX idx_page_url (page_url(255))
+// );
+// CREATE TABLE pages (
+//   url_sha256 CHAR(64) PRIMARY KEY,
+//   url TEXT NOT NULL,
+//   base_url TEXT,
+//   etag VARCHAR(255),
+//   last_modified VARCHAR(64),
+//   sha256 CHAR(64),
+//   links MEDIUMTEXT,
+//   feeds TEXT,
+//   redirects TEXT,
+//   fetched_at DATETIME NULL,
+//   checked_at DATETIME NULL
 // );
 //
 // High-level design notes:
 //  - A dispatcher goroutine accepts starting URLs and keeps a "to visit" queue.
 //  - Worker goroutines fetch pages (optionally using chromedp for JS rendering), parse links
 //    and images, and send discovered links back to dispatcher to be scheduled if not seen.
-//  - A visited map with sync.Mutex prevents revisiting.
+//  - An unbounded Frontier (per-host priority queues + seen set) prevents revisiting; a feeder
+//    goroutine hands its best jobs to the workers over jobCh.
 //  - A semaphore (buffered channel) limits maximum concurrent HTTP fetch goroutines.
 //  - Image downloads are performed by workers and thumbnails are created using the image
-//    packages (jpeg/png/gif). Metadata is inserted into MySQL.
+//    packages (see formats.go). Metadata is inserted into the configured ImageStore.
 //
 
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"embed"
-	_ "errors"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"image"
 	_ "image/jpeg"
-	"image/png"
+	_ "image/png"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/publicsuffix"
 
-	"github.com/chromedp/chromedp"
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -111,19 +235,55 @@ type ImageMeta struct {
 	ID        int64
 	URL       string
 	Filename  string
-	Thumbnail string
+	Thumbnail string // default-size thumbnail shown in the grid
 	Alt       string
 	Title     string
 	Width     int
 	Height    int
 	Format    string
 	CrawledAt time.Time
+
+	Source     string   // discovery source, see ImageRef.Source
+	Alternates []string // other URLs of the same image (srcset candidates)
+
+	Thumbnails map[int]string // every thumbnail path by its width in pixels
+
+	Frames   int           // number of frames of an animated GIF/WebP, 0 for still images
+	Duration time.Duration // length of one animation loop
+
+	PhotoMeta // EXIF/XMP/IPTC metadata embedded in the file (metadata.go)
+
+	// Colors of raster images (color.go)
+	Palette      []PaletteColor // dominant colors, most common first
+	AvgColor     string         // #rrggbb
+	Colorfulness float64        // Hasler-Süsstrunk metric, 0 = gray
+
+	// Page the image was found on, see ImageRef
+	PageURL   string
+	PageTitle string
+	Caption   string
+	Context   string
+
+	SHA256      string
+	AHash       uint64
+	DHash       uint64
+	PHash       uint64
+	DuplicateOf int64 // ID of the canonical image this one duplicates, 0 if canonical
+
+	// Change tracking for re-crawls (recrawl.go)
+	ETag         string
+	LastModified string    // Last-Modified header, sent back verbatim
+	CheckedAt    time.Time // last crawl that found the image on its page
+	StaleSince   time.Time // when a crawl first found the page without it, zero while it is there
 }
 
 // Job represents a page to crawl
 type Job struct {
-	URL   string
-	Depth int
+	URL    string
+	Depth  int
+	Images int // images on the page the link was found on, for the frontier's score
+
+	LastMod time.Time // last modified according to a sitemap or feed, zero if unknown
 }
 
 func main() {
@@ -131,18 +291,49 @@ func main() {
 	workerCount := flag.Int("workers", DefaultWorkers, "number of worker goroutines in pool")
 	followExternal := flag.Bool("follow-external", false, "follow external links (default false)")
 	enableJS := flag.Bool("enable-js", true, "enable JS rendering via chromedp for SPA pages")
+	sitemaps := flag.Bool("sitemaps", false, "also crawl the pages listed in the sitemaps of the start URLs' hosts (robots.txt Sitemap: lines, else /sitemap.xml)")
+	feeds := flag.Bool("feeds", false, "also crawl the items of RSS and Atom feeds linked from pages")
+	jsTabs := flag.Int("js-tabs", DefaultRenderOptions().Tabs, "browser tabs per crawl, i.e. pages rendered at once with -enable-js")
+	jsWait := flag.String("js-wait", WaitNetworkIdle, "when a rendered page is ready: load, networkidle, selector=CSS or delay=DURATION")
+	jsTimeout := flag.Duration("js-timeout", DefaultRenderOptions().Timeout, "time to wait for a rendered page before taking it as it is")
+	jsScroll := flag.Bool("js-scroll", true, "scroll rendered pages to the bottom to trigger lazy loading")
 	timeout := flag.Duration("timeout", DefaultTimeout, "crawling timeout, e.g. 2m")
 	maxGoroutines := flag.Int("max-goroutines", DefaultMaxGoroutines, "maximum concurrent goroutines")
 	imageDir := flag.String("image-dir", "images", "directory to save images and thumbnails")
+	storeKind := flag.String("store", "mysql", "image metadata store: mysql, file or memory")
 	mysqlDSN := flag.String("mysql-dsn", "user:password@tcp(127.0.0.1:3306)/imagedb?parseTime=true", "MySQL DSN")
-	svgRasterCmd := flag.String("svg-raster-cmd", "", "optional external command to rasterize SVGs into PNG (e.g. 'rsvg-convert -w %d -o %s %s') - provide format string with width, outpath, inputpath")
+	storeFile := flag.String("store-file", "", "path of the -store=file index (default <image-dir>/index.jsonl)")
+	thumbSizes := flag.String("thumb-sizes", "100,200,400", "comma separated thumbnail widths")
+	thumbFilter := flag.String("thumb-filter", "lanczos", "thumbnail resampling filter: area, bilinear or lanczos")
+	thumbQuality := flag.Int("thumb-jpeg-quality", 85, "JPEG quality of photo thumbnails (1-100)")
+	svgRasterCmd := flag.String("svg-raster-cmd", "", "fallback command for SVGs the built-in renderer can't handle (e.g. 'rsvg-convert -w %d -o %s %s'); %d/%s are replaced in order by width, outpath, inputpath; run without a shell")
 	port := flag.Int("port", 8080, "HTTP server port for search UI")
-	startServer := flag.Bool("serve-only", false, "only start the web UI server (don't crawl)")
+	startServer := flag.Bool("serve-only", false, "only start the web UI server and run the crawls started from it (start URLs are ignored)")
+	respectRobots := flag.Bool("respect-robots", true, "obey robots.txt rules and Crawl-delay")
+	hostRate := flag.Float64("host-rate", 1, "max requests per second to a single host (0 = unlimited)")
+	hostBurst := flag.Int("host-burst", 2, "requests allowed to a single host in a burst")
+	maxDepth := flag.Int("max-depth", 0, "maximum link depth from the start URLs (0 = unlimited)")
+	maxPages := flag.Int("max-pages", 0, "maximum number of pages to crawl (0 = unlimited)")
+	maxPagesPerHost := flag.Int("max-pages-per-host", 0, "maximum number of pages to crawl per host (0 = unlimited)")
+	frontierFile := flag.String("frontier-file", "", "crawl frontier log used by -resume (default <image-dir>/frontier.jsonl)")
+	resume := flag.Bool("resume", false, "continue the crawl recorded in -frontier-file")
+	dupDistance := flag.Int("dup-distance", 4, "treat raster images whose pHash differs in at most this many bits as duplicates (-1 = exact SHA-256 only)")
+	priorityRules := flag.String("priority-rules", "", "file of frontier scoring rules: weights of depth, in-links, linking page images, sitemap lastmod and host fairness, and URL patterns to prefer or avoid (see priority.go)")
+	crawlRules := flag.String("crawl-rules", "", "file of allow/deny rules for the URLs of pages and images, per host (see scope.go)")
+	defLimits := DefaultImageLimits()
+	minImageBytes := flag.Int64("min-image-bytes", defLimits.MinBytes, "skip images smaller than this many bytes")
+	maxImageBytes := flag.Int64("max-image-bytes", defLimits.MaxBytes, "skip images larger than this many bytes (0 = unlimited)")
+	minImageSize := flag.String("min-image-size", fmt.Sprintf("%dx%d", defLimits.MinWidth, defLimits.MinHeight), "skip images smaller than WIDTHxHEIGHT pixels, e.g. tracking pixels")
+	imageTypes := flag.String("image-types", strings.Join(defLimits.Types, ","), "comma separated MIME types of the images to keep, e.g. image/jpeg,image/png (empty = any)")
+	fetchTimeout := flag.Duration("fetch-timeout", DefaultFetchOptions().Timeout, "time limit of one HTTP request, body included")
+	fetchRetries := flag.Int("fetch-retries", DefaultFetchOptions().Retries, "retries of requests that failed with a 5xx, 429 or timeout, with exponential backoff")
+	maxBodyBytes := flag.Int64("max-body-bytes", DefaultFetchOptions().MaxBytes, "largest page or image downloaded, decompressed")
+	nearDupDistance := flag.Int("near-dup-distance", 3, "skip the images of pages whose text SimHash differs from an already crawled page in at most this many bits (0-3, -1 = off)")
 	flag.Parse()
 
 	startURLs := flag.Args()
-	if len(startURLs) == 0 && !*startServer {
-		log.Fatal("provide at least one start URL as positional argument, or use -serve-only")
+	if len(startURLs) == 0 && !*startServer && !*resume {
+		log.Fatal("provide at least one start URL as positional argument, or use -serve-only or -resume")
 	}
 
 	if *workerCount <= 0 {
@@ -153,49 +344,139 @@ func main() {
 		*maxGoroutines = DefaultMaxGoroutines
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-	defer cancel()
-
-	db, err := sql.Open("mysql", *mysqlDSN)
+	thumbs := DefaultThumbnailOptions()
+	sizes, err := parseThumbnailSizes(*thumbSizes)
 	if err != nil {
-		log.Fatalf("db open: %v", err)
+		log.Fatalf("-thumb-sizes: %v", err)
 	}
-	defer db.Close()
+	thumbs.Sizes = sizes
+	if _, ok := resampleFilters[*thumbFilter]; !ok {
+		log.Fatalf("-thumb-filter: unknown filter %q", *thumbFilter)
+	}
+	thumbs.Filter = *thumbFilter
+	if *thumbQuality >= 1 && *thumbQuality <= 100 {
+		thumbs.JPEGQuality = *thumbQuality
+	}
+
+	scoring := DefaultScoringRules()
+	if *priorityRules != "" {
+		if scoring, err = LoadScoringRules(*priorityRules); err != nil {
+			log.Fatalf("-priority-rules: %v", err)
+		}
+	}
+
+	var rules *CrawlRules
+	if *crawlRules != "" {
+		if rules, err = LoadCrawlRules(*crawlRules); err != nil {
+			log.Fatalf("-crawl-rules: %v", err)
+		}
+	}
+	imageLimits := ImageLimits{MinBytes: *minImageBytes, MaxBytes: *maxImageBytes}
+	if imageLimits.MinWidth, imageLimits.MinHeight, err = parseImageSize(*minImageSize); err != nil {
+		log.Fatalf("-min-image-size: %v", err)
+	}
+	if imageLimits.Types, err = parseMIMETypes(*imageTypes); err != nil {
+		log.Fatalf("-image-types: %v", err)
+	}
+
+	fetch := DefaultFetchOptions()
+	fetch.Timeout, fetch.Retries, fetch.MaxBytes = *fetchTimeout, *fetchRetries, *maxBodyBytes
+	fetcher := NewFetcher(fetch) // shared by all crawls and by robots.txt fetches
+
+	render := RenderOptions{Tabs: *jsTabs, Timeout: *jsTimeout, Scroll: *jsScroll}
+	if render.Wait, err = parseWaitStrategy(*jsWait); err != nil {
+		log.Fatalf("-js-wait: %v", err)
+	}
+
+	// Ctrl-C stops the crawls the same way the timeout does, so the frontier can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Ensure image directory exists
 	if err := os.MkdirAll(*imageDir, 0755); err != nil {
 		log.Fatalf("create image dir: %v", err)
 	}
 
-	// Start HTTP server (UI) in separate goroutine
+	dsn := *mysqlDSN
+	if *storeKind == "file" {
+		dsn = *storeFile
+		if dsn == "" {
+			dsn = filepath.Join(*imageDir, "index.jsonl")
+		}
+	}
+	rawStore, err := OpenImageStore(*storeKind, dsn)
+	if err != nil {
+		log.Fatalf("store open: %v", err)
+	}
+	defer rawStore.Close()
+	// pHash BK-tree for "similar images" and fast near-duplicate lookups, and the
+	// full-text index behind q=
+	store, err := withIndexes(ctx, rawStore)
+	if err != nil {
+		log.Fatalf("indexes: %v", err)
+	}
+	log.Printf("indexes: %d images by pHash, %d by text", store.sim.Len(), store.text.Len())
+
+	// the flags are the settings of the command line crawl and the defaults of crawls
+	// started over HTTP
+	defaults := CrawlConfig{
+		Workers:         *workerCount,
+		MaxGoroutines:   *maxGoroutines,
+		FollowExternal:  *followExternal,
+		EnableJS:        *enableJS,
+		Limits:          CrawlLimits{MaxDepth: *maxDepth, MaxPages: *maxPages, MaxPagesPerHost: *maxPagesPerHost},
+		Timeout:         *timeout,
+		Sitemaps:        *sitemaps,
+		Feeds:           *feeds,
+		Render:          render,
+		ImageDir:        *imageDir,
+		Thumbs:          thumbs,
+		SVGRasterCmd:    *svgRasterCmd,
+		Polite:          NewPoliteness(*respectRobots, *hostRate, *hostBurst, fetcher),
+		Fetcher:         fetcher,
+		Scoring:         scoring,
+		Rules:           rules,
+		ImageLimits:     imageLimits,
+		NearDupDistance: *nearDupDistance,
+		DupDistance:     *dupDistance,
+	}
+	crawls := NewCrawlManager(ctx, store, defaults)
+
+	// Start HTTP server (UI and API) in separate goroutine
 	uiDone := make(chan struct{})
 	go func() {
-		if err := startHTTPServer(db, *imageDir, *port); err != nil {
+		if err := startHTTPServer(store, crawls, *imageDir, *port); err != nil {
 			log.Printf("ui server: %v", err)
 		}
 		close(uiDone)
 	}()
 
 	if *startServer {
-		<-uiDone
+		select {
+		case <-uiDone:
+		case <-ctx.Done():
+		}
+		log.Println("main: shutting down - stopping running crawls")
+		crawls.CancelAll()
+		crawls.Wait()
 		return
 	}
 
-	// Dispatcher and worker pool
-	dispatcher := NewDispatcher(*workerCount, *maxGoroutines, *followExternal, *enableJS, *imageDir, db, *svgRasterCmd)
-	dispatcherCtx, dispatcherCancel := context.WithCancel(ctx)
-	defer dispatcherCancel()
-
-	go dispatcher.Run(dispatcherCtx)
-
-	for _, u := range startURLs {
-		dispatcher.Add(Job{URL: u, Depth: 0})
+	if *frontierFile == "" {
+		*frontierFile = filepath.Join(*imageDir, "frontier.jsonl")
 	}
+	frontier, err := OpenFrontier(*frontierFile, *resume)
+	if err != nil {
+		log.Fatalf("frontier open: %v", err)
+	}
+	defer frontier.Close()
 
-	// wait until context expires
-	<-ctx.Done()
-	log.Println("main: timeout or cancelled - stopping dispatcher")
-	dispatcher.Stop()
+	// the command line crawl ends the program; crawls started over HTTP meanwhile are
+	// cancelled with it
+	crawl := crawls.Start(startURLs, defaults, frontier, *resume)
+	<-crawl.Done()
+	crawls.CancelAll()
+	crawls.Wait()
 	// allow graceful shutdown of UI server for a short time
 	select {
 	case <-uiDone:
@@ -203,58 +484,186 @@ func main() {
 	}
 }
 
+// CrawlLimits bounds a crawl. Zero values mean unlimited.
+type CrawlLimits struct {
+	MaxDepth        int
+	MaxPages        int
+	MaxPagesPerHost int
+}
+
+// CrawlConfig holds the settings of one crawl. main fills it from the flags; crawls
+// started over HTTP override the per-job part (see CrawlManager).
+type CrawlConfig struct {
+	// per job
+	Workers        int
+	MaxGoroutines  int
+	FollowExternal bool
+	EnableJS       bool
+	Limits         CrawlLimits
+	Timeout        time.Duration
+	Sitemaps       bool // also crawl the pages in the sitemaps of the start URLs' hosts
+	Feeds          bool // also crawl the items of RSS and Atom feeds linked from pages
+
+	Render          RenderOptions // of the browser used with EnableJS
+	ImageDir        string
+	Thumbs          ThumbnailOptions
+	SVGRasterCmd    string
+	Polite          *Politeness   // shared by all crawls, so host rate limits are global
+	Fetcher         *Fetcher      // shared by all crawls, so connections are reused; nil = defaults
+	Scoring         *ScoringRules // order of the frontier, nil = DefaultScoringRules
+	Rules           *CrawlRules   // which pages and images are crawled, nil = all
+	ImageLimits     ImageLimits   // which downloaded images are kept
+	NearDupDistance int           // max SimHash distance for near-duplicate pages, <0 disables
+	DupDistance     int           // max pHash distance for duplicate images, <0 = exact only
+}
+
+// imageSaveMu serializes the duplicate lookup of images across all dispatchers, since
+// concurrent crawls share the store. savingImages holds the new images between that
+// lookup and their insert, by SHA-256, so that a copy found meanwhile waits for the
+// first one to be stored instead of being saved as well. Files and thumbnails are
+// written outside the lock.
+var (
+	imageSaveMu  sync.Mutex
+	savingImages = map[string]chan struct{}{}
+)
+
 // Dispatcher orchestrates jobs and workers
 type Dispatcher struct {
 	workers        int
 	maxGoroutines  int
 	followExternal bool
 	enableJS       bool
+	sitemaps       bool
+	feeds          bool
+	render         RenderOptions
+	browser        *Browser // started by Run if enableJS
 	imageDir       string
-	db             *sql.DB
+	store          ImageStore
+	thumbs         ThumbnailOptions
 	svgRasterCmd   string
+	polite         *Politeness
+	fetcher        *Fetcher
+	limits         CrawlLimits
+	rules          *CrawlRules
+	imageLimits    ImageLimits
+	nearDupDist    int           // max SimHash distance for near-duplicate pages, <0 disables
+	pageHashes     *simhashIndex // fingerprints of crawled pages
+	dupDist        int           // max pHash distance for duplicate images, <0 = exact only
 
 	jobCh   chan Job
 	results chan struct{}
 	quit    chan struct{}
 	wg      sync.WaitGroup
 
-	visited map[string]struct{}
-	mu      sync.Mutex
+	frontier     *Frontier
+	pages        int // pages scheduled so far
+	budgetLogged bool
+	pagesPerHost map[string]int  // pages scheduled per host
+	seedDocs     map[string]bool // sitemaps and feeds read (seeds.go)
+	pending      int             // scheduled jobs not finished yet (+1 while seeding)
+	seeded       bool            // FinishSeeding was called
+	done         chan struct{}   // closed when pending drops to zero
+	fetched      int             // pages downloaded
+	errors       int             // failed page, stylesheet and image fetches
+	images       int             // images saved by this crawl
+	duplicates   int             // of which duplicates of an earlier image
+	unchanged    int             // pages not modified since the last crawl (recrawl.go)
+	paused       bool
+	resumed      chan struct{} // closed by Resume
+	emit         func(Event)   // set by the CrawlManager; nil drops events
+	mu           sync.Mutex
 
 	sem chan struct{} // semaphore to bound concurrent goroutines
 }
 
-func NewDispatcher(workers, maxG int, followExternal, enableJS bool, imageDir string, db *sql.DB, svgRasterCmd string) *Dispatcher {
+// NewDispatcher creates the dispatcher of one crawl. frontier may be nil for a crawl
+// that isn't persisted.
+func NewDispatcher(cfg CrawlConfig, store ImageStore, frontier *Frontier) *Dispatcher {
+	if frontier == nil {
+		frontier = NewMemoryFrontier()
+	}
+	if cfg.Scoring != nil {
+		frontier.SetRules(cfg.Scoring)
+	}
+	workers, maxG := cfg.Workers, cfg.MaxGoroutines
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if maxG <= 0 {
+		maxG = DefaultMaxGoroutines
+	}
 	r := &Dispatcher{
 		workers:        workers,
 		maxGoroutines:  maxG,
-		followExternal: followExternal,
-		enableJS:       enableJS,
-		imageDir:       imageDir,
-		db:             db,
-		svgRasterCmd:   svgRasterCmd,
-		jobCh:          make(chan Job, 1000),
+		followExternal: cfg.FollowExternal,
+		enableJS:       cfg.EnableJS,
+		sitemaps:       cfg.Sitemaps,
+		feeds:          cfg.Feeds,
+		render:         cfg.Render,
+		imageDir:       cfg.ImageDir,
+		store:          store,
+		thumbs:         cfg.Thumbs,
+		svgRasterCmd:   cfg.SVGRasterCmd,
+		polite:         cfg.Polite,
+		fetcher:        cfg.Fetcher,
+		limits:         cfg.Limits,
+		rules:          cfg.Rules,
+		imageLimits:    cfg.ImageLimits,
+		nearDupDist:    cfg.NearDupDistance,
+		pageHashes:     newSimhashIndex(),
+		dupDist:        cfg.DupDistance,
+		jobCh:          make(chan Job, workers),
 		results:        make(chan struct{}, 1000),
 		quit:           make(chan struct{}),
-		visited:        make(map[string]struct{}),
+		frontier:       frontier,
+		pagesPerHost:   make(map[string]int),
+		seedDocs:       make(map[string]bool),
+		pending:        1 + frontier.Len(),
+		done:           make(chan struct{}),
 		sem:            make(chan struct{}, maxG),
 	}
+	if r.fetcher == nil {
+		r.fetcher = NewFetcher(DefaultFetchOptions())
+	}
+	// a resumed frontier has already used part of the page budgets
+	frontier.forEachSeen(func(u string, depth int) {
+		r.pages++
+		r.pagesPerHost[hostOf(u)]++
+	})
 	return r
 }
 
 func (d *Dispatcher) Run(ctx context.Context) {
 	log.Printf("dispatcher: starting with %d workers, maxGoroutines=%d\n", d.workers, d.maxGoroutines)
+	if d.enableJS {
+		d.browser = newBrowser(ctx, d.render)
+	}
 	for i := 0; i < d.workers; i++ {
 		d.wg.Add(1)
 		go d.worker(ctx, i)
 	}
 
-	// Wait for cancellation
-	<-ctx.Done()
+	// Feed jobs from the frontier to the workers until cancellation
+	for d.waitWhilePaused(ctx) {
+		job, ok := d.frontier.Pop(ctx)
+		if !ok {
+			break
+		}
+		select {
+		case d.jobCh <- job:
+			continue
+		case <-ctx.Done():
+			// job stays incomplete in the frontier and is picked up again on -resume
+		}
+		break
+	}
 	log.Println("dispatcher: context done - closing job channel")
 	close(d.jobCh)
 	// wait workers
 	d.wg.Wait()
+	if d.browser != nil {
+		d.browser.Close()
+	}
 	log.Println("dispatcher: all workers done")
 }
 
@@ -262,30 +671,198 @@ func (d *Dispatcher) Stop() {
 	close(d.quit)
 }
 
-func (d *Dispatcher) Add(job Job) {
-	// Normalize URL
-	u := strings.TrimSpace(job.URL)
+// FinishSeeding must be called once all start URLs have been added. Until then
+// Done can't fire, even if the first pages finish before the last seed is added.
+func (d *Dispatcher) FinishSeeding() {
+	d.mu.Lock()
+	d.seeded = true
+	d.mu.Unlock()
+	d.jobDone()
+}
+
+// Done is closed when every scheduled page has been processed and nothing is left to crawl.
+func (d *Dispatcher) Done() <-chan struct{} {
+	return d.done
+}
+
+// Pause stops handing out pages; the workers finish the pages they are on.
+func (d *Dispatcher) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.paused {
+		d.paused = true
+		d.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues a paused crawl.
+func (d *Dispatcher) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.paused {
+		d.paused = false
+		close(d.resumed)
+	}
+}
+
+// waitWhilePaused blocks while the crawl is paused. It returns false if ctx ends first.
+func (d *Dispatcher) waitWhilePaused(ctx context.Context) bool {
+	d.mu.Lock()
+	paused, resumed := d.paused, d.resumed
+	d.mu.Unlock()
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// DispatcherStats is a snapshot of a crawl's progress.
+type DispatcherStats struct {
+	Paused         bool
+	PagesScheduled int // pages accepted into the frontier, including a resumed one
+	PagesPending   int // scheduled pages not processed yet
+	Queued         int // pages waiting in the frontier
+	Fetched        int // pages downloaded
+	Errors         int
+	Images         int
+	Duplicates     int
+	Unchanged      int // fetched pages that hadn't changed since the last crawl
+}
+
+// Stats reports the progress of the crawl so far.
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := d.pending
+	if !d.seeded {
+		pending-- // the seeding placeholder isn't a page
+	}
+	return DispatcherStats{
+		Paused:         d.paused,
+		PagesScheduled: d.pages,
+		PagesPending:   pending,
+		Queued:         d.frontier.Len(),
+		Fetched:        d.fetched,
+		Errors:         d.errors,
+		Images:         d.images,
+		Duplicates:     d.duplicates,
+		Unchanged:      d.unchanged,
+	}
+}
+
+// count increments one of the progress counters.
+func (d *Dispatcher) count(n *int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*n++
+}
+
+// publish reports a step of the crawl on the event bus (events.go).
+func (d *Dispatcher) publish(e Event) {
+	if d.emit != nil {
+		d.emit(e)
+	}
+}
+
+// failed counts and reports a failed fetch of rawURL, unless it failed because the
+// crawl is stopping.
+func (d *Dispatcher) failed(ctx context.Context, rawURL string, err error) {
+	if ctx.Err() == nil {
+		d.count(&d.errors)
+		d.publish(Event{Type: EventError, URL: rawURL, Err: err.Error()})
+	}
+}
+
+func (d *Dispatcher) jobDone() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending--
+	if d.pending == 0 {
+		close(d.done)
+	}
+}
+
+// overLimit checks job against the crawl limits and returns the one it exceeds. If
+// it fits, it is charged to the page budgets and "" is returned. Must be called with
+// d.mu held.
+func (d *Dispatcher) overLimit(job Job) string {
+	l := d.limits
+	if l.MaxDepth > 0 && job.Depth > l.MaxDepth {
+		return "max-depth"
+	}
+	if l.MaxPages > 0 && d.pages >= l.MaxPages {
+		if !d.budgetLogged {
+			log.Printf("dispatcher: page budget of %d reached\n", l.MaxPages)
+			d.budgetLogged = true
+		}
+		return "max-pages"
+	}
+	host := hostOf(job.URL)
+	if l.MaxPagesPerHost > 0 && d.pagesPerHost[host] >= l.MaxPagesPerHost {
+		return "max-pages-per-host"
+	}
+	d.pages++
+	d.pagesPerHost[host]++
+	return ""
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// jobURL normalizes a URL given to Add; "" means it can't be crawled.
+func jobURL(raw string) string {
+	u := strings.TrimSpace(raw)
 	if u == "" {
-		return
+		return ""
 	}
 	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
 		u = "http://" + u
 	}
-	job.URL = u
+	return canonicalURL(u)
+}
+
+func (d *Dispatcher) Add(job Job) {
+	job.URL = jobURL(job.URL)
+	if job.URL == "" {
+		return
+	}
+	if !d.rules.allowed(job.URL, false) {
+		d.publish(Event{Type: EventLinkDropped, URL: job.URL, Depth: job.Depth, Reason: skipCrawlRules})
+		return
+	}
 
 	d.mu.Lock()
-	if _, ok := d.visited[job.URL]; ok {
+	if d.frontier.Seen(job.URL) {
 		d.mu.Unlock()
+		d.frontier.Link(job)
 		return
 	}
-	d.visited[job.URL] = struct{}{}
+	if limit := d.overLimit(job); limit != "" {
+		d.mu.Unlock()
+		d.publish(Event{Type: EventLinkDropped, URL: job.URL, Depth: job.Depth, Reason: limit})
+		return
+	}
+	// the frontier is unbounded and keeps accepting links after a timeout,
+	// so they can be crawled on -resume
+	added, err := d.frontier.Push(job)
+	if added {
+		d.pending++
+	}
 	d.mu.Unlock()
-
-	select {
-	case d.jobCh <- job:
-	default:
-		// job queue full; drop job (alternatively block or expand)
-		log.Printf("dispatcher: job queue full, dropping %s\n", job.URL)
+	if err != nil {
+		log.Printf("dispatcher: enqueue %s: %v\n", job.URL, err)
+		return
+	}
+	if added {
+		d.publish(Event{Type: EventLinkEnqueued, URL: job.URL, Depth: job.Depth})
 	}
 }
 
@@ -303,142 +880,535 @@ func (d *Dispatcher) worker(ctx context.Context, id int) {
 		// Acquire semaphore to ensure we don't exceed global goroutine limit
 		d.sem <- struct{}{}
 		func(job Job) {
+			defer d.jobDone()
+			defer func() {
+				if ctx.Err() != nil {
+					// interrupted mid-page: leave it queued for -resume
+					return
+				}
+				if err := d.frontier.Complete(job); err != nil {
+					log.Printf("worker %d: %v\n", id, err)
+				}
+			}()
 			defer func() { <-d.sem }()
 			log.Printf("worker %d: processing %s\n", id, job.URL)
-			pagesrc, baseURL, err := d.fetchPage(ctx, job.URL)
+			if err := d.beforeFetch(ctx, job.URL); err != nil {
+				log.Printf("worker %d: skip %s: %v\n", id, job.URL, err)
+				if errors.Is(err, errDisallowed) {
+					d.publish(Event{Type: EventLinkDropped, URL: job.URL, Depth: job.Depth, Reason: "robots.txt"})
+				}
+				return
+			}
+			prev, known := d.previousPage(ctx, job.URL)
+			fp, err := d.fetchPage(ctx, job.URL, prev)
 			if err != nil {
 				log.Printf("worker %d: fetch %s: %v\n", id, job.URL, err)
+				d.failed(ctx, job.URL, err)
 				return
 			}
+			d.count(&d.fetched)
+			if known && fp.unchanged(prev) {
+				// same as last time: no parsing, stylesheets or image downloads (recrawl.go)
+				d.count(&d.unchanged)
+				metricRevalidations.Inc("page", revalidationResult(fp.NotModified))
+				d.publish(Event{Type: EventPageFetched, URL: job.URL, Depth: job.Depth, Reason: "unchanged"})
+				d.revisit(ctx, id, job, prev, fp)
+				return
+			}
+			if known {
+				metricRevalidations.Inc("page", "changed")
+			}
+			d.publish(Event{Type: EventPageFetched, URL: job.URL, Depth: job.Depth})
+			pagesrc, baseURL := fp.HTML, fp.Base
+			dup := ""
+			if d.nearDupDist >= 0 {
+				if fp, ok := simhash(pageText(bytes.NewReader(pagesrc))); ok {
+					dup = d.pageHashes.addOrMatch(fp, job.URL, d.nearDupDist)
+				}
+			}
 			// parse page: extract links and images
-			links, imgs, err := parseHTMLForLinksAndImages(bytes.NewReader(pagesrc), baseURL)
+			page, err := parseHTMLForLinksAndImages(bytes.NewReader(pagesrc), baseURL)
 			if err != nil {
 				log.Printf("worker %d: parse %s: %v\n", id, job.URL, err)
+				d.failed(ctx, job.URL, err)
 				return
 			}
-
-			// schedule links
-			for _, l := range links {
-				if !d.followExternal {
-					if !sameSite(baseURL, l) {
-						// skip externals
-						continue
-					}
+			if dup != "" {
+				// its images are those of dup, but pages may be reachable only through
+				// it, like page 3 of a gallery whose pages share their text
+				log.Printf("worker %d: %s is a near-duplicate of %s - images skipped\n", id, job.URL, dup)
+				d.follow(ctx, job, baseURL, page.Links, page.Feeds, len(page.Images))
+				return
+			}
+			imgs := page.Images
+			// images referenced from linked stylesheets (background-image etc.)
+			for i, css := range page.Stylesheets {
+				if i == maxStylesheetsPerPage {
+					break
+				}
+				if err := d.beforeFetch(ctx, css); err != nil {
+					continue
 				}
-				d.Add(Job{URL: l, Depth: job.Depth + 1})
+				refs, err := d.fetchStylesheetImages(ctx, css)
+				if err != nil {
+					log.Printf("worker %d: stylesheet %s: %v\n", id, css, err)
+					d.failed(ctx, css, err)
+					continue
+				}
+				for j := range refs {
+					refs[j].PageURL, refs[j].PageTitle = baseURL.String(), page.Title
+				}
+				imgs = append(imgs, refs...)
 			}
+			imgs = uniqueImages(imgs)
 
-			// handle images
+			d.follow(ctx, job, baseURL, page.Links, page.Feeds, len(imgs))
+
+			// handle images, updating the records of those the page had last time
+			stored := d.pageImages(ctx, baseURL.String())
+			byURL := make(map[string]*ImageMeta, len(stored))
+			for i := range stored {
+				byURL[stored[i].URL] = &stored[i]
+			}
+			found := make(map[string]bool, len(imgs))
 			for _, img := range imgs {
-				if err := d.processImage(ctx, img, baseURL); err != nil {
-					log.Printf("worker %d: process image %s: %v\n", id, img.Src, err)
-				}
+				found[img.Src] = true
+				d.handleImage(ctx, id, img, baseURL, byURL[img.Src])
 			}
+			d.markStale(ctx, stored, found)
+			now := time.Now()
+			d.savePage(ctx, PageMeta{
+				URL: job.URL, Base: baseURL.String(), ETag: fp.ETag, LastModified: fp.LastModified, SHA256: fp.SHA256,
+				Links: page.Links, Feeds: page.Feeds, Redirects: fp.Redirects, FetchedAt: now, CheckedAt: now,
+			})
 		}(job)
 	}
 	log.Printf("worker %d: stopped\n", id)
 }
 
-// fetchPage fetches page HTML. If enableJS is true it will try to render the page
-// using chromedp to execute JS and return the final HTML.
-func (d *Dispatcher) fetchPage(ctx context.Context, pageURL string) ([]byte, *url.URL, error) {
+// follow schedules the links of a page with images images and, with -feeds, the
+// items of its feeds.
+func (d *Dispatcher) follow(ctx context.Context, job Job, base *url.URL, links, feeds []string, images int) {
+	for _, l := range links {
+		if !d.followExternal {
+			if !sameSite(base, l) {
+				// skip externals
+				d.publish(Event{Type: EventLinkDropped, URL: l, Depth: job.Depth + 1, Reason: "external"})
+				continue
+			}
+		}
+		d.Add(Job{URL: l, Depth: job.Depth + 1, Images: images})
+	}
+	if d.feeds && len(feeds) > 0 {
+		d.seedFromFeeds(ctx, feeds, job.Depth+1)
+	}
+}
+
+// handleImage downloads or revalidates an image found on a page. prev is the image's
+// record from an earlier crawl of the page, nil if it is new there.
+func (d *Dispatcher) handleImage(ctx context.Context, id int, img ImageRef, base *url.URL, prev *ImageMeta) {
+	if !d.rules.allowed(img.Src, true) {
+		d.skipped(img.Src, &skippedError{skipCrawlRules, "excluded"})
+		return
+	}
+	if err := d.beforeFetch(ctx, img.Src); err != nil {
+		log.Printf("worker %d: skip image %s: %v\n", id, img.Src, err)
+		return
+	}
+	err := d.processImage(ctx, img, base, prev)
+	var skip *skippedError
+	switch {
+	case errors.As(err, &skip):
+		log.Printf("worker %d: image %s: %v\n", id, img.Src, err)
+		d.skipped(img.Src, skip)
+	case err != nil:
+		log.Printf("worker %d: process image %s: %v\n", id, img.Src, err)
+		d.failed(ctx, img.Src, err)
+	}
+}
+
+// skipped counts and reports an image left out by the crawl scope (scope.go).
+func (d *Dispatcher) skipped(rawURL string, skip *skippedError) {
+	metricImagesSkipped.Inc(skip.reason)
+	d.publish(Event{Type: EventImageSkipped, URL: rawURL, Reason: skip.reason})
+}
+
+var errDisallowed = errors.New("disallowed by robots.txt")
+
+// beforeFetch enforces robots.txt and the per-host rate limit for rawURL.
+func (d *Dispatcher) beforeFetch(ctx context.Context, rawURL string) error {
+	if d.polite == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !d.polite.Allowed(ctx, u) {
+		return errDisallowed
+	}
+	return d.polite.Wait(ctx, u)
+}
+
+// fetch downloads r.URL with the crawl's Fetcher, waiting for the host's rate limit
+// before each retry as beforeFetch does before the first attempt.
+func (d *Dispatcher) fetch(ctx context.Context, r fetchRequest) (*fetchResponse, error) {
+	if d.polite != nil {
+		if u, err := url.Parse(r.URL); err == nil {
+			r.Wait = func(ctx context.Context) error { return d.polite.Wait(ctx, u) }
+		}
+	}
+	return d.fetcher.Fetch(ctx, r)
+}
+
+// fetchedPage is a page downloaded by fetchPage.
+type fetchedPage struct {
+	HTML         []byte
+	Base         *url.URL // the URL to resolve links against
+	SHA256       string   // of HTML
+	ETag         string
+	LastModified string
+	NotModified  bool     // answered 304 to the validators of the last crawl; no HTML
+	Redirects    []string // the URLs redirected from, the requested one first
+}
+
+// pageTypes are the media types of the responses parsed as pages.
+var pageTypes = []string{"text/html", "application/xhtml+xml"}
+
+// fetchPage fetches page HTML, conditionally if prev has validators. If enableJS is
+// true it will try to render the page in the crawl's browser to execute JS and
+// return the final HTML.
+func (d *Dispatcher) fetchPage(ctx context.Context, pageURL string, prev PageMeta) (fetchedPage, error) {
 	u, err := url.Parse(pageURL)
 	if err != nil {
-		return nil, nil, err
+		return fetchedPage{}, err
 	}
+	fp := fetchedPage{Base: u}
 
-	if d.enableJS {
-		// use chromedp to render page
-		ctxt, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-		options := chromedp.DefaultExecAllocatorOptions[:]
-		allocCtx, aCancel := chromedp.NewExecAllocator(ctxt, options...)
-		defer aCancel()
-		cctx, cCancel := chromedp.NewContext(allocCtx)
-		defer cCancel()
-		var htmlContent string
-		if err := chromedp.Run(cctx,
-			chromedp.Navigate(pageURL),
-			chromedp.Sleep(500*time.Millisecond),
-			chromedp.OuterHTML("html", &htmlContent, chromedp.ByQuery),
-		); err != nil {
+	if d.browser != nil {
+		// the browser doesn't report the validators of the page, so they come from a
+		// HEAD, which is conditional if the last crawl recorded some: that is cheaper
+		// than rendering an unchanged page
+		res, err := d.fetch(ctx, fetchRequest{
+			Kind: "page", Method: http.MethodHead, URL: pageURL, ETag: prev.ETag, LastModified: prev.LastModified,
+		})
+		if err == nil {
+			fp.ETag, fp.LastModified = validators(res.Header)
+			fp.Redirects = res.Redirects
+			if res.StatusCode == http.StatusNotModified {
+				fp.NotModified = true
+				return fp, nil
+			}
+		}
+		// render the page in the crawl's headless Chrome (browser.go)
+		start := time.Now()
+		html, final, err := d.browser.Render(ctx, pageURL)
+		if err == nil {
+			metricFetchSeconds.Observe(time.Since(start).Seconds(), "render")
+			metricBytes.Add(float64(len(html)), "render")
+			fp.HTML, fp.Base, fp.SHA256 = html, final, sha256Hex(html)
+			return fp, nil
+		}
+		if ctx.Err() != nil {
+			return fetchedPage{}, err
+		}
+		if !errors.Is(err, errNoBrowser) {
 			// fallback to plain HTTP fetch
-			log.Printf("chromedp run failed for %s: %v - falling back to http.Get", pageURL, err)
-			goto HTTPFetch
+			metricFetchErrors.Inc("render")
+			log.Printf("render %s: %v - falling back to http.Get", pageURL, err)
 		}
-		return []byte(htmlContent), u, nil
 	}
 
-HTTPFetch:
-	client := &http.Client{Timeout: 15 * time.Second}
-	req, _ := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
-	req.Header.Set("User-Agent", "GoImageCrawler/1.0")
-	resp, err := client.Do(req)
+	res, err := d.fetch(ctx, fetchRequest{
+		Kind: "page", URL: pageURL, ETag: prev.ETag, LastModified: prev.LastModified,
+		Types: pageTypes, UTF8: true,
+	})
 	if err != nil {
-		return nil, nil, err
+		return fetchedPage{}, err
 	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, err
+	fp.ETag, fp.LastModified = validators(res.Header)
+	fp.Base, fp.Redirects = res.URL, res.Redirects
+	if res.StatusCode == http.StatusNotModified {
+		fp.NotModified = true
+		return fp, nil
 	}
-	return b, u, nil
+	fp.HTML, fp.SHA256 = res.Body, sha256Hex(res.Body)
+	return fp, nil
 }
 
-// ImageRef represents an <img> found in a page
+// ImageRef represents an image found in a page
 type ImageRef struct {
-	Src   string
-	Alt   string
-	Title string
+	Src        string
+	Alt        string
+	Title      string
+	Source     string   // how the image was discovered: img, srcset, data-src, picture, style, css, og:image, twitter:image
+	Alternates []string // other candidates for the same image (srcset entries, src behind data-src)
+
+	// Where the image was found, used by the full-text index (textindex.go)
+	PageURL   string
+	PageTitle string
+	Caption   string // nearest enclosing <figure>'s figcaption or <table>'s caption
+	Context   string // visible page text around the image
 }
 
-// parseHTMLForLinksAndImages parses links and image tags from HTML
-func parseHTMLForLinksAndImages(r io.Reader, base *url.URL) ([]string, []ImageRef, error) {
+// parsedPage is what parseHTMLForLinksAndImages extracts from a page.
+type parsedPage struct {
+	Title       string
+	Links       []string
+	Images      []ImageRef
+	Stylesheets []string
+	Feeds       []string // <link rel="alternate"> RSS and Atom feeds
+}
+
+// contextChars is how much surrounding text (in bytes, on each side) is kept per image.
+const contextChars = 300
+
+// parseHTMLForLinksAndImages parses links, images and linked stylesheets from HTML.
+// Images come from <img> (src, srcset, data-src, data-lazy-src), <picture><source>,
+// inline style and <style> url(...) references and og:image / twitter:image meta tags.
+// Each image also gets the page title, its caption and the text around it.
+func parseHTMLForLinksAndImages(r io.Reader, base *url.URL) (parsedPage, error) {
 	z := html.NewTokenizer(r)
 	links := make([]string, 0)
 	images := make([]ImageRef, 0)
+	stylesheets := make([]string, 0)
+	feeds := make([]string, 0)
+	pictureDepth := 0
+	inStyle := false
+
+	// text context: visible text so far, and where in it each image appeared
+	var text strings.Builder
+	var textPos []int
+	title, inTitle, skipText := "", false, 0
+	// caption context: open <figure>/<table> elements, their captions, and which one
+	// each image belongs to (-1 = none)
+	var containers []int
+	var captions []strings.Builder
+	var imgContainer []int
+	inCaption := -1
+	addImage := func(ref ImageRef) {
+		images = append(images, ref)
+		textPos = append(textPos, text.Len())
+		c := -1
+		if len(containers) > 0 {
+			c = containers[len(containers)-1]
+		}
+		imgContainer = append(imgContainer, c)
+	}
+	finish := func() parsedPage {
+		all := text.String()
+		for i := range images {
+			images[i].PageURL = base.String()
+			images[i].PageTitle = title
+			if c := imgContainer[i]; c >= 0 {
+				images[i].Caption = collapseSpace(captions[c].String())
+			}
+			images[i].Context = textWindow(all, textPos[i], contextChars)
+		}
+		return parsedPage{Title: title, Links: uniqueStrings(links), Images: uniqueImages(images), Stylesheets: uniqueStrings(stylesheets), Feeds: uniqueStrings(feeds)}
+	}
 	for {
 		t := z.Next()
 		switch t {
 		case html.ErrorToken:
 			if z.Err() == io.EOF {
-				return uniqueStrings(links), images, nil
+				return finish(), nil
+			}
+			return parsedPage{}, z.Err()
+		case html.TextToken:
+			if inStyle {
+				for _, s := range cssImageURLs(string(z.Text()), base) {
+					addImage(ImageRef{Src: s, Source: SourceCSS})
+				}
+			}
+			switch {
+			case inTitle:
+				if title == "" {
+					title = collapseSpace(html.UnescapeString(string(z.Text())))
+				}
+			case skipText == 0:
+				s := html.UnescapeString(string(z.Text()))
+				text.WriteString(s)
+				text.WriteByte(' ')
+				if inCaption >= 0 {
+					captions[inCaption].WriteString(s)
+					captions[inCaption].WriteByte(' ')
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "picture":
+				if pictureDepth > 0 {
+					pictureDepth--
+				}
+			case "style":
+				inStyle = false
+			case "title":
+				inTitle = false
+			}
+			switch string(name) {
+			case "script", "style", "noscript", "template":
+				if skipText > 0 {
+					skipText--
+				}
+			case "figure", "table":
+				if len(containers) > 0 {
+					containers = containers[:len(containers)-1]
+				}
+				inCaption = -1
+			case "figcaption", "caption":
+				inCaption = -1
 			}
-			return nil, nil, z.Err()
 		case html.StartTagToken, html.SelfClosingTagToken:
 			n := z.Token()
-			if n.Data == "a" {
-				for _, a := range n.Attr {
-					if a.Key == "href" {
-						if h := sanitizeURL(a.Val, base); h != "" {
-							links = append(links, h)
-						}
+			attrs := map[string]string{}
+			for _, a := range n.Attr {
+				attrs[strings.ToLower(a.Key)] = a.Val
+			}
+			if style := attrs["style"]; style != "" {
+				for _, s := range cssImageURLs(style, base) {
+					addImage(ImageRef{Src: s, Source: SourceStyle})
+				}
+			}
+			if t == html.StartTagToken {
+				switch n.Data {
+				case "title":
+					inTitle = true
+				case "script", "style", "noscript", "template":
+					skipText++
+				case "figure", "table":
+					captions = append(captions, strings.Builder{})
+					containers = append(containers, len(captions)-1)
+				case "figcaption", "caption":
+					if len(containers) > 0 {
+						inCaption = containers[len(containers)-1]
 					}
 				}
-				continue
 			}
-			if n.Data == "img" {
-				src := ""
-				alt := ""
-				title := ""
-				for _, a := range n.Attr {
-					switch strings.ToLower(a.Key) {
-					case "src":
-						src = a.Val
-					case "alt":
-						alt = a.Val
-					case "title":
-						title = a.Val
+			switch n.Data {
+			case "a":
+				if h := sanitizeURL(attrs["href"], base); h != "" {
+					links = append(links, h)
+				}
+			case "img":
+				if ref, ok := imgRef(attrs, base); ok {
+					addImage(ref)
+				}
+			case "picture":
+				if t == html.StartTagToken {
+					pictureDepth++
+				}
+			case "source":
+				if pictureDepth == 0 {
+					// <video>/<audio> sources aren't images
+					continue
+				}
+				srcset := attrs["srcset"]
+				if srcset == "" {
+					srcset = attrs["data-srcset"]
+				}
+				if ref, ok := srcsetRef(srcset, base); ok {
+					ref.Source = SourcePicture
+					addImage(ref)
+				}
+			case "link":
+				rel := strings.Fields(strings.ToLower(attrs["rel"]))
+				for _, r := range rel {
+					if r == "stylesheet" {
+						if h := sanitizeURL(attrs["href"], base); h != "" {
+							stylesheets = append(stylesheets, h)
+						}
+						break
+					}
+					if r == "alternate" && isFeedType(attrs["type"]) {
+						if h := sanitizeURL(attrs["href"], base); h != "" {
+							feeds = append(feeds, h)
+						}
+						break
+					}
+				}
+			case "meta":
+				key := strings.ToLower(attrs["property"])
+				if key == "" {
+					key = strings.ToLower(attrs["name"])
+				}
+				source := ""
+				switch key {
+				case "og:image", "og:image:url", "og:image:secure_url":
+					source = SourceOpenGraph
+				case "twitter:image", "twitter:image:src":
+					source = SourceTwitterImage
+				}
+				if source != "" {
+					if s := sanitizeURL(attrs["content"], base); s != "" {
+						addImage(ImageRef{Src: s, Source: source})
 					}
 				}
-				if s := sanitizeURL(src, base); s != "" {
-					images = append(images, ImageRef{Src: s, Alt: alt, Title: title})
+			case "style":
+				if t == html.StartTagToken {
+					inStyle = true
 				}
 			}
 		}
 	}
 }
 
+// imgRef picks the best URL of an <img>: the largest srcset candidate, then the
+// lazy-loading attribute, then src. The remaining candidates become Alternates.
+func imgRef(attrs map[string]string, base *url.URL) (ImageRef, bool) {
+	srcset := attrs["srcset"]
+	if srcset == "" {
+		srcset = attrs["data-srcset"]
+	}
+	lazy := attrs["data-src"]
+	if lazy == "" {
+		lazy = attrs["data-lazy-src"]
+	}
+
+	ref, ok := srcsetRef(srcset, base)
+	if ok {
+		ref.Source = SourceSrcset
+	}
+	for _, c := range []struct{ raw, source string }{{lazy, SourceDataSrc}, {attrs["src"], SourceImg}} {
+		s := sanitizeURL(c.raw, base) // drops data: placeholders
+		if s == "" {
+			continue
+		}
+		if !ok {
+			ref, ok = ImageRef{Src: s, Source: c.source}, true
+		} else if s != ref.Src {
+			ref.Alternates = append(ref.Alternates, s)
+		}
+	}
+	ref.Alternates = uniqueStrings(ref.Alternates)
+	ref.Alt = attrs["alt"]
+	ref.Title = attrs["title"]
+	return ref, ok
+}
+
+// srcsetRef returns the largest candidate of a srcset, the others as Alternates.
+func srcsetRef(srcset string, base *url.URL) (ImageRef, bool) {
+	cs := parseSrcset(srcset)
+	valid := cs[:0]
+	for _, c := range cs {
+		if c.URL = sanitizeURL(c.URL, base); c.URL != "" {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return ImageRef{}, false
+	}
+	best := largestCandidate(valid)
+	ref := ImageRef{Src: valid[best].URL}
+	for i, c := range valid {
+		if i != best && c.URL != ref.Src {
+			ref.Alternates = append(ref.Alternates, c.URL)
+		}
+	}
+	return ref, true
+}
+
 func sanitizeURL(raw string, base *url.URL) string {
 	raw = strings.TrimSpace(raw)
 	if raw == "" {
@@ -458,6 +1428,7 @@ func sanitizeURL(raw string, base *url.URL) string {
 	if u.Scheme != "http" && u.Scheme != "https" {
 		return ""
 	}
+	canonicalizeURL(u)
 	return u.String()
 }
 
@@ -486,8 +1457,16 @@ func sameSite(base *url.URL, other string) bool {
 	return bdp == ohp
 }
 
-// processImage downloads image, saves file, generates thumbnail (if raster), inserts metadata to DB
-func (d *Dispatcher) processImage(ctx context.Context, img ImageRef, pageBase *url.URL) error {
+// processImage downloads image, saves file, generates thumbnail (if raster), inserts metadata into the store.
+// With prev, the image's record from an earlier crawl of the page, the download is
+// conditional and the record is updated instead (recrawl.go).
+func (d *Dispatcher) processImage(ctx context.Context, img ImageRef, pageBase *url.URL, prev *ImageMeta) (err error) {
+	defer func() {
+		// the decoders parse hostile input; a bug in one mustn't take down every crawl
+		if p := recover(); p != nil {
+			err = &skippedError{skipUnreadable, fmt.Sprintf("decoder panic: %v", p)}
+		}
+	}()
 	u, err := url.Parse(img.Src)
 	if err != nil {
 		return err
@@ -496,77 +1475,222 @@ func (d *Dispatcher) processImage(ctx context.Context, img ImageRef, pageBase *u
 		u = pageBase.ResolveReference(u)
 	}
 	// Download image
-	client := &http.Client{Timeout: 20 * time.Second}
-	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	req.Header.Set("User-Agent", "GoImageCrawler/1.0")
-	resp, err := client.Do(req)
+	fr := fetchRequest{Kind: "image", URL: u.String(), MaxBytes: d.imageLimits.MaxBytes}
+	if prev != nil {
+		fr.ETag, fr.LastModified = prev.ETag, prev.LastModified
+	}
+	res, err := d.fetch(ctx, fr)
+	if errors.Is(err, errTooLarge) && d.imageLimits.MaxBytes > 0 {
+		return &skippedError{skipMaxBytes, err.Error()}
+	}
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("non-200: %d", resp.StatusCode)
+	etag, lastModified := validators(res.Header)
+	if res.StatusCode == http.StatusNotModified {
+		metricRevalidations.Inc("image", "not_modified")
+		return d.touch(ctx, *prev, img, etag, lastModified)
 	}
-	// Determine filename
-	fname := path.Base(u.Path)
-	if fname == "" || fname == "/" || fname == "." {
-		// try from URL
-		fname = urlSafeFilename(u.String())
-	}
-	// Ensure unique filename
-	unique := uniqueFilename(d.imageDir, fname)
-	outfile := filepath.Join(d.imageDir, unique)
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	b := res.Body
+	if err := d.imageLimits.checkBytes(int64(len(b))); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(outfile, b, 0644); err != nil {
+	if err := d.imageLimits.checkType(imageMIME(res.Header.Get("Content-Type"), b)); err != nil {
 		return err
 	}
-	// Try to decode image to get dimensions and type
-	header := bytes.NewReader(b)
-	cfg, format, err := image.DecodeConfig(header)
-	thumbnailPath := ""
-	width := 0
-	height := 0
+	sha := sha256Hex(b)
+	if prev != nil {
+		if sha == prev.SHA256 {
+			metricRevalidations.Inc("image", "unchanged")
+			return d.touch(ctx, *prev, img, etag, lastModified)
+		}
+		metricRevalidations.Inc("image", "changed")
+	}
+	meta := &ImageMeta{
+		URL:          u.String(),
+		Alt:          img.Alt,
+		Title:        img.Title,
+		SHA256:       sha,
+		Source:       img.Source,
+		Alternates:   img.Alternates,
+		PageURL:      img.PageURL,
+		PageTitle:    img.PageTitle,
+		Caption:      img.Caption,
+		Context:      img.Context,
+		ETag:         etag,
+		LastModified: lastModified,
+		CheckedAt:    time.Now(),
+	}
+	// Try to decode image to get dimensions, type and perceptual hashes
+	var decoded image.Image
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
 	if err == nil {
-		width = cfg.Width
-		height = cfg.Height
+		meta.Width = cfg.Width
+		meta.Height = cfg.Height
+		if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+			// don't let a tiny file with a huge header allocate gigabytes
+			return err
+		}
 		if format != "svg" {
-			// generate thumbnail
-			thumbPath := outfile + ".thumb.png"
-			if err := makeThumbnail(bytes.NewReader(b), thumbPath); err == nil {
-				thumbnailPath = thumbPath
+			// camera JPEGs are often stored sideways with an EXIF rotation flag
+			orientation := 1
+			if format == "jpeg" {
+				orientation = exifOrientation(b)
+			}
+			if orientation >= 5 {
+				meta.Width, meta.Height = meta.Height, meta.Width
+			}
+			// the header is enough to tell a spacer or tracking pixel, skip decoding it
+			if err := d.imageLimits.checkSize(meta.Width, meta.Height); err != nil {
+				return err
+			}
+			if decoded, meta.Frames, meta.Duration, err = decodeImage(b, format); err == nil {
+				if orientation != 1 {
+					decoded = applyOrientation(decoded, orientation)
+					meta.Width, meta.Height = decoded.Bounds().Dx(), decoded.Bounds().Dy()
+				}
+				meta.AHash, meta.DHash, meta.PHash = perceptualHashes(decoded)
 			} else {
-				log.Printf("thumbnail failed: %v", err)
+				log.Printf("decode %s: %v", u, err)
 			}
 		}
-	} else {
+	} else if isSVG(b) {
 		// Not a raster decodeable image; check if it's SVG by sniffing
-		if isSVG(b) {
-			format = "svg"
-			// optionally rasterize using external command
-			if d.svgRasterCmd != "" {
-				outp := outfile + ".thumb.png"
-				cmdStr := fmt.Sprintf(d.svgRasterCmd, MaxThumbnailWidth, outp, outfile)
-				// Use shell to execute formatting; user must ensure command string is safe
-				cmd := exec.Command("/bin/sh", "-c", cmdStr)
-				if err := cmd.Run(); err == nil {
-					thumbnailPath = outp
-				}
-			}
+		format = "svg"
+		// Rendered in-process (svg.go); the render doubles as thumbnail and hash input
+		if raster, w, h, err := rasterizeSVG(b, d.thumbs.maxSize()); err == nil {
+			decoded = raster
+			meta.Width, meta.Height = w, h
+			meta.AHash, meta.DHash, meta.PHash = perceptualHashes(decoded)
 		} else {
-			log.Printf("unknown image format for %s", outfile)
+			log.Printf("svg %s: %v", u, err)
+		}
+		if err := d.imageLimits.checkSize(meta.Width, meta.Height); err != nil {
+			return err
 		}
 	}
+	meta.Format = format
+	meta.PhotoMeta = extractPhotoMeta(b, format)
+	if decoded != nil {
+		meta.Palette, meta.AvgColor, meta.Colorfulness = colorStats(decoded)
+	}
 
-	// Insert into DB
-	res, err := d.db.Exec(`INSERT INTO images (url, filename, thumbnail_path, alt_text, title_text, width, height, format) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, u.String(), unique, thumbnailPath, img.Alt, img.Title, width, height, format)
+	// Same picture under another URL or size: link to the canonical record, don't save it again
+	canon, release, err := d.claimImage(ctx, meta, prev)
 	if err != nil {
 		return err
 	}
-	_ = res
-	return nil
+	if canon != nil {
+		meta.Filename = canon.Filename
+		meta.Thumbnail = canon.Thumbnail
+		meta.Thumbnails = canon.Thumbnails
+		meta.DuplicateOf = canon.ID
+		return d.save(ctx, meta, prev)
+	}
+	defer release()
+
+	// Determine filename
+	fname := path.Base(u.Path)
+	if fname == "" || fname == "/" || fname == "." {
+		// try from URL
+		fname = urlSafeFilename(u.String())
+	}
+	unique, err := writeUniqueFile(d.imageDir, fname, b)
+	if err != nil {
+		return err
+	}
+	outfile := filepath.Join(d.imageDir, unique)
+	meta.Filename = unique
+	if decoded != nil {
+		thumbs, err := makeThumbnails(decoded, format, outfile, d.thumbs)
+		if err != nil {
+			log.Printf("thumbnail failed: %v", err)
+		}
+		metricThumbnails.Add(float64(len(thumbs)))
+		if len(thumbs) > 0 {
+			meta.Thumbnails = thumbs
+			meta.Thumbnail = defaultThumbnail(thumbs)
+		}
+	} else if format == "svg" && d.svgRasterCmd != "" {
+		// the built-in renderer failed; fall back to the external rasterizer if configured
+		outp := outfile + ".thumb.png"
+		if err := runSVGRasterCmd(ctx, d.svgRasterCmd, MaxThumbnailWidth, outp, outfile); err == nil {
+			metricThumbnails.Inc()
+			meta.Thumbnail = outp
+		} else {
+			log.Printf("svg-raster-cmd %s: %v", outfile, err)
+		}
+	} else if format == "" {
+		log.Printf("unknown image format for %s", outfile)
+	}
+
+	return d.save(ctx, meta, prev)
+}
+
+// claimImage looks for an earlier copy of meta in the store. If there is one, other
+// than prev, it is returned. Otherwise meta is marked as being saved until release is
+// called, and copies of it found meanwhile wait until then.
+func (d *Dispatcher) claimImage(ctx context.Context, meta, prev *ImageMeta) (canon *ImageMeta, release func(), err error) {
+	for {
+		imageSaveMu.Lock()
+		wait, busy := savingImages[meta.SHA256]
+		if !busy {
+			break
+		}
+		imageSaveMu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	defer imageSaveMu.Unlock()
+	c, err := d.store.FindDuplicate(ctx, meta.SHA256, meta.PHash, d.dupDist)
+	switch {
+	case err == nil && (prev == nil || c.ID != prev.ID):
+		return &c, nil, nil
+	case err != nil && !errors.Is(err, ErrImageNotFound):
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	savingImages[meta.SHA256] = done
+	return nil, func() {
+		imageSaveMu.Lock()
+		delete(savingImages, meta.SHA256)
+		imageSaveMu.Unlock()
+		close(done)
+	}, nil
+}
+
+// save inserts meta into the store, or replaces prev with it when the image changed
+// since an earlier crawl. The old file stays, as duplicates of prev may use it.
+func (d *Dispatcher) save(ctx context.Context, meta, prev *ImageMeta) error {
+	var err error
+	if prev == nil {
+		_, err = d.store.Insert(ctx, meta)
+	} else {
+		meta.ID = prev.ID
+		meta.CrawledAt = time.Now()
+		err = d.store.Update(ctx, meta)
+	}
+	d.inserted(meta, err)
+	return err
+}
+
+// inserted counts and reports the result of saving meta into the store.
+func (d *Dispatcher) inserted(meta *ImageMeta, err error) {
+	if err != nil {
+		metricInsertErrors.Inc()
+		return
+	}
+	d.count(&d.images)
+	dup := meta.DuplicateOf != 0
+	if dup {
+		d.count(&d.duplicates)
+	}
+	metricImagesSaved.Inc(strconv.FormatBool(dup))
+	im := *meta
+	d.publish(Event{Type: EventImageSaved, URL: im.URL, Image: &im})
 }
 
 func urlSafeFilename(u string) string {
@@ -574,55 +1698,65 @@ func urlSafeFilename(u string) string {
 	return re.ReplaceAllString(u, "-")
 }
 
-func uniqueFilename(dir, fname string) string {
-	base := fname
+// writeUniqueFile writes data to a new file in dir named fname, or fname with -1, -2...
+// before the extension if that is taken, and returns the name used. Names are claimed
+// with O_EXCL, so concurrent saves never pick the same one.
+func writeUniqueFile(dir, fname string, data []byte) (string, error) {
 	ext := filepath.Ext(fname)
-	name := strings.TrimSuffix(base, ext)
+	name := strings.TrimSuffix(fname, ext)
 	for i := 0; ; i++ {
 		candidate := fname
 		if i > 0 {
 			candidate = fmt.Sprintf("%s-%d%s", name, i, ext)
 		}
-		if _, err := os.Stat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
-			return candidate
+		p := filepath.Join(dir, candidate)
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
 		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(p)
+			return "", err
+		}
+		return candidate, nil
 	}
 }
 
-func makeThumbnail(r io.Reader, outpath string) error {
-	img, _, err := image.Decode(r)
-	if err != nil {
-		return err
+// runSVGRasterCmd runs the -svg-raster-cmd template without a shell: the template is
+// split on spaces and its %d / %s verbs are filled, in order, with width, outpath and
+// inputpath, so file names taken from URLs are never interpreted by a shell.
+func runSVGRasterCmd(ctx context.Context, tmpl string, width int, outpath, inpath string) error {
+	fields := strings.Fields(tmpl)
+	if len(fields) == 0 {
+		return errors.New("empty command")
 	}
-	// scale
-	w := img.Bounds().Dx()
-	h := img.Bounds().Dy()
-	if w <= MaxThumbnailWidth {
-		// save as png
-		f, err := os.Create(outpath)
-		if err != nil {
-			return err
+	vals := []interface{}{width, outpath, inpath}
+	args := make([]string, 0, len(fields))
+	for _, f := range fields {
+		n := strings.Count(f, "%d") + strings.Count(f, "%s")
+		if n > len(vals) {
+			return fmt.Errorf("too many placeholders in %q", tmpl)
 		}
-		defer f.Close()
-		return png.Encode(f, img)
-	}
-	newW := MaxThumbnailWidth
-	newH := (newW * h) / w
-	newImg := image.NewRGBA(image.Rect(0, 0, newW, newH))
-	// simple nearest-neighbor scaling
-	for y := 0; y < newH; y++ {
-		for x := 0; x < newW; x++ {
-			srcX := x * w / newW
-			srcY := y * h / newH
-			newImg.Set(x, y, img.At(srcX, srcY))
+		if n > 0 {
+			f = fmt.Sprintf(f, vals[:n]...)
+			vals = vals[n:]
 		}
+		args = append(args, f)
 	}
-	f, err := os.Create(outpath)
+	cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(cmdCtx, args[0], args[1:]...).CombinedOutput()
 	if err != nil {
-		return err
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
 	}
-	defer f.Close()
-	return png.Encode(f, newImg)
+	return nil
 }
 
 func isSVG(b []byte) bool {
@@ -630,86 +1764,338 @@ func isSVG(b []byte) bool {
 	return strings.HasPrefix(s, "<?xml") || strings.Contains(s, "<svg")
 }
 
-// startHTTPServer starts a simple web UI to search and view images
-func startHTTPServer(db *sql.DB, imageDir string, port int) error {
+// filterFromQuery reads the search parameters shared by the HTML page and the JSON
+// API. Empty parameters are ignored; malformed ones are an error.
+func filterFromQuery(q url.Values) (ImageFilter, error) {
+	filter := ImageFilter{
+		Format:        q.Get("format"),
+		Filename:      q.Get("filename"),
+		CanonicalOnly: q.Get("duplicates") == "",
+		HideStale:     q.Get("stale") == "",
+		PageURL:       q.Get("page_url"),
+		HasGPS:        q.Get("gps") != "",
+		Copyright:     q.Get("copyright"),
+	}
+	var err error
+	intParam := func(name string, dst *int) {
+		if v := q.Get(name); v != "" && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 0 {
+				err = fmt.Errorf("%s: want a non-negative integer", name)
+			}
+		}
+	}
+	floatParam := func(name string, dst *float64) {
+		if v := q.Get(name); v != "" && err == nil {
+			if *dst, err = strconv.ParseFloat(v, 64); err != nil || *dst < 0 {
+				err = fmt.Errorf("%s: want a non-negative number", name)
+			}
+		}
+	}
+	intParam("minw", &filter.MinWidth)
+	intParam("minh", &filter.MinHeight)
+	floatParam("de", &filter.ColorDelta)
+	floatParam("share", &filter.ColorShare)
+	if err != nil {
+		return filter, err
+	}
+	if v := q.Get("taken_after"); v != "" {
+		if filter.TakenAfter, err = time.Parse("2006-01-02", v); err != nil {
+			return filter, errors.New("taken_after: want YYYY-MM-DD")
+		}
+	}
+	if v := q.Get("color"); v != "" {
+		if _, ok := parseHexColor(v); !ok {
+			return filter, errors.New("color: want #rrggbb")
+		}
+		filter.Color = v
+	}
+	switch v := q.Get("sort"); v {
+	case SortRelevance, "relevance":
+		filter.Sort = SortRelevance
+	case SortNewest, SortLargest, SortFormat, SortColorful:
+		filter.Sort = v
+	default:
+		return filter, fmt.Errorf("sort: unknown order %q", q.Get("sort"))
+	}
+	return filter, nil
+}
+
+// uiPageSize is the number of images per page of the search UI.
+const uiPageSize = 60
+
+// sortOption is an entry of the search form's sort menu.
+type sortOption struct{ Value, Label string }
+
+var sortOptions = []sortOption{
+	{SortRelevance, "relevance"},
+	{SortNewest, "newest"},
+	{SortLargest, "largest"},
+	{SortFormat, "format"},
+	{SortColorful, "most colorful"},
+}
+
+// pageTemplates holds templates/*.html; html/template escapes every value for the
+// context it appears in (text, attribute, URL, CSS).
+var pageTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"img":   imageURL,
+	"thumb": thumbURL,
+	"preview": func(im ImageMeta) string {
+		if w := largestThumbnail(im.Thumbnails); w > 0 {
+			return imageURL(im.Thumbnails[w])
+		}
+		return imageURL(im.Filename)
+	},
+	"srcset": func(im ImageMeta) string {
+		// let high-DPI screens pick the larger thumbnails
+		widths := make([]int, 0, len(im.Thumbnails))
+		for w := range im.Thumbnails {
+			widths = append(widths, w)
+		}
+		sort.Ints(widths)
+		srcset := make([]string, 0, len(widths))
+		for _, w := range widths {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", imageURL(im.Thumbnails[w]), w))
+		}
+		return strings.Join(srcset, ", ")
+	},
+	"camera": func(im ImageMeta) string { return strings.TrimSpace(im.CameraMake + " " + im.CameraModel) },
+	"osm": func(im ImageMeta) string {
+		return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f", im.GPSLat, im.GPSLon)
+	},
+	"pct":  func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	"join": strings.Join,
+	"action": func(id int, name string) interface{} {
+		return struct {
+			ID   int
+			Name string
+		}{id, name}
+	},
+}).ParseFS(templatesFS, "templates/*.html"))
+
+// searchPageData is the data of templates/search.html.
+type searchPageData struct {
+	Heading  string     // shown above the results, e.g. by /similar
+	Query    url.Values // the form fields, to fill the form in again
+	Sorts    []sortOption
+	Images   []ImageMeta
+	FirstURL string
+	NextURL  string
+}
+
+// imagePageData is the data of templates/image.html.
+type imagePageData struct {
+	Image     ImageMeta
+	Canonical *ImageMeta  // the image Image duplicates, nil if it is canonical
+	Copies    []ImageMeta // the canonical image and all its duplicates
+}
+
+// crawlsPageData is the data of templates/crawls.html.
+type crawlsPageData struct {
+	Defaults   CrawlConfig
+	MaxWorkers int
+	Crawls     []CrawlStatus
+}
+
+// crawlRequestFromForm reads the start form of templates/crawls.html. The form always
+// shows every setting, so unchecked boxes mean false.
+func crawlRequestFromForm(r *http.Request) (crawlRequest, error) {
+	req := crawlRequest{Timeout: strings.TrimSpace(r.PostFormValue("timeout"))}
+	for _, line := range strings.Split(r.PostFormValue("urls"), "\n") {
+		if u := strings.TrimSpace(line); u != "" {
+			req.URLs = append(req.URLs, u)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		dst  **int
+	}{
+		{"workers", &req.Workers},
+		{"max_depth", &req.MaxDepth},
+		{"max_pages", &req.MaxPages},
+		{"max_pages_per_host", &req.MaxPagesPerHost},
+	} {
+		v := strings.TrimSpace(r.PostFormValue(f.name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return req, fmt.Errorf("%s: want an integer", f.name)
+		}
+		*f.dst = &n
+	}
+	follow, js := r.PostFormValue("follow_external") != "", r.PostFormValue("enable_js") != ""
+	req.FollowExternal, req.EnableJS = &follow, &js
+	sitemaps, feeds := r.PostFormValue("sitemaps") != "", r.PostFormValue("feeds") != ""
+	req.Sitemaps, req.Feeds = &sitemaps, &feeds
+	return req, nil
+}
+
+func thumbURL(im ImageMeta) string {
+	if im.Thumbnail == "" {
+		// use original
+		return imageURL(im.Filename)
+	}
+	return imageURL(im.Thumbnail)
+}
+
+func largestThumbnail(t map[int]string) int {
+	best := 0
+	for w := range t {
+		if w > best {
+			best = w
+		}
+	}
+	return best
+}
+
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	// render into a buffer first, so a template error doesn't leave half a page
+	var buf bytes.Buffer
+	if err := pageTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("template %s: %v", name, err)
+		http.Error(w, "template error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// startHTTPServer starts a simple web UI to search and view images, and the JSON API (api.go)
+func startHTTPServer(store *indexedStore, crawls *CrawlManager, imageDir string, port int) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		q := r.URL.Query()
-		format := q.Get("format")
-		filename := q.Get("filename")
-		minw := q.Get("minw")
-		minh := q.Get("minh")
-		// build query
-		where := []string{"1=1"}
-		params := []interface{}{}
-		if format != "" {
-			where = append(where, "format = ?")
-			params = append(params, format)
-		}
-		if filename != "" {
-			where = append(where, "filename LIKE ?")
-			params = append(params, "%"+filename+"%")
-		}
-		if minw != "" {
-			if v, err := strconv.Atoi(minw); err == nil {
-				where = append(where, "width >= ?")
-				params = append(params, v)
-			}
+		fq := r.URL.Query()
+		if q.Get("bycolor") == "" {
+			// the color picker always submits a value
+			fq.Del("color")
+		}
+		filter, err := filterFromQuery(fq)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		imgs, next, err := store.Page(r.Context(), strings.TrimSpace(q.Get("q")), filter, uiPageSize, q.Get("cursor"))
+		if errors.Is(err, errBadCursor) {
+			http.Error(w, err.Error(), 400)
+			return
 		}
-		if minh != "" {
-			if v, err := strconv.Atoi(minh); err == nil {
-				where = append(where, "height >= ?")
-				params = append(params, v)
+		if err != nil {
+			log.Printf("search: %v", err)
+			http.Error(w, "db error", 500)
+			return
+		}
+		data := searchPageData{Query: q, Sorts: sortOptions, Images: imgs}
+		pageQuery := func(cursor string) string {
+			pq := r.URL.Query()
+			pq.Del("cursor")
+			if cursor != "" {
+				pq.Set("cursor", cursor)
 			}
+			return "/?" + pq.Encode()
 		}
-		query := fmt.Sprintf("SELECT id, url, filename, thumbnail_path, alt_text, title_text, width, height, format, crawled_at FROM images WHERE %s ORDER BY crawled_at DESC LIMIT 500", strings.Join(where, " AND "))
-		rows, err := db.Query(query, params...)
+		data.FirstURL = pageQuery("")
+		if next != "" {
+			data.NextURL = pageQuery(next)
+		}
+		renderPage(w, "search.html", data)
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
 		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		im, err := store.Get(r.Context(), id)
+		if errors.Is(err, ErrImageNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("image %d: %v", id, err)
 			http.Error(w, "db error", 500)
 			return
 		}
-		defer rows.Close()
-		imgs := []ImageMeta{}
-		for rows.Next() {
-			var im ImageMeta
-			if err := rows.Scan(&im.ID, &im.URL, &im.Filename, &im.Thumbnail, &im.Alt, &im.Title, &im.Width, &im.Height, &im.Format, &im.CrawledAt); err != nil {
-				log.Printf("row scan: %v", err)
-				continue
+		data := imagePageData{Image: im}
+		canon := im
+		if im.DuplicateOf != 0 {
+			if canon, err = store.Get(r.Context(), im.DuplicateOf); err == nil {
+				data.Canonical = &canon
 			}
-			imgs = append(imgs, im)
-		}
-		// render template
-		tmplb, _ := templatesFS.ReadFile("templates/search.html")
-		tmpl := string(tmplb)
-		out := strings.ReplaceAll(tmpl, "{{IMAGES}}", buildImagesHTML(imgs, imageDir))
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write([]byte(out))
+		}
+		data.Copies = []ImageMeta{canon}
+		dups, err := store.Search(r.Context(), ImageFilter{DuplicateOf: canon.ID, Sort: SortNewest})
+		if err != nil {
+			log.Printf("image %d: duplicates: %v", id, err)
+		}
+		data.Copies = append(data.Copies, dups...)
+		renderPage(w, "image.html", data)
+	})
+	mux.HandleFunc("/similar", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		id, err := strconv.ParseInt(q.Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		dist := 10
+		if v, err := strconv.Atoi(q.Get("dist")); err == nil && v >= 0 && v <= 32 {
+			dist = v
+		}
+		imgs, err := store.Similar(r.Context(), id, dist, 200)
+		if errors.Is(err, ErrImageNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("similar: %v", err)
+			http.Error(w, "db error", 500)
+			return
+		}
+		heading := fmt.Sprintf("Similar to image #%d", id)
+		renderPage(w, "search.html", searchPageData{Heading: heading, Query: url.Values{}, Sorts: sortOptions, Images: imgs})
+	})
+	mux.HandleFunc("GET /crawls", func(w http.ResponseWriter, r *http.Request) {
+		data := crawlsPageData{Defaults: crawls.Defaults(), MaxWorkers: maxJobWorkers, Crawls: crawls.List()}
+		renderPage(w, "crawls.html", data)
+	})
+	mux.HandleFunc("POST /crawls", func(w http.ResponseWriter, r *http.Request) {
+		req, err := crawlRequestFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		cfg, err := req.config(crawls.Defaults())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		crawls.Start(req.URLs, cfg, nil, false)
+		http.Redirect(w, r, "/crawls", http.StatusSeeOther)
+	})
+	mux.HandleFunc("POST /crawls/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		action, ok := crawlActions(crawls)[r.PathValue("action")]
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// acting on a crawl that has just ended is harmless; the page shows its state
+		if err := action(id); errors.Is(err, ErrCrawlNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/crawls", http.StatusSeeOther)
 	})
 	mux.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(imageDir))))
+	registerAPI(mux, store, crawls)
+	mux.HandleFunc("GET /metrics", serveMetrics(crawls))
 	addr := fmt.Sprintf(":%d", port)
 	log.Printf("http server listening on %s", addr)
 	return http.ListenAndServe(addr, mux)
 }
-
-func buildImagesHTML(imgs []ImageMeta, dir string) string {
-	var sb strings.Builder
-	for _, im := range imgs {
-		thumb := im.Thumbnail
-		if thumb == "" {
-			// use original
-			thumb = filepath.Join("/images", im.Filename)
-		} else {
-			thumb = filepath.Join("/images", filepath.Base(thumb))
-		}
-		sb.WriteString("<div style='display:inline-block;margin:8px;text-align:center;width:220px'>")
-		sb.WriteString(fmt.Sprintf("<a href='%s' target='_blank'><img src='%s' style='max-width:200px;display:block;margin-bottom:4px'/></a>", im.URL, thumb))
-		sb.WriteString(fmt.Sprintf("<div style='font-size:12px'>%s<br/>%s %dx%d</div>", htmlEscape(im.Filename), htmlEscape(im.Format), im.Width, im.Height))
-		sb.WriteString("</div>")
-	}
-	return sb.String()
-}
-
-func htmlEscape(s string) string {
-	replacer := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
-	return replacer.Replace(s)
-}
@@ -0,0 +1,464 @@
+package homework2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Embedded photo metadata: EXIF (camera, lens, capture date, GPS), XMP and IPTC
+// (creator, copyright, keywords) from JPEG, PNG, WebP and TIFF files. EXIF wins for
+// the technical fields, XMP and then IPTC fill in what is missing; keywords are merged.
+
+// PhotoMeta is the embedded metadata of an image.
+type PhotoMeta struct {
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	TakenAt     time.Time // zero if unknown
+
+	HasGPS bool
+	GPSLat float64
+	GPSLon float64
+
+	Creator   string
+	Copyright string
+	Keywords  []string
+}
+
+// maxXMPBytes bounds decompressed XMP packets from PNG iTXt chunks.
+const maxXMPBytes = 1 << 20
+
+// extractPhotoMeta reads whatever metadata blocks format carries.
+func extractPhotoMeta(b []byte, format string) PhotoMeta {
+	var exif, xmp, iptc []byte
+	switch format {
+	case "jpeg":
+		exif, xmp, iptc = jpegMetadataSegments(b)
+	case "png":
+		exif, xmp = pngMetadataChunks(b)
+	case "webp":
+		exif, xmp = webpMetadataChunks(b)
+	case "tiff":
+		exif = b
+	}
+	var m PhotoMeta
+	if exif != nil {
+		readEXIFMeta(exif, &m)
+	}
+	if xmp != nil {
+		readXMPMeta(xmp, &m)
+	}
+	if iptc != nil {
+		readIPTCMeta(iptc, &m)
+	}
+	m.Keywords = uniqueStrings(m.Keywords)
+	return m
+}
+
+// ---- containers ----
+
+// jpegMetadataSegments returns the Exif TIFF block, the XMP packet and the IPTC IIM
+// data (from the Photoshop APP13 segment) of a JPEG.
+func jpegMetadataSegments(b []byte) (exif, xmp, iptc []byte) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return
+		}
+		seg := b[i+4 : i+2+n]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			exif = seg[6:]
+		case marker == 0xE1 && bytes.HasPrefix(seg, []byte("http://ns.adobe.com/xap/1.0/\x00")):
+			xmp = seg[len("http://ns.adobe.com/xap/1.0/\x00"):]
+		case marker == 0xED && bytes.HasPrefix(seg, []byte("Photoshop 3.0\x00")):
+			iptc = photoshopIPTC(seg[len("Photoshop 3.0\x00"):])
+		}
+		i += 2 + n
+	}
+	return
+}
+
+// photoshopIPTC finds the IPTC-NAA resource (0x0404) among Photoshop image resources.
+func photoshopIPTC(b []byte) []byte {
+	for len(b) >= 12 && string(b[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(b[4:])
+		nameLen := int(b[6])
+		p := 7 + nameLen
+		if p%2 == 1 { // the Pascal name is padded to an even length
+			p++
+		}
+		if p+4 > len(b) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(b[p:]))
+		p += 4
+		if size < 0 || p+size > len(b) {
+			return nil
+		}
+		if id == 0x0404 {
+			return b[p : p+size]
+		}
+		p += size + size&1
+		if p > len(b) {
+			return nil
+		}
+		b = b[p:]
+	}
+	return nil
+}
+
+// pngMetadataChunks returns the eXIf chunk and the XMP packet from an iTXt chunk.
+func pngMetadataChunks(b []byte) (exif, xmp []byte) {
+	if len(b) < 8 || string(b[:8]) != "\x89PNG\r\n\x1a\n" {
+		return
+	}
+	for p := 8; p+12 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		typ := string(b[p+4 : p+8])
+		if n < 0 || p+12+n > len(b) {
+			return
+		}
+		data := b[p+8 : p+8+n]
+		switch typ {
+		case "eXIf":
+			exif = data
+		case "iTXt":
+			if x := pngXMP(data); x != nil {
+				xmp = x
+			}
+		case "IDAT", "IEND":
+			// metadata normally precedes the image data; don't walk megabytes of IDAT
+			if exif != nil || xmp != nil || typ == "IEND" {
+				return
+			}
+		}
+		p += 12 + n
+	}
+	return
+}
+
+// pngXMP returns the text of an iTXt chunk with keyword XML:com.adobe.xmp.
+func pngXMP(data []byte) []byte {
+	const kw = "XML:com.adobe.xmp\x00"
+	if !bytes.HasPrefix(data, []byte(kw)) || len(data) < len(kw)+2 {
+		return nil
+	}
+	compressed := data[len(kw)] == 1
+	rest := data[len(kw)+2:]
+	// skip language tag and translated keyword
+	for i := 0; i < 2; i++ {
+		j := bytes.IndexByte(rest, 0)
+		if j < 0 {
+			return nil
+		}
+		rest = rest[j+1:]
+	}
+	if !compressed {
+		return rest
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxXMPBytes))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// webpMetadataChunks returns the EXIF and XMP chunks of an extended WebP.
+func webpMetadataChunks(b []byte) (exif, xmp []byte) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return
+	}
+	for p := 12; p+8 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		if n < 0 || p+8+n > len(b) {
+			return
+		}
+		data := b[p+8 : p+8+n]
+		switch string(b[p : p+4]) {
+		case "EXIF":
+			// some writers keep the JPEG-style prefix
+			exif = bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+		case "XMP ":
+			xmp = data
+		}
+		p += 8 + n + n&1
+	}
+	return
+}
+
+// ---- EXIF ----
+
+func readEXIFMeta(raw []byte, m *PhotoMeta) {
+	t, off, err := newTIFFReader(raw)
+	if err != nil {
+		return
+	}
+	ifd0, _, err := t.ifd(off)
+	if err != nil {
+		return
+	}
+	m.CameraMake = t.string(ifd0[tagMake])
+	m.CameraModel = t.string(ifd0[tagModel])
+	m.Creator = t.string(ifd0[tagArtist])
+	m.Copyright = t.string(ifd0[tagCopyright])
+	taken := t.string(ifd0[tagDateTime])
+	offset := ""
+
+	if p, ok := t.uint(ifd0[tagExifIFD], 0); ok {
+		if sub, _, err := t.ifd(p); err == nil {
+			if s := t.string(sub[tagDateTimeOriginal]); s != "" {
+				taken = s
+				offset = t.string(sub[tagOffsetTimeOrig])
+			}
+			lensMake, lensModel := t.string(sub[tagLensMake]), t.string(sub[tagLensModel])
+			m.Lens = lensModel
+			if !strings.HasPrefix(lensModel, lensMake) {
+				m.Lens = strings.TrimSpace(lensMake + " " + lensModel)
+			}
+		}
+	}
+	if taken != "" {
+		m.TakenAt = parseEXIFTime(taken, offset)
+	}
+
+	if p, ok := t.uint(ifd0[tagGPSIFD], 0); ok {
+		if gps, _, err := t.ifd(p); err == nil {
+			lat, latOK := gpsCoordinate(t, gps[gpsLatitude], t.string(gps[gpsLatitudeRef]))
+			lon, lonOK := gpsCoordinate(t, gps[gpsLongitude], t.string(gps[gpsLongitudeRef]))
+			if latOK && lonOK && !(lat == 0 && lon == 0) {
+				m.HasGPS, m.GPSLat, m.GPSLon = true, lat, lon
+			}
+		}
+	}
+}
+
+// gpsCoordinate converts degrees/minutes/seconds rationals and an N/S/E/W reference
+// to signed decimal degrees.
+func gpsCoordinate(t *tiffReader, e tiffEntry, ref string) (float64, bool) {
+	d, ok1 := t.rational(e, 0)
+	mn, ok2 := t.rational(e, 1)
+	s, ok3 := t.rational(e, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	v := d + mn/60 + s/3600
+	if ref == "S" || ref == "W" {
+		v = -v
+	}
+	return v, true
+}
+
+// parseEXIFTime parses "2006:01:02 15:04:05" with an optional "+01:00" offset; EXIF
+// times without an offset are local to the camera and kept as UTC.
+func parseEXIFTime(s, offset string) time.Time {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", s+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil || t.Year() < 1800 {
+		return time.Time{}
+	}
+	return t
+}
+
+// ---- XMP ----
+
+// readXMPMeta picks the common Dublin Core, Photoshop, TIFF and EXIF properties out
+// of an XMP packet, matching them by local name. Values may be written as elements,
+// rdf:Seq/Bag/Alt lists or attributes of rdf:Description.
+func readXMPMeta(packet []byte, m *PhotoMeta) {
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	dec.Strict = false
+	vals := map[string][]string{}
+	var stack []string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name.Local == "Description" {
+				for _, a := range tok.Attr {
+					vals[a.Name.Local] = append(vals[a.Name.Local], a.Value)
+				}
+			}
+			stack = append(stack, tok.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(tok))
+			if text == "" || len(stack) == 0 {
+				continue
+			}
+			// the property is the innermost element that isn't RDF list syntax
+			prop := ""
+			for i := len(stack) - 1; i >= 0; i-- {
+				switch stack[i] {
+				case "li", "Seq", "Bag", "Alt":
+					continue
+				}
+				prop = stack[i]
+				break
+			}
+			vals[prop] = append(vals[prop], text)
+		}
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := vals[k]; len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+	fill := func(dst *string, keys ...string) {
+		if *dst == "" {
+			*dst = first(keys...)
+		}
+	}
+	fill(&m.CameraMake, "Make")
+	fill(&m.CameraModel, "Model")
+	fill(&m.Lens, "LensModel", "Lens")
+	fill(&m.Creator, "creator")
+	fill(&m.Copyright, "rights", "Copyright")
+	m.Keywords = append(m.Keywords, vals["subject"]...)
+	if m.TakenAt.IsZero() {
+		m.TakenAt = parseXMPTime(first("DateTimeOriginal", "DateCreated", "CreateDate"))
+	}
+	if !m.HasGPS {
+		lat, ok1 := parseXMPCoordinate(first("GPSLatitude"))
+		lon, ok2 := parseXMPCoordinate(first("GPSLongitude"))
+		if ok1 && ok2 {
+			m.HasGPS, m.GPSLat, m.GPSLon = true, lat, lon
+		}
+	}
+}
+
+// parseXMPTime parses the ISO 8601 subsets XMP allows.
+func parseXMPTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseXMPCoordinate parses "DDD,MM.mmk" or "DDD,MM,SSk" with k one of N, S, E, W.
+func parseXMPCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1]
+	parts := strings.Split(s[:len(s)-1], ",")
+	v := 0.0
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || i > 2 {
+			return 0, false
+		}
+		v += f / []float64{1, 60, 3600}[i]
+	}
+	switch ref {
+	case 'S', 'W':
+		return -v, true
+	case 'N', 'E':
+		return v, true
+	}
+	return 0, false
+}
+
+// ---- IPTC ----
+
+// IPTC IIM datasets of the application record (2).
+const (
+	iptcKeywords    = 25
+	iptcDateCreated = 55
+	iptcTimeCreated = 60
+	iptcByline      = 80
+	iptcCopyright   = 116
+)
+
+func readIPTCMeta(b []byte, m *PhotoMeta) {
+	var date, clock string
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, dataset := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:]))
+		p := 5
+		if size&0x8000 != 0 { // extended dataset: the low bits give the length of the length
+			n := size & 0x7FFF
+			if n > 4 || len(b) < 5+n {
+				return
+			}
+			size = 0
+			for _, c := range b[5 : 5+n] {
+				size = size<<8 | int(c)
+			}
+			p += n
+		}
+		if size < 0 || p+size > len(b) {
+			return
+		}
+		val := strings.TrimSpace(string(b[p : p+size]))
+		b = b[p+size:]
+		if record != 2 {
+			continue
+		}
+		switch dataset {
+		case iptcKeywords:
+			if val != "" {
+				m.Keywords = append(m.Keywords, val)
+			}
+		case iptcByline:
+			if m.Creator == "" {
+				m.Creator = val
+			}
+		case iptcCopyright:
+			if m.Copyright == "" {
+				m.Copyright = val
+			}
+		case iptcDateCreated:
+			date = val
+		case iptcTimeCreated:
+			clock = val
+		}
+	}
+	if m.TakenAt.IsZero() && date != "" {
+		if t, err := time.Parse("20060102150405-0700", date+clock); err == nil {
+			m.TakenAt = t
+		} else if t, err := time.Parse("20060102", date); err == nil {
+			m.TakenAt = t
+		}
+	}
+}
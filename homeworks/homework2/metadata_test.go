@@ -0,0 +1,358 @@
+package homework2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func cameraTIFF() []byte {
+	return buildTIFF(
+		[]exifField{
+			asciiField(tagMake, "Canon"),
+			asciiField(tagModel, "Canon EOS R5"),
+			asciiField(tagArtist, "Ivan Petrov"),
+			asciiField(tagDateTime, "2020:01:01 00:00:00"),
+			{tag: tagExifIFD, sub: 1},
+			{tag: tagGPSIFD, sub: 2},
+		},
+		[]exifField{
+			asciiField(tagDateTimeOriginal, "2023:07:15 18:30:05"),
+			asciiField(tagOffsetTimeOrig, "+03:00"),
+			asciiField(tagLensMake, "Canon"),
+			asciiField(tagLensModel, "RF24-105mm F4 L IS USM"),
+		},
+		[]exifField{
+			asciiField(gpsLatitudeRef, "N"),
+			rationalField(gpsLatitude, 42, 1, 41, 1, 30, 1),
+			asciiField(gpsLongitudeRef, "E"),
+			rationalField(gpsLongitude, 23, 1, 19, 1, 3600, 100),
+		},
+	)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:exif="http://ns.adobe.com/exif/1.0/"
+  exif:GPSLatitude="42,41.5N" exif:GPSLongitude="23,19.01E">
+ <dc:creator><rdf:Seq><rdf:li>XMP Author</rdf:li></rdf:Seq></dc:creator>
+ <dc:rights><rdf:Alt><rdf:li xml:lang="x-default">CC BY 4.0</rdf:li></rdf:Alt></dc:rights>
+ <dc:subject><rdf:Bag><rdf:li>Sofia</rdf:li><rdf:li>mountain</rdf:li></rdf:Bag></dc:subject>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+// iptcDataset encodes an IIM dataset of the application record.
+func iptcDataset(dataset byte, v string) []byte {
+	b := []byte{0x1C, 2, dataset, 0, 0}
+	binary.BigEndian.PutUint16(b[3:], uint16(len(v)))
+	return append(b, v...)
+}
+
+// photoshopResource wraps IPTC data in an APP13 8BIM resource with an empty name.
+func photoshopResource(id uint16, data []byte) []byte {
+	b := []byte("8BIM\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(b[4:], id)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestExtractPhotoMetaJPEG(t *testing.T) {
+	iptc := slices.Concat(
+		iptcDataset(iptcKeywords, "mountain"),
+		iptcDataset(iptcKeywords, "Vitosha"),
+		iptcDataset(iptcByline, "IPTC Author"),
+		iptcDataset(iptcCopyright, "IPTC rights"),
+	)
+	b := jpegWith(
+		jpegSegment(0xE1, append([]byte("Exif\x00\x00"), cameraTIFF()...)),
+		jpegSegment(0xE1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), testXMP...)),
+		jpegSegment(0xED, slices.Concat([]byte("Photoshop 3.0\x00"),
+			photoshopResource(0x0425, []byte{1, 2, 3}), photoshopResource(0x0404, iptc))),
+	)
+	m := extractPhotoMeta(b, "jpeg")
+
+	if m.CameraMake != "Canon" || m.CameraModel != "Canon EOS R5" {
+		t.Errorf("camera = %q %q", m.CameraMake, m.CameraModel)
+	}
+	if m.Lens != "RF24-105mm F4 L IS USM" && m.Lens != "Canon RF24-105mm F4 L IS USM" {
+		t.Errorf("lens = %q", m.Lens)
+	}
+	if want := time.Date(2023, 7, 15, 18, 30, 5, 0, time.FixedZone("", 3*3600)); !m.TakenAt.Equal(want) {
+		t.Errorf("taken at %v, want %v", m.TakenAt, want)
+	}
+	if !m.HasGPS || math.Abs(m.GPSLat-42.691667) > 1e-5 || math.Abs(m.GPSLon-23.326667) > 1e-5 {
+		t.Errorf("GPS = %v %v %v", m.HasGPS, m.GPSLat, m.GPSLon)
+	}
+	// EXIF wins, then XMP, then IPTC
+	if m.Creator != "Ivan Petrov" || m.Copyright != "CC BY 4.0" {
+		t.Errorf("creator %q, copyright %q", m.Creator, m.Copyright)
+	}
+	if want := []string{"Sofia", "mountain", "Vitosha"}; !slices.Equal(m.Keywords, want) {
+		t.Errorf("keywords = %q, want %q", m.Keywords, want)
+	}
+
+	// every truncation parses without panicking
+	for n := range b {
+		extractPhotoMeta(b[:n], "jpeg")
+	}
+}
+
+func TestReadEXIFMetaMalformed(t *testing.T) {
+	zeroDen := buildTIFF([]exifField{{tag: tagGPSIFD, sub: 1}}, []exifField{
+		asciiField(gpsLatitudeRef, "N"),
+		rationalField(gpsLatitude, 42, 0, 0, 1, 0, 1),
+		asciiField(gpsLongitudeRef, "E"),
+		rationalField(gpsLongitude, 23, 1, 0, 1, 0, 1),
+	})
+	short := buildTIFF([]exifField{{tag: tagGPSIFD, sub: 1}}, []exifField{
+		rationalField(gpsLatitude, 42, 1),
+		rationalField(gpsLongitude, 23, 1, 0, 1, 0, 1),
+	})
+	loop := buildTIFF([]exifField{{tag: tagExifIFD, sub: 0}, asciiField(tagMake, "Nikon")})
+	badSub := buildTIFF([]exifField{asciiField(tagMake, "Nikon"), {tag: tagExifIFD, typ: 4, count: 1, data: []byte{0xFF, 0xFF, 0xFF, 0x7F}}})
+	badDate := buildTIFF([]exifField{asciiField(tagDateTime, "0000:00:00 00:00:00")})
+	tests := []struct {
+		name   string
+		in     []byte
+		make   string
+		hasGPS bool
+	}{
+		{"zero denominator", zeroDen, "", false},
+		{"two GPS components", short, "", false},
+		{"IFD pointing at itself", loop, "Nikon", false},
+		{"EXIF IFD past the end", badSub, "Nikon", false},
+		{"zero date", badDate, "", false},
+		{"header only", []byte("II\x2a\x00\x08\x00\x00\x00"), "", false},
+		{"empty", nil, "", false},
+	}
+	for _, tt := range tests {
+		var m PhotoMeta
+		readEXIFMeta(tt.in, &m)
+		if m.CameraMake != tt.make || m.HasGPS != tt.hasGPS || !m.TakenAt.IsZero() {
+			t.Errorf("%s: readEXIFMeta = %+v", tt.name, m)
+		}
+	}
+}
+
+func TestParseEXIFTime(t *testing.T) {
+	tests := []struct {
+		s, offset string
+		want      time.Time
+	}{
+		{"2023:07:15 18:30:05", "", time.Date(2023, 7, 15, 18, 30, 5, 0, time.UTC)},
+		{"2023:07:15 18:30:05", "-05:00", time.Date(2023, 7, 15, 23, 30, 5, 0, time.UTC)},
+		{"2023:07:15 18:30:05", "garbage", time.Date(2023, 7, 15, 18, 30, 5, 0, time.UTC)},
+		{"0000:00:00 00:00:00", "", time.Time{}},
+		{"    :  :     :  :  ", "", time.Time{}},
+		{"2023-07-15", "", time.Time{}},
+		{"", "", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := parseEXIFTime(tt.s, tt.offset); !got.Equal(tt.want) {
+			t.Errorf("parseEXIFTime(%q, %q) = %v, want %v", tt.s, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestParseXMPTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2023-07-15T18:30:05.25+03:00", time.Date(2023, 7, 15, 15, 30, 5, 250e6, time.UTC)},
+		{"2023-07-15T18:30:05", time.Date(2023, 7, 15, 18, 30, 5, 0, time.UTC)},
+		{"2023-07-15T18:30Z", time.Date(2023, 7, 15, 18, 30, 0, 0, time.UTC)},
+		{"2023-07-15", time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{"2023", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"15.07.2023", time.Time{}},
+		{"", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := parseXMPTime(tt.in); !got.Equal(tt.want) {
+			t.Errorf("parseXMPTime(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseXMPCoordinate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"42,41.5N", 42.691667, true},
+		{"23,19,30E", 23.325, true},
+		{"33,52.5S", -33.875, true},
+		{"0,30W", -0.5, true},
+		{"42,41.5", 0, false},
+		{"42,41.5X", 0, false},
+		{"1,2,3,4N", 0, false},
+		{"a,bN", 0, false},
+		{"N", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseXMPCoordinate(tt.in)
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-5 {
+			t.Errorf("parseXMPCoordinate(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReadXMPMetaMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		creator string
+	}{
+		{"unclosed elements", `<rdf:Description><dc:creator><rdf:Seq><rdf:li>Anna`, "Anna"},
+		{"stray end tag", `<dc:creator>Anna</dc:creator></a><dc:rights>x</dc:rights>`, "Anna"},
+		{"attribute", `<rdf:Description dc:creator="Anna"/>`, "Anna"},
+		{"undeclared entity", `<dc:creator>&nbsp;Anna</dc:creator>`, "&nbsp;Anna"},
+		{"binary", "\x00\xff\xfe<\x01", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		var m PhotoMeta
+		readXMPMeta([]byte(tt.in), &m)
+		if m.Creator != tt.creator {
+			t.Errorf("%s: creator = %q, want %q", tt.name, m.Creator, tt.creator)
+		}
+	}
+}
+
+func TestReadIPTCMeta(t *testing.T) {
+	extended := []byte{0x1C, 2, iptcByline, 0x80, 0x02, 0x00, 0x04}
+	extended = append(extended, "Anna"...)
+	tests := []struct {
+		name     string
+		in       []byte
+		creator  string
+		keywords int
+		taken    time.Time
+	}{
+		{"date and time", slices.Concat(iptcDataset(iptcDateCreated, "20230715"), iptcDataset(iptcTimeCreated, "183005+0300")),
+			"", 0, time.Date(2023, 7, 15, 15, 30, 5, 0, time.UTC)},
+		{"date only", iptcDataset(iptcDateCreated, "20230715"), "", 0, time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{"extended length", extended, "Anna", 0, time.Time{}},
+		{"other record", []byte("\x1c\x01\x50\x00\x04Anna"), "", 0, time.Time{}},
+		{"empty keyword", iptcDataset(iptcKeywords, "  "), "", 0, time.Time{}},
+		{"length past the end", append(iptcDataset(iptcKeywords, "a"), 0x1C, 2, iptcByline, 0x7F, 0xFF, 'x'), "", 1, time.Time{}},
+		{"length of length too big", append(iptcDataset(iptcKeywords, "a"), 0x1C, 2, iptcByline, 0x80, 0x08, 1, 2, 3, 4, 5, 6, 7, 8), "", 1, time.Time{}},
+		{"extended length past the end", []byte{0x1C, 2, iptcByline, 0x80, 0x04, 0xFF, 0xFF, 0xFF, 0xFF, 'A'}, "", 0, time.Time{}},
+		{"no tag marker", []byte("garbage"), "", 0, time.Time{}},
+		{"empty", nil, "", 0, time.Time{}},
+	}
+	for _, tt := range tests {
+		var m PhotoMeta
+		readIPTCMeta(tt.in, &m)
+		if m.Creator != tt.creator || len(m.Keywords) != tt.keywords || !m.TakenAt.Equal(tt.taken) {
+			t.Errorf("%s: readIPTCMeta = %+v", tt.name, m)
+		}
+	}
+}
+
+func TestPhotoshopIPTC(t *testing.T) {
+	named := []byte("8BIM\x04\x04\x03abc\x00\x00\x00\x02hi")
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"after another resource", slices.Concat(photoshopResource(0x0425, []byte{1}), photoshopResource(0x0404, []byte("iptc"))), "iptc"},
+		{"odd name padded", named, "hi"},
+		{"missing", photoshopResource(0x0425, []byte("xx")), ""},
+		{"size past the end", []byte("8BIM\x04\x04\x00\x00\x7f\xff\xff\xff\x00\x00"), ""},
+		{"huge size", []byte("8BIM\x04\x04\x00\x00\xff\xff\xff\xff\x00\x00"), ""},
+		{"name past the end", []byte("8BIM\x04\x04\xff\x00\x00\x00\x00\x00"), ""},
+		{"not 8BIM", []byte("8BIX\x04\x04\x00\x00\x00\x00\x00\x00"), ""},
+	}
+	for _, tt := range tests {
+		if got := string(photoshopIPTC(tt.in)); got != tt.want {
+			t.Errorf("%s: photoshopIPTC = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+func pngWith(chunks ...[]byte) []byte {
+	return slices.Concat(append([][]byte{[]byte("\x89PNG\r\n\x1a\n")}, chunks...)...)
+}
+
+func xmpITXt(t *testing.T, packet []byte, compressed bool) []byte {
+	t.Helper()
+	data := []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00")
+	if !compressed {
+		return pngChunk("iTXt", append(data, packet...))
+	}
+	data[len("XML:com.adobe.xmp\x00")] = 1
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(packet)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return pngChunk("iTXt", append(data, buf.Bytes()...))
+}
+
+func TestPNGMetadataChunks(t *testing.T) {
+	tiff := cameraTIFF()
+	tests := []struct {
+		name      string
+		in        []byte
+		exif, xmp int // lengths
+	}{
+		{"eXIf and iTXt", pngWith(pngChunk("eXIf", tiff), xmpITXt(t, []byte(testXMP), false), pngChunk("IEND", nil)), len(tiff), len(testXMP)},
+		{"compressed XMP", pngWith(xmpITXt(t, []byte(testXMP), true)), 0, len(testXMP)},
+		// a small chunk inflating to far more than any XMP packet
+		{"zlib bomb", pngWith(xmpITXt(t, make([]byte, 8*maxXMPBytes), true)), 0, maxXMPBytes},
+		{"corrupt zlib", pngWith(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x01\x00\x00\x00garbage"))), 0, 0},
+		{"other iTXt", pngWith(pngChunk("iTXt", []byte("Comment\x00\x00\x00\x00\x00hello"))), 0, 0},
+		{"iTXt without language", pngWith(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00"))), 0, 0},
+		{"after IEND", pngWith(pngChunk("IEND", nil), pngChunk("eXIf", tiff)), 0, 0},
+		{"length past the end", pngWith([]byte("\x7f\xff\xff\xffeXIf")), 0, 0},
+		{"huge length", pngWith([]byte("\xff\xff\xff\xffeXIf\x00\x00\x00\x00")), 0, 0},
+		{"not a PNG", []byte("GIF89a"), 0, 0},
+	}
+	for _, tt := range tests {
+		exif, xmp := pngMetadataChunks(tt.in)
+		if len(exif) != tt.exif || len(xmp) != tt.xmp {
+			t.Errorf("%s: pngMetadataChunks = %d, %d bytes, want %d, %d", tt.name, len(exif), len(xmp), tt.exif, tt.xmp)
+		}
+	}
+}
+
+func TestWebPMetadataChunks(t *testing.T) {
+	tiff := cameraTIFF()
+	tests := []struct {
+		name      string
+		in        []byte
+		exif, xmp int
+	}{
+		{"EXIF and XMP", riffFile(vp8x(0, 8, 8), riffChunk("EXIF", tiff), riffChunk("XMP ", []byte(testXMP))), len(tiff), len(testXMP)},
+		{"Exif prefix", riffFile(riffChunk("EXIF", append([]byte("Exif\x00\x00"), tiff...))), len(tiff), 0},
+		{"odd chunk padded", riffFile(riffChunk("ICCP", []byte{1}), riffChunk("XMP ", []byte(testXMP))), 0, len(testXMP)},
+		{"chunk past the end", riffFile([]byte("EXIF\xff\xff\xff\x7f")), 0, 0},
+		{"huge chunk", riffFile([]byte("EXIF\xff\xff\xff\xff")), 0, 0},
+		{"not WebP", []byte("RIFF\x00\x00\x00\x00WAVE"), 0, 0},
+	}
+	for _, tt := range tests {
+		exif, xmp := webpMetadataChunks(tt.in)
+		if len(exif) != tt.exif || len(xmp) != tt.xmp {
+			t.Errorf("%s: webpMetadataChunks = %d, %d bytes, want %d, %d", tt.name, len(exif), len(xmp), tt.exif, tt.xmp)
+		}
+	}
+}
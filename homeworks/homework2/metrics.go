@@ -0,0 +1,303 @@
+package homework2
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format (version 0.0.4), served at
+// /metrics for a Prometheus server to scrape. A handful of counters, gauges and
+// histograms don't need the client library, so they are kept here.
+
+// metricVec is a counter, gauge or histogram with one series per combination of
+// label values.
+type metricVec struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64 // upper bounds of a histogram, ascending, without +Inf
+
+	mu     sync.Mutex
+	series map[string]*series // by joined label values
+}
+
+type series struct {
+	labels []string
+	value  float64  // counters and gauges
+	counts []uint64 // histograms: observations per bucket, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (m *metricVec) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(values), len(m.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{labels: append([]string(nil), values...)}
+		if m.typ == "histogram" {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to the counter or gauge with the given label values.
+func (m *metricVec) Add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += v
+}
+
+// Inc adds 1 to the counter with the given label values.
+func (m *metricVec) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Set sets the gauge with the given label values.
+func (m *metricVec) Set(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value = v
+}
+
+// Reset drops every series of the gauge, e.g. those of crawls that have ended.
+func (m *metricVec) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[string]*series)
+}
+
+// Observe records v in the histogram with the given label values.
+func (m *metricVec) Observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	i := sort.SearchFloat64s(m.buckets, v) // first bucket with bound >= v
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, m.typ)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		var cum uint64
+		for i, n := range s.counts {
+			cum += n
+			le := math.Inf(1)
+			if i < len(m.buckets) {
+				le = m.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, s.labels, ""), s.count)
+	}
+}
+
+// labelString formats {name="value",...}, with an le label for histogram buckets.
+func labelString(names, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", n, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricRegistry is the set of metrics written at /metrics, in registration order.
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics []*metricVec
+}
+
+func (r *metricRegistry) register(name, help, typ string, buckets []float64, labels []string) *metricVec {
+	m := &metricVec{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	if len(labels) == 0 && typ != "histogram" {
+		m.get(nil) // report 0 before the first increment
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metricVec {
+	return r.register(name, help, "counter", nil, labels)
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metricVec {
+	return r.register(name, help, "gauge", nil, labels)
+}
+
+func (r *metricRegistry) histogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return r.register(name, help, "histogram", buckets, labels)
+}
+
+func (r *metricRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]*metricVec(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// crawlerMetrics are shared by all crawls of the process. Fetch kinds are page,
+// render (a page loaded by chromedp), stylesheet, image, sitemap (sitemaps and feeds)
+// and robots.
+var (
+	crawlerMetrics = &metricRegistry{}
+
+	fetchBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	metricFetchSeconds = crawlerMetrics.histogram("crawler_fetch_duration_seconds",
+		"Time to fetch a page, stylesheet or image, including the body.", fetchBuckets, "kind")
+	metricResponses = crawlerMetrics.counter("crawler_http_responses_total",
+		"HTTP responses by kind of fetch and status code.", "kind", "code")
+	metricFetchErrors = crawlerMetrics.counter("crawler_fetch_errors_total",
+		"Fetches that got no response: DNS, connection and timeout errors, failed renders.", "kind")
+	metricBytes = crawlerMetrics.counter("crawler_downloaded_bytes_total",
+		"Bytes of response bodies downloaded, before decompression.", "kind")
+	metricRetries = crawlerMetrics.counter("crawler_fetch_retries_total",
+		"Requests repeated after a 5xx, 429 or timeout.", "kind")
+	metricRedirects = crawlerMetrics.counter("crawler_redirects_total",
+		"Redirects followed.", "kind")
+	metricImagesSaved = crawlerMetrics.counter("crawler_images_saved_total",
+		"Images inserted into the store; duplicate=\"true\" for copies of an earlier image.", "duplicate")
+	metricThumbnails = crawlerMetrics.counter("crawler_thumbnails_total",
+		"Thumbnail files written.")
+	metricInsertErrors = crawlerMetrics.counter("crawler_store_insert_errors_total",
+		"Failed inserts into the image store.")
+	metricRevalidations = crawlerMetrics.counter("crawler_revalidations_total",
+		"Pages and images crawled before, by result: not_modified (304), unchanged (same SHA-256) or changed.", "kind", "result")
+	metricStaleImages = crawlerMetrics.counter("crawler_stale_images_total",
+		"Images marked stale because their page no longer has them.")
+	metricImagesSkipped = crawlerMetrics.counter("crawler_images_skipped_total",
+		"Images left out by -crawl-rules or the image limits, by the flag that excluded them.", "reason")
+
+	// set when scraped, see CrawlManager.collectMetrics
+	metricCrawls = crawlerMetrics.gauge("crawler_crawls",
+		"Crawls started by this process, by state.", "state")
+	metricJobQueue = crawlerMetrics.gauge("crawler_job_queue_length",
+		"Jobs handed to the workers but not picked up yet, per running crawl.", "crawl")
+	metricJobQueueCap = crawlerMetrics.gauge("crawler_job_queue_capacity",
+		"Size of the job channel, per running crawl.", "crawl")
+	metricSemInUse = crawlerMetrics.gauge("crawler_goroutines_in_use",
+		"Slots of the goroutine semaphore in use, per running crawl.", "crawl")
+	metricSemCap = crawlerMetrics.gauge("crawler_goroutines_max",
+		"Size of the goroutine semaphore (-max-goroutines), per running crawl.", "crawl")
+	metricFrontier = crawlerMetrics.gauge("crawler_frontier_length",
+		"Pages waiting in the frontier, per running crawl.", "crawl")
+	metricGoroutines = crawlerMetrics.gauge("go_goroutines",
+		"Number of goroutines that currently exist.")
+	metricHeap = crawlerMetrics.gauge("go_memstats_heap_alloc_bytes",
+		"Number of heap bytes allocated and still in use.")
+)
+
+// observeFetch records a fetch of the given kind that started at start and read n
+// bytes of the body of resp. A nil resp counts as a fetch error.
+func observeFetch(kind string, start time.Time, resp *http.Response, n int) {
+	metricFetchSeconds.Observe(time.Since(start).Seconds(), kind)
+	if resp == nil {
+		metricFetchErrors.Inc(kind)
+		return
+	}
+	metricResponses.Inc(kind, strconv.Itoa(resp.StatusCode))
+	metricBytes.Add(float64(n), kind)
+}
+
+// collectMetrics updates the gauges that describe the crawls and the process.
+func (m *CrawlManager) collectMetrics() {
+	metricCrawls.Reset()
+	for _, state := range []string{CrawlRunning, CrawlPaused, CrawlFinished, CrawlTimeout, CrawlCancelled} {
+		metricCrawls.Set(0, state)
+	}
+	for _, g := range []*metricVec{metricJobQueue, metricJobQueueCap, metricSemInUse, metricSemCap, metricFrontier} {
+		g.Reset()
+	}
+	for _, s := range m.List() {
+		metricCrawls.Add(1, s.State)
+		if s.State != CrawlRunning && s.State != CrawlPaused {
+			continue
+		}
+		id, d := strconv.Itoa(s.ID), s.dispatcher
+		metricJobQueue.Set(float64(len(d.jobCh)), id)
+		metricJobQueueCap.Set(float64(cap(d.jobCh)), id)
+		metricSemInUse.Set(float64(len(d.sem)), id)
+		metricSemCap.Set(float64(cap(d.sem)), id)
+		metricFrontier.Set(float64(s.Queued), id)
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	metricGoroutines.Set(float64(runtime.NumGoroutine()))
+	metricHeap.Set(float64(ms.HeapAlloc))
+}
+
+// scrapeMu keeps concurrent scrapes from resetting the gauges under each other.
+var scrapeMu sync.Mutex
+
+// serveMetrics serves the metrics of m's crawls at /metrics.
+func serveMetrics(m *CrawlManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scrapeMu.Lock()
+		defer scrapeMu.Unlock()
+		m.collectMetrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		crawlerMetrics.write(w)
+	}
+}
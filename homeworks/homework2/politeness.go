@@ -0,0 +1,346 @@
+package homework2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserAgent is sent with every request and matched against robots.txt groups.
+const UserAgent = "GoImageCrawler/1.0"
+
+const (
+	robotsTTL      = 24 * time.Hour
+	robotsErrorTTL = 5 * time.Minute // of the rules assumed when robots.txt can't be read
+	maxRobotsBytes = 512 * 1024
+)
+
+// Politeness decides whether a URL may be fetched (robots.txt) and throttles
+// requests per host (token bucket, slowed down further by Crawl-delay).
+type Politeness struct {
+	respectRobots bool
+	rate          float64 // requests per second per host
+	burst         int
+
+	fetcher *Fetcher // of robots.txt
+
+	mu      sync.Mutex
+	robots  map[string]*robotsEntry
+	buckets map[string]*tokenBucket
+}
+
+// NewPoliteness returns a Politeness that fetches robots.txt with fetcher, the one the
+// crawls use, or a Fetcher of its own if nil.
+func NewPoliteness(respectRobots bool, rate float64, burst int, fetcher *Fetcher) *Politeness {
+	if burst < 1 {
+		burst = 1
+	}
+	if fetcher == nil {
+		fetcher = NewFetcher(DefaultFetchOptions())
+	}
+	return &Politeness{
+		respectRobots: respectRobots,
+		rate:          rate,
+		burst:         burst,
+		fetcher:       fetcher,
+		robots:        make(map[string]*robotsEntry),
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+// Allowed reports whether robots.txt of u's host permits our User-Agent to fetch u.
+func (p *Politeness) Allowed(ctx context.Context, u *url.URL) bool {
+	if !p.respectRobots {
+		return true
+	}
+	return p.rulesFor(ctx, u).allowed(u.EscapedPath(), u.RawQuery)
+}
+
+// Sitemaps returns the Sitemap: URLs in robots.txt of u's host. They are read even when
+// robots.txt isn't respected.
+func (p *Politeness) Sitemaps(ctx context.Context, u *url.URL) []string {
+	return p.rulesFor(ctx, u).sitemaps
+}
+
+// Wait blocks until the host of u may be contacted again or ctx is done.
+func (p *Politeness) Wait(ctx context.Context, u *url.URL) error {
+	rate, burst := p.rate, p.burst
+	if p.respectRobots {
+		if delay := p.rulesFor(ctx, u).crawlDelay; delay > 0 {
+			if r := 1 / delay.Seconds(); rate <= 0 || r < rate {
+				rate, burst = r, 1
+			}
+		}
+	}
+	return p.waitHost(ctx, u, rate, burst)
+}
+
+// waitHost takes a token from the bucket of u's host, filled at rate.
+func (p *Politeness) waitHost(ctx context.Context, u *url.URL, rate float64, burst int) error {
+	if rate <= 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Host)
+	p.mu.Lock()
+	b, ok := p.buckets[host]
+	if !ok {
+		b = newTokenBucket(burst)
+		p.buckets[host] = b
+	}
+	p.mu.Unlock()
+	return b.wait(ctx, rate, burst)
+}
+
+// ---- robots.txt ----
+
+type robotsEntry struct {
+	once    sync.Once
+	rules   *robotsRules
+	expires time.Time // zero until rules are fetched; guarded by Politeness.mu
+}
+
+func (p *Politeness) rulesFor(ctx context.Context, u *url.URL) *robotsRules {
+	key := u.Scheme + "://" + strings.ToLower(u.Host)
+	p.mu.Lock()
+	e, ok := p.robots[key]
+	if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) {
+		e = &robotsEntry{}
+		p.robots[key] = e
+	}
+	p.mu.Unlock()
+	// concurrent workers for the same host share a single fetch, whose result is kept
+	// by every crawl, so it mustn't be cut short by the crawl that happens to start it
+	// being cancelled; the fetcher's timeout bounds it instead
+	e.once.Do(func() {
+		rules, ttl := p.fetchRobots(context.WithoutCancel(ctx), u, key+"/robots.txt")
+		p.mu.Lock()
+		e.rules, e.expires = rules, time.Now().Add(ttl)
+		p.mu.Unlock()
+	})
+	return e.rules
+}
+
+// fetchRobots downloads and parses robots.txt of u's host and says how long to keep
+// the result. A missing file (4xx) allows everything. A server or network error, once
+// the fetcher has given up retrying, disallows everything, but only for
+// robotsErrorTTL, after which robots.txt is fetched again.
+func (p *Politeness) fetchRobots(ctx context.Context, u *url.URL, robotsURL string) (*robotsRules, time.Duration) {
+	res, err := p.fetcher.Fetch(ctx, fetchRequest{
+		Kind: "robots", URL: robotsURL, MaxBytes: maxRobotsBytes, Truncate: true, UTF8: true,
+		// the host's rate without Crawl-delay, which is what is being fetched
+		Wait: func(ctx context.Context) error { return p.waitHost(ctx, u, p.rate, p.burst) },
+	})
+	var se *statusError
+	switch {
+	case errors.As(err, &se) && se.code >= 500:
+		log.Printf("robots: %s: status %d, treating host as disallowed for %v", robotsURL, se.code, robotsErrorTTL)
+		return &robotsRules{disallowAll: true}, robotsErrorTTL
+	case errors.As(err, &se):
+		// missing (4xx), or a redirect left unfollowed
+		return &robotsRules{}, robotsTTL
+	case err != nil:
+		log.Printf("robots: %s: %v, treating host as disallowed for %v", robotsURL, err, robotsErrorTTL)
+		return &robotsRules{disallowAll: true}, robotsErrorTTL
+	}
+	return parseRobots(bytes.NewReader(res.Body), UserAgent), robotsTTL
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// robotsRules is the group of robots.txt rules that applies to our User-Agent.
+type robotsRules struct {
+	disallowAll bool
+	rules       []robotsRule
+	crawlDelay  time.Duration
+	sitemaps    []string
+}
+
+// allowed applies the longest matching rule; on a tie Allow wins. No match means allowed.
+func (r *robotsRules) allowed(escapedPath, rawQuery string) bool {
+	if r.disallowAll {
+		return false
+	}
+	target := escapedPath
+	if target == "" {
+		target = "/"
+	}
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	if target == "/robots.txt" {
+		return true
+	}
+	best := -1
+	allow := true
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(target) {
+			continue
+		}
+		if n := len(rule.pattern); n > best || (n == best && rule.allow) {
+			best = n
+			allow = rule.allow
+		}
+	}
+	return allow
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// parseRobots parses robots.txt and returns the rules of the most specific group
+// matching userAgent, falling back to the "*" group.
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	var groups []*robotsGroup
+	var cur *robotsGroup
+	inAgents := false
+	sitemaps := []string{}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				cur = &robotsGroup{}
+				groups = append(groups, cur)
+				inAgents = true
+			}
+			cur.agents = append(cur.agents, strings.ToLower(val))
+		case "allow", "disallow":
+			inAgents = false
+			if cur == nil || val == "" {
+				// empty Disallow means "allow everything" - no rule needed
+				continue
+			}
+			cur.rules = append(cur.rules, robotsRule{allow: key == "allow", pattern: val, re: robotsPattern(val)})
+		case "crawl-delay":
+			inAgents = false
+			if cur == nil {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(val, 64); err == nil && secs > 0 {
+				cur.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		case "sitemap":
+			// Sitemap lines are global, not part of a group
+			if val != "" {
+				sitemaps = append(sitemaps, val)
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	// product token, e.g. "goimagecrawler" from "GoImageCrawler/1.0"; a group names
+	// us only with the whole token, so "User-agent: bot" isn't for every crawler
+	token := productToken(userAgent)
+	var best *robotsGroup
+	bestLen := -1
+	for _, g := range groups {
+		for _, a := range g.agents {
+			n := -1
+			if a == "*" {
+				n = 0
+			} else if a != "" && productToken(a) == token {
+				n = len(a)
+			}
+			if n > bestLen {
+				best, bestLen = g, n
+			}
+		}
+	}
+	out := &robotsRules{sitemaps: sitemaps}
+	if best != nil {
+		out.rules = best.rules
+		out.crawlDelay = best.crawlDelay
+	}
+	return out
+}
+
+// productToken returns the lowercased name of a User-Agent, without its version.
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(userAgent)), "/")
+	return token
+}
+
+// robotsPattern compiles a robots.txt path pattern: '*' matches any sequence and
+// a trailing '$' anchors the end of the URL.
+func robotsPattern(p string) *regexp.Regexp {
+	anchored := strings.HasSuffix(p, "$")
+	p = strings.TrimSuffix(p, "$")
+	parts := strings.Split(p, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// ---- rate limiting ----
+
+// tokenBucket is a simple token bucket. Waiters reserve a token up front (tokens may go
+// negative) so concurrent callers are served in order at the configured rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int) *tokenBucket {
+	return &tokenBucket{tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) wait(ctx context.Context, rate float64, burst int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package homework2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name    string
+		robots  string
+		path    string
+		allowed bool
+	}{
+		{"empty", "", "/a", true},
+		{"star group", "User-agent: *\nDisallow: /private", "/private/x", false},
+		{"star group other path", "User-agent: *\nDisallow: /private", "/public", true},
+		{"our group wins", "User-agent: *\nDisallow: /\n\nUser-agent: GoImageCrawler\nAllow: /", "/a", true},
+		{"our group with version", "User-agent: *\nAllow: /\n\nUser-agent: goimagecrawler/2.0\nDisallow: /", "/a", false},
+		{"substring agent", "User-agent: *\nAllow: /\n\nUser-agent: go\nDisallow: /", "/a", true},
+		{"other bot", "User-agent: *\nAllow: /\n\nUser-agent: bot\nDisallow: /", "/a", true},
+		{"longer agent", "User-agent: *\nAllow: /\n\nUser-agent: GoImageCrawlerPro\nDisallow: /", "/a", true},
+		{"longest rule wins", "User-agent: *\nDisallow: /a\nAllow: /a/b", "/a/b/c", true},
+		{"tie goes to allow", "User-agent: *\nDisallow: /a\nAllow: /a", "/a", true},
+		{"wildcard", "User-agent: *\nDisallow: /*.gif$", "/x/y.gif", false},
+		{"anchored", "User-agent: *\nDisallow: /*.gif$", "/x/y.gif?z", true},
+		{"robots.txt itself", "User-agent: *\nDisallow: /", "/robots.txt", true},
+		{"garbage", "\x00\xff::\n:Disallow\nUser-agent\nDisallow: /", "/a", true},
+		{"comments", "User-agent: * # all\nDisallow: /a # not a\n", "/a", false},
+	}
+	for _, tt := range tests {
+		r := parseRobots(strings.NewReader(tt.robots), UserAgent)
+		if got := r.allowed(tt.path, ""); got != tt.allowed {
+			t.Errorf("%s: allowed(%q) = %v, want %v", tt.name, tt.path, got, tt.allowed)
+		}
+	}
+}
+
+func TestParseRobotsLongLine(t *testing.T) {
+	// a line over bufio.Scanner's limit stops parsing; what was read so far applies
+	r := parseRobots(strings.NewReader("User-agent: *\nDisallow: /a\n"+strings.Repeat("x", 1<<20)), UserAgent)
+	if r.allowed("/a", "") {
+		t.Error("rules before a long line were lost")
+	}
+}
+
+// robotsServer serves robots.txt after failing the first failures requests with a
+// 503, and counts the requests in calls.
+func robotsServer(failures int32, calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	}))
+}
+
+func testFetcher() *Fetcher {
+	opts := DefaultFetchOptions()
+	opts.Retries, opts.Backoff = 2, time.Millisecond
+	return NewFetcher(opts)
+}
+
+func TestRobotsRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := robotsServer(1, &calls)
+	defer srv.Close()
+	p := NewPoliteness(true, 1000, 1, testFetcher())
+	u, _ := url.Parse(srv.URL + "/private")
+	if p.Allowed(context.Background(), u) {
+		t.Fatal("robots.txt ignored after a retry")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("robots.txt fetched %d times, want 2", n)
+	}
+}
+
+func TestRobotsErrorTTL(t *testing.T) {
+	var calls atomic.Int32
+	srv := robotsServer(3, &calls) // the first attempt and both retries
+	defer srv.Close()
+	p := NewPoliteness(true, 0, 1, testFetcher())
+	u, _ := url.Parse(srv.URL + "/a")
+	if p.Allowed(context.Background(), u) {
+		t.Fatal("allowed while robots.txt failed")
+	}
+	// pretend robotsErrorTTL has passed
+	for _, e := range p.robots {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	if !p.Allowed(context.Background(), u) {
+		t.Fatal("still disallowed after robotsErrorTTL")
+	}
+	u.Path = "/private"
+	if p.Allowed(context.Background(), u) {
+		t.Fatal("robots.txt ignored after it was fetched again")
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("robots.txt fetched %d times, want 4", n)
+	}
+}
@@ -0,0 +1,245 @@
+package homework2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Priority scheduling: the frontier hands out the queued page with the highest score
+// instead of the oldest one, so the image-rich parts of a site are crawled first
+// within the time budget. A page's score adds up
+//
+//	Depth   * link depth
+//	InLinks * log2(1 + links to the page seen so far)
+//	Images  * log2(1 + images on the page that linked to it)
+//	LastMod * 2^(-age in days / 30), for pages a sitemap or feed dates
+//	the points of every URL pattern the page matches
+//
+// and when choosing between hosts Host * pages already taken from the host is added,
+// so one big site doesn't starve the others. Equal scores keep discovery order. The age
+// is taken when the page is queued or linked again, so scores don't drift while queued.
+
+// lastModHalfLife is the age at which a page's LastMod points are halved.
+const lastModHalfLife = 30 * 24 * time.Hour
+
+// ScoringRules are the weights of the page score. The zero value scores every page
+// the same, i.e. breadth-first.
+type ScoringRules struct {
+	Depth    float64
+	InLinks  float64
+	Images   float64
+	LastMod  float64
+	Host     float64
+	Patterns []ScorePattern
+}
+
+// ScorePattern adds Points (negative for exclude rules) to the pages whose URL
+// matches Regexp.
+type ScorePattern struct {
+	Regexp *regexp.Regexp
+	Points float64
+}
+
+// Default points of include and exclude lines without a number.
+const (
+	defaultIncludePoints = 5
+	defaultExcludePoints = 5
+)
+
+func DefaultScoringRules() *ScoringRules {
+	return &ScoringRules{Depth: -1, InLinks: 1, Images: 1, LastMod: 2, Host: -0.1}
+}
+
+// score is the priority of job while inLinks pages link to it.
+func (r *ScoringRules) score(job Job, inLinks int) float64 {
+	s := r.Depth*float64(job.Depth) +
+		r.InLinks*math.Log2(1+float64(inLinks)) +
+		r.Images*math.Log2(1+float64(job.Images))
+	if !job.LastMod.IsZero() {
+		age := max(time.Since(job.LastMod), 0)
+		s += r.LastMod * math.Exp2(-float64(age)/float64(lastModHalfLife))
+	}
+	for _, p := range r.Patterns {
+		if p.Regexp.MatchString(job.URL) {
+			s += p.Points
+		}
+	}
+	return s
+}
+
+// LoadScoringRules reads a rules file (-priority-rules). Each line is a weight or a
+// URL pattern, # starts a comment:
+//
+//	depth   -1            # per level of link depth
+//	inlinks  1            # per doubling of the links to a page
+//	images   1            # per doubling of the images on the linking page
+//	lastmod  2            # for a page modified just now, halved every 30 days of age
+//	host    -0.1          # per page already taken from the same host
+//	include /gallery/  10 # URLs matching the regexp get 10 points (default 5)
+//	exclude /tag/|/page/  # URLs matching lose 5 points (or the given number)
+//
+// Weights not set keep their DefaultScoringRules value.
+func LoadScoringRules(path string) (*ScoringRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := parseScoringRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+func parseScoringRules(in io.Reader) (*ScoringRules, error) {
+	r := DefaultScoringRules()
+	weights := map[string]*float64{"depth": &r.Depth, "inlinks": &r.InLinks, "images": &r.Images, "lastmod": &r.LastMod, "host": &r.Host}
+	sc := bufio.NewScanner(in)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		number := func(s string) (float64, error) {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return 0, fmt.Errorf("line %d: %q is not a number", n, s)
+			}
+			return v, nil
+		}
+		key := strings.ToLower(fields[0])
+		if w, ok := weights[key]; ok {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: want %s WEIGHT", n, key)
+			}
+			v, err := number(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			*w = v
+			continue
+		}
+		switch key {
+		case "include", "exclude":
+			if len(fields) < 2 || len(fields) > 3 {
+				return nil, fmt.Errorf("line %d: want %s REGEXP [POINTS]", n, key)
+			}
+			re, err := regexp.Compile(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			points := float64(defaultIncludePoints)
+			if key == "exclude" {
+				points = defaultExcludePoints
+			}
+			if len(fields) == 3 {
+				if points, err = number(fields[2]); err != nil {
+					return nil, err
+				}
+			}
+			if key == "exclude" {
+				points = -math.Abs(points)
+			}
+			r.Patterns = append(r.Patterns, ScorePattern{Regexp: re, Points: points})
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q (want depth, inlinks, images, lastmod, host, include or exclude)", n, fields[0])
+		}
+	}
+	return r, sc.Err()
+}
+
+// queuedJob is a job waiting in the frontier.
+type queuedJob struct {
+	Job
+	inLinks int
+	score   float64
+	seq     int64 // discovery order, breaks ties
+	index   int   // in its host's heap
+}
+
+func (a *queuedJob) before(b *queuedJob) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	return a.seq < b.seq
+}
+
+// hostQueue is the queue of one host: a max-heap by score.
+type hostQueue struct {
+	jobs   jobHeap
+	served int // jobs taken from it so far
+	index  int // in Frontier.active, -1 while jobs is empty
+}
+
+// hostHeap implements container/heap.Interface over the hosts with queued jobs, best
+// first: by the score of their best job less weight for each job already served.
+type hostHeap struct {
+	queues []*hostQueue
+	weight float64 // ScoringRules.Host
+}
+
+func (h *hostHeap) score(q *hostQueue) float64 {
+	return q.jobs[0].score + h.weight*float64(q.served)
+}
+
+func (h *hostHeap) Len() int { return len(h.queues) }
+func (h *hostHeap) Less(i, j int) bool {
+	a, b := h.queues[i], h.queues[j]
+	if sa, sb := h.score(a), h.score(b); sa != sb {
+		return sa > sb
+	}
+	return a.jobs[0].seq < b.jobs[0].seq
+}
+func (h *hostHeap) Swap(i, j int) {
+	h.queues[i], h.queues[j] = h.queues[j], h.queues[i]
+	h.queues[i].index, h.queues[j].index = i, j
+}
+
+func (h *hostHeap) Push(x any) {
+	q := x.(*hostQueue)
+	q.index = len(h.queues)
+	h.queues = append(h.queues, q)
+}
+
+func (h *hostHeap) Pop() any {
+	old := h.queues
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.queues = old[:len(old)-1]
+	q.index = -1
+	return q
+}
+
+// jobHeap implements container/heap.Interface.
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *jobHeap) Push(x any) {
+	q := x.(*queuedJob)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	q.index = -1
+	return q
+}
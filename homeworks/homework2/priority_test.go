@@ -0,0 +1,103 @@
+package homework2
+
+import (
+	"container/heap"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScoringRules(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"", false},
+		{"depth -2\ninlinks 0.5 # comment\ninclude /gallery/ 10\nexclude /tag/", false},
+		{"depth", true},
+		{"depth x", true},
+		{"depth NaN", true},
+		{"host +Inf", true},
+		{"include (", true},
+		{"include /a/ 1 2", true},
+		{"frobnicate 1", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseScoringRules(strings.NewReader(tt.in)); (err != nil) != tt.wantErr {
+			t.Errorf("parseScoringRules(%q): err = %v, want error %v", tt.in, err, tt.wantErr)
+		}
+	}
+	r, _ := parseScoringRules(strings.NewReader("depth -2\nexclude /tag/ 3\ninclude /gallery/"))
+	job := Job{URL: "http://a.com/gallery/tag/x", Depth: 1}
+	// -2 + log2(2) - 3 + 5 + log2(1)
+	if s := r.score(job, 1); s != 1 {
+		t.Errorf("score = %v, want 1", s)
+	}
+}
+
+func TestScoringRulesScore(t *testing.T) {
+	r := DefaultScoringRules()
+	r.Patterns = []ScorePattern{{Regexp: regexp.MustCompile("/gallery/"), Points: 5}}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		job     Job
+		inLinks int
+		want    float64
+	}{
+		{"start page", Job{URL: "http://a.com/"}, 0, 0},
+		{"deeper", Job{URL: "http://a.com/x", Depth: 3}, 0, -3},
+		{"linked three times", Job{URL: "http://a.com/x", Depth: 1}, 3, 1},
+		{"from a page with 7 images", Job{URL: "http://a.com/x", Depth: 1, Images: 7}, 1, 3},
+		{"gallery", Job{URL: "http://a.com/gallery/1", Depth: 1}, 1, 5},
+		{"modified now", Job{URL: "http://a.com/x", LastMod: now}, 0, 2},
+		{"modified a half-life ago", Job{URL: "http://a.com/x", LastMod: now.Add(-lastModHalfLife)}, 0, 1},
+		{"modified in the future", Job{URL: "http://a.com/x", LastMod: now.Add(time.Hour)}, 0, 2},
+	}
+	for _, tt := range tests {
+		if got := r.score(tt.job, tt.inLinks); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("%s: score = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if s := (&ScoringRules{}).score(Job{URL: "http://a.com/gallery/", Depth: 5, Images: 100, LastMod: now}, 10); s != 0 {
+		t.Errorf("zero rules score = %v, want 0", s)
+	}
+}
+
+func TestHostHeap(t *testing.T) {
+	host := func(score float64, seq int64, served int) *hostQueue {
+		return &hostQueue{jobs: jobHeap{{score: score, seq: seq}}, served: served}
+	}
+	tests := []struct {
+		name   string
+		weight float64
+		queues []*hostQueue
+		want   int // index of the best queue
+	}{
+		{"best job", 0, []*hostQueue{host(1, 1, 0), host(3, 2, 0), host(2, 3, 0)}, 1},
+		{"tie by discovery", 0, []*hostQueue{host(1, 5, 0), host(1, 2, 0), host(1, 9, 0)}, 1},
+		// 3 - 0.1*30 < 1 - 0.1*0
+		{"busy host loses", -0.1, []*hostQueue{host(3, 1, 30), host(1, 2, 0)}, 1},
+		{"served ignored without weight", 0, []*hostQueue{host(3, 1, 30), host(1, 2, 0)}, 0},
+	}
+	for _, tt := range tests {
+		h := &hostHeap{weight: tt.weight}
+		for _, q := range tt.queues {
+			heap.Push(h, q)
+		}
+		if h.queues[0] != tt.queues[tt.want] {
+			t.Errorf("%s: best host has score %v, want %v", tt.name, h.score(h.queues[0]), h.score(tt.queues[tt.want]))
+		}
+		for i, q := range h.queues {
+			if q.index != i {
+				t.Errorf("%s: queue at %d has index %d", tt.name, i, q.index)
+			}
+		}
+		q := heap.Pop(h).(*hostQueue)
+		if q.index != -1 {
+			t.Errorf("%s: popped queue has index %d", tt.name, q.index)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package homework2
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Incremental re-crawls: the store keeps the ETag, Last-Modified and SHA-256 of every
+// page (PageMeta) and image (ImageMeta) it has seen. Crawling them again sends
+// If-None-Match / If-Modified-Since; a page that answers 304 or hashes the same is not
+// parsed again, its stored links are followed and the images it had are revalidated.
+// An image that hasn't changed only gets its row touched, a changed one has its row
+// replaced, and the images a changed page no longer has are marked stale.
+
+// maxImagesPerPage bounds the stored images read back for one page.
+const maxImagesPerPage = 5000
+
+// conditional makes req conditional on the validators of an earlier response.
+func conditional(req *http.Request, etag, lastModified string) {
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// validators returns the ETag and Last-Modified headers of a response.
+func validators(h http.Header) (etag, lastModified string) {
+	return h.Get("ETag"), h.Get("Last-Modified")
+}
+
+// previousPage returns what the last crawl recorded about pageURL, if anything.
+func (d *Dispatcher) previousPage(ctx context.Context, pageURL string) (PageMeta, bool) {
+	p, err := d.store.GetPage(ctx, pageURL)
+	if err != nil {
+		if !errors.Is(err, ErrPageNotFound) && ctx.Err() == nil {
+			log.Printf("recrawl: %s: %v", pageURL, err)
+		}
+		return PageMeta{}, false
+	}
+	return p, true
+}
+
+// unchanged reports whether fp is the version of the page prev describes.
+func (fp fetchedPage) unchanged(prev PageMeta) bool {
+	return fp.NotModified || (prev.SHA256 != "" && fp.SHA256 == prev.SHA256)
+}
+
+// revalidationResult labels a revalidation that found nothing new.
+func revalidationResult(notModified bool) string {
+	if notModified {
+		return "not_modified"
+	}
+	return "unchanged"
+}
+
+// savePage records the version of a page a crawl has just processed.
+func (d *Dispatcher) savePage(ctx context.Context, p PageMeta) {
+	if ctx.Err() != nil {
+		// interrupted before all its images were seen; crawl it in full next time
+		return
+	}
+	if err := d.store.PutPage(ctx, p); err != nil {
+		log.Printf("recrawl: save %s: %v", p.URL, err)
+	}
+}
+
+// revisit handles a page that hasn't changed since prev was recorded: its links and
+// feeds are followed again and the images found on it last time are revalidated.
+func (d *Dispatcher) revisit(ctx context.Context, id int, job Job, prev PageMeta, fp fetchedPage) {
+	base, err := url.Parse(prev.Base)
+	if err != nil || base.Host == "" {
+		base = fp.Base
+	}
+	imgs := d.pageImages(ctx, base.String())
+	d.follow(ctx, job, base, prev.Links, prev.Feeds, len(imgs))
+	for _, im := range imgs {
+		if !im.StaleSince.IsZero() {
+			continue
+		}
+		d.handleImage(ctx, id, storedRef(im), base, &im)
+	}
+	if fp.ETag != "" {
+		prev.ETag = fp.ETag
+	}
+	if fp.LastModified != "" {
+		prev.LastModified = fp.LastModified
+	}
+	prev.CheckedAt = time.Now()
+	d.savePage(ctx, prev)
+}
+
+// pageImages returns the stored images of pageURL, stale ones included, the newest
+// record of each image URL only.
+func (d *Dispatcher) pageImages(ctx context.Context, pageURL string) []ImageMeta {
+	imgs, err := d.store.Search(ctx, ImageFilter{PageURL: pageURL, Sort: SortNewest, Limit: maxImagesPerPage})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("recrawl: images of %s: %v", pageURL, err)
+		}
+		return nil
+	}
+	seen := make(map[string]bool, len(imgs))
+	out := imgs[:0]
+	for _, im := range imgs {
+		if !seen[im.URL] {
+			seen[im.URL] = true
+			out = append(out, im)
+		}
+	}
+	return out
+}
+
+// storedRef is the reference im was saved from, to revalidate it with.
+func storedRef(im ImageMeta) ImageRef {
+	return ImageRef{
+		Src: im.URL, Alt: im.Alt, Title: im.Title, Source: im.Source, Alternates: im.Alternates,
+		PageURL: im.PageURL, PageTitle: im.PageTitle, Caption: im.Caption, Context: im.Context,
+	}
+}
+
+// touch records that prev, unchanged, is still on its page, where it was found as
+// ref this time. etag and lastModified replace its validators unless empty.
+func (d *Dispatcher) touch(ctx context.Context, prev ImageMeta, ref ImageRef, etag, lastModified string) error {
+	im := prev
+	im.Alt, im.Title, im.Source, im.Alternates = ref.Alt, ref.Title, ref.Source, ref.Alternates
+	im.PageTitle, im.Caption, im.Context = ref.PageTitle, ref.Caption, ref.Context
+	if etag != "" {
+		im.ETag = etag
+	}
+	if lastModified != "" {
+		im.LastModified = lastModified
+	}
+	im.CheckedAt = time.Now()
+	im.StaleSince = time.Time{}
+	return d.store.Update(ctx, &im)
+}
+
+// markStale marks the stored images of a changed page that weren't found on it.
+func (d *Dispatcher) markStale(ctx context.Context, known []ImageMeta, found map[string]bool) {
+	if ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	for _, im := range known {
+		if found[im.URL] || !im.StaleSince.IsZero() {
+			continue
+		}
+		im.StaleSince = now
+		if err := d.store.Update(ctx, &im); err != nil {
+			log.Printf("recrawl: mark %s stale: %v", im.URL, err)
+			continue
+		}
+		metricStaleImages.Inc()
+		d.publish(Event{Type: EventImageStale, URL: im.URL, Image: &im})
+	}
+}
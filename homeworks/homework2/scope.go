@@ -0,0 +1,338 @@
+package homework2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Crawl scope: besides -follow-external, a rules file (-crawl-rules) decides which links
+// are queued and which images are downloaded, and ImageLimits decide which downloaded
+// images are kept, so tracking pixels, 1x1 spacers and error pages served in place of
+// an image don't end up in the index.
+
+// CrawlRules are the allow and deny rules of a rules file. A nil *CrawlRules allows
+// everything.
+type CrawlRules struct {
+	all   []scopeRule // before the first host line
+	hosts []*hostRules
+}
+
+// hostRules are the rules of a host section.
+type hostRules struct {
+	names []string // each matches the host and its subdomains
+	rules []scopeRule
+}
+
+// scopeRule allows or denies the URLs whose path matches a glob, or whose whole URL
+// matches a regular expression.
+type scopeRule struct {
+	allow         bool
+	pages, images bool // what it applies to
+	re            *regexp.Regexp
+	path          bool // re is matched against the path instead of the URL
+}
+
+// LoadCrawlRules reads a rules file (-crawl-rules). Each line is a rule or starts a
+// host section, # starts a comment:
+//
+//	deny re:[?&](replytocom|share)=  # regexp against the whole URL
+//	images deny /**/pixel.gif        # glob against the path, for images only
+//	host example.com                 # rules for example.com and its subdomains
+//	pages allow /gallery/**          # crawl only the galleries there
+//	host *                           # back to the rules for all hosts
+//
+// In globs ** matches anything, * and ? any run of characters and any one character
+// within a path segment, and a trailing /** also matches the directory itself. Rules
+// starting with pages or images apply to pages (links) or images only.
+//
+// A URL is checked against the sections of its host, in file order, and then the
+// rules for all hosts; the first matching rule decides. When none matches, the URL is
+// denied if any of those rules was an allow rule, so allow rules alone scope a crawl,
+// and allowed otherwise. Start URLs are checked too.
+func LoadCrawlRules(path string) (*CrawlRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := parseCrawlRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+func parseCrawlRules(in io.Reader) (*CrawlRules, error) {
+	r := &CrawlRules{}
+	cur := &r.all
+	sc := bufio.NewScanner(in)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		if key == "host" {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: want host NAME...", n)
+			}
+			if len(fields) == 2 && fields[1] == "*" {
+				cur = &r.all
+				continue
+			}
+			h := &hostRules{}
+			for _, name := range fields[1:] {
+				h.names = append(h.names, strings.TrimPrefix(strings.ToLower(name), "."))
+			}
+			r.hosts = append(r.hosts, h)
+			cur = &h.rules
+			continue
+		}
+		rule := scopeRule{pages: true, images: true}
+		switch key {
+		case "pages":
+			rule.images = false
+			fields = fields[1:]
+		case "images":
+			rule.pages = false
+			fields = fields[1:]
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want [pages|images] allow|deny PATTERN", n)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q (want host, pages, images, allow or deny)", n, fields[0])
+		}
+		pattern := fields[1]
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			rule.re = re
+		} else if strings.HasPrefix(pattern, "/") {
+			rule.re, rule.path = globPattern(pattern), true
+		} else {
+			return nil, fmt.Errorf("line %d: %q is neither a path glob (starting with /) nor re:REGEXP", n, pattern)
+		}
+		*cur = append(*cur, rule)
+	}
+	return r, sc.Err()
+}
+
+// globPattern compiles a path glob, see LoadCrawlRules.
+func globPattern(g string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(g); i++ {
+		switch {
+		case g[i:] == "/**":
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(g[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case g[i] == '*':
+			b.WriteString("[^/]*")
+		case g[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(g[i : i+1]))
+		}
+	}
+	b.WriteByte('$')
+	return regexp.MustCompile(b.String())
+}
+
+func (h *hostRules) matches(host string) bool {
+	for _, name := range h.names {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the rules let the crawl fetch rawURL, an image or a page.
+func (r *CrawlRules) allowed(rawURL string, image bool) bool {
+	if r == nil {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	host := strings.ToLower(u.Hostname())
+	var rules []scopeRule
+	for _, h := range r.hosts {
+		if h.matches(host) {
+			rules = append(rules, h.rules...)
+		}
+	}
+	rules = append(rules, r.all...)
+	hadAllow := false
+	for _, rule := range rules {
+		if (image && !rule.images) || (!image && !rule.pages) {
+			continue
+		}
+		target := rawURL
+		if rule.path {
+			target = p
+		}
+		if rule.re.MatchString(target) {
+			return rule.allow
+		}
+		hadAllow = hadAllow || rule.allow
+	}
+	return !hadAllow
+}
+
+// ImageLimits decide which downloaded images are kept. Zero values mean no limit.
+type ImageLimits struct {
+	MinBytes  int64
+	MaxBytes  int64 // larger images aren't downloaded past this
+	MinWidth  int
+	MinHeight int
+	Types     []string // allowed MIME types, patterns like image/*; empty = any
+}
+
+// DefaultImageLimits, the defaults of the image limit flags, drop 1x1 images and
+// anything that isn't an image.
+func DefaultImageLimits() ImageLimits {
+	return ImageLimits{MinWidth: 2, MinHeight: 2, Types: []string{"image/*"}}
+}
+
+// Reasons an image is skipped, named after the flag that sets the limit, except
+// skipUnreadable for an image whose decoder panicked.
+const (
+	skipCrawlRules = "crawl-rules"
+	skipMinBytes   = "min-image-bytes"
+	skipMaxBytes   = "max-image-bytes"
+	skipType       = "image-types"
+	skipMinSize    = "min-image-size"
+	skipUnreadable = "unreadable"
+)
+
+// skippedError is returned for an image that was left out by the crawl scope.
+type skippedError struct {
+	reason string // one of the skip constants
+	detail string
+}
+
+func (e *skippedError) Error() string {
+	if e.reason == skipUnreadable {
+		return "skipped as unreadable: " + e.detail
+	}
+	return fmt.Sprintf("skipped by -%s: %s", e.reason, e.detail)
+}
+
+// checkBytes checks the size of an image body, n < 0 if it isn't known yet.
+func (l ImageLimits) checkBytes(n int64) error {
+	switch {
+	case n < 0:
+	case l.MaxBytes > 0 && n > l.MaxBytes:
+		return &skippedError{skipMaxBytes, fmt.Sprintf("more than %d bytes", l.MaxBytes)}
+	case n < l.MinBytes:
+		return &skippedError{skipMinBytes, fmt.Sprintf("%d bytes", n)}
+	}
+	return nil
+}
+
+// checkType checks the MIME type of an image body.
+func (l ImageLimits) checkType(mimeType string) error {
+	if len(l.Types) == 0 {
+		return nil
+	}
+	for _, t := range l.Types {
+		if ok, _ := path.Match(t, mimeType); ok {
+			return nil
+		}
+	}
+	if mimeType == "" {
+		mimeType = "unknown type"
+	}
+	return &skippedError{skipType, mimeType}
+}
+
+// checkSize checks the dimensions of a decoded image; unknown (zero) ones pass.
+func (l ImageLimits) checkSize(width, height int) error {
+	if width == 0 || height == 0 {
+		return nil
+	}
+	if width < l.MinWidth || height < l.MinHeight {
+		return &skippedError{skipMinSize, fmt.Sprintf("%dx%d", width, height)}
+	}
+	return nil
+}
+
+// imageMIME is the media type of an image body: the image type its bytes look like,
+// since servers often send images as application/octet-stream, else the Content-Type
+// header.
+func imageMIME(contentType string, b []byte) string {
+	sniffed := http.DetectContentType(b)
+	if isSVG(b) {
+		sniffed = "image/svg+xml"
+	}
+	if strings.HasPrefix(sniffed, "image/") {
+		return sniffed
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	mt, _, _ := mime.ParseMediaType(sniffed)
+	return mt
+}
+
+// parseImageSize parses -min-image-size, WIDTHxHEIGHT or a single number for both.
+func parseImageSize(s string) (width, height int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		hs = ws
+	}
+	width, err = strconv.Atoi(ws)
+	if err == nil {
+		height, err = strconv.Atoi(hs)
+	}
+	if err != nil || width < 0 || height < 0 {
+		return 0, 0, fmt.Errorf("%q is not WIDTHxHEIGHT", s)
+	}
+	return width, height, nil
+}
+
+// parseMIMETypes parses -image-types, a comma separated list of MIME type patterns.
+func parseMIMETypes(s string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if _, err := path.Match(t, ""); err != nil || !strings.Contains(t, "/") {
+			return nil, fmt.Errorf("%q is not a MIME type like image/png or image/*", t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
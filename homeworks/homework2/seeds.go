@@ -0,0 +1,333 @@
+package homework2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Seeding from sitemaps and feeds. Start URLs that are sitemaps or feeds are read
+// instead of crawled; with Sitemaps the start URLs' hosts are asked for their sitemaps
+// (robots.txt Sitemap: lines, else /sitemap.xml), and with Feeds the RSS and Atom feeds
+// that pages link to are read. The pages they list are queued most recently modified
+// first.
+
+const (
+	maxSeedDocBytes = 50 << 20 // uncompressed size limit of the sitemap protocol
+	maxSeedDocs     = 100      // sitemaps and feeds read per crawl, indexes included
+	maxSeedPages    = 100000   // pages taken from one crawl's sitemaps
+	maxFeedsPerPage = 2
+)
+
+// seedEntry is a page listed in a sitemap or feed, or a sitemap listed in an index.
+type seedEntry struct {
+	URL     string
+	LastMod time.Time // zero if not given
+}
+
+// seedDocument is a parsed sitemap, sitemap index or feed.
+type seedDocument struct {
+	Pages    []seedEntry
+	Sitemaps []seedEntry // of a sitemap index
+}
+
+// Seed queues the start URLs of a crawl and the pages of their sitemaps.
+func (d *Dispatcher) Seed(ctx context.Context, startURLs []string) {
+	var docs, origins []string
+	seenOrigin := map[string]bool{}
+	for _, raw := range startURLs {
+		u := jobURL(raw)
+		if u == "" {
+			continue
+		}
+		if isSeedDocumentURL(u) {
+			docs = append(docs, u)
+		} else {
+			d.Add(Job{URL: u, Depth: 0})
+		}
+		if p, err := url.Parse(u); err == nil && d.sitemaps {
+			if o := p.Scheme + "://" + p.Host; !seenOrigin[o] {
+				seenOrigin[o] = true
+				origins = append(origins, o)
+			}
+		}
+	}
+	for _, o := range origins {
+		docs = append(docs, d.hostSitemaps(ctx, o)...)
+	}
+	for _, e := range d.readSeedDocuments(ctx, docs) {
+		d.Add(Job{URL: e.URL, Depth: 0, LastMod: e.LastMod})
+	}
+}
+
+// seedFromFeeds queues the items of the feeds linked from a page at depth.
+func (d *Dispatcher) seedFromFeeds(ctx context.Context, feeds []string, depth int) {
+	if len(feeds) > maxFeedsPerPage {
+		feeds = feeds[:maxFeedsPerPage]
+	}
+	for _, e := range d.readSeedDocuments(ctx, feeds) {
+		d.Add(Job{URL: e.URL, Depth: depth, LastMod: e.LastMod})
+	}
+}
+
+// isSeedDocumentURL tells sitemaps and feeds given as start URLs from pages, by path.
+func isSeedDocumentURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	p := strings.ToLower(strings.TrimSuffix(u.Path, "/"))
+	switch path.Base(p) {
+	case "feed", "rss", "atom":
+		return true
+	}
+	for _, ext := range []string{".xml", ".xml.gz", ".rss", ".atom"} {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostSitemaps returns the sitemaps robots.txt of origin lists, or its /sitemap.xml.
+func (d *Dispatcher) hostSitemaps(ctx context.Context, origin string) []string {
+	if d.polite != nil {
+		u, _ := url.Parse(origin)
+		if s := d.polite.Sitemaps(ctx, u); len(s) > 0 {
+			return s
+		}
+	}
+	return []string{origin + "/sitemap.xml"}
+}
+
+// readSeedDocuments reads the sitemaps and feeds docs, following sitemap indexes, and
+// returns up to maxSeedPages of the pages they list, newest first. Every document is
+// read only once per crawl.
+func (d *Dispatcher) readSeedDocuments(ctx context.Context, docs []string) []seedEntry {
+	var pages []seedEntry
+	seen := map[string]bool{}
+	for len(docs) > 0 && len(pages) < maxSeedPages && ctx.Err() == nil {
+		docURL := docs[0]
+		docs = docs[1:]
+		if !d.claimSeedDoc(docURL) {
+			continue
+		}
+		if err := d.beforeFetch(ctx, docURL); err != nil {
+			continue
+		}
+		doc, err := d.fetchSeedDocument(ctx, docURL)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("seeds: %s: %v", docURL, err)
+			}
+			continue
+		}
+		base, _ := url.Parse(docURL)
+		for _, s := range doc.Sitemaps {
+			if u := sanitizeURL(s.URL, base); u != "" && (d.followExternal || sameSite(base, u)) {
+				docs = append(docs, u)
+			}
+		}
+		for _, p := range doc.Pages {
+			u := sanitizeURL(p.URL, base)
+			if u == "" || seen[u] || (!d.followExternal && !sameSite(base, u)) {
+				continue
+			}
+			seen[u] = true
+			pages = append(pages, seedEntry{URL: u, LastMod: p.LastMod})
+		}
+		log.Printf("seeds: %s: %d pages, %d sitemaps", docURL, len(doc.Pages), len(doc.Sitemaps))
+	}
+	if len(pages) > maxSeedPages {
+		pages = pages[:maxSeedPages]
+	}
+	// pages without a date go last, the rest keep their order among equals
+	sort.SliceStable(pages, func(i, j int) bool { return pages[i].LastMod.After(pages[j].LastMod) })
+	return pages
+}
+
+// claimSeedDoc reports whether docURL hasn't been read by this crawl yet, and marks
+// it read.
+func (d *Dispatcher) claimSeedDoc(docURL string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seedDocs[docURL] || len(d.seedDocs) >= maxSeedDocs {
+		return false
+	}
+	d.seedDocs[docURL] = true
+	return true
+}
+
+// fetchSeedDocument downloads and parses a sitemap or feed, gzipped or not.
+func (d *Dispatcher) fetchSeedDocument(ctx context.Context, docURL string) (seedDocument, error) {
+	res, err := d.fetch(ctx, fetchRequest{Kind: "sitemap", URL: docURL, MaxBytes: maxSeedDocBytes})
+	if err != nil {
+		return seedDocument{}, err
+	}
+	b := res.Body
+	// sitemap.xml.gz files, as opposed to Content-Encoding which the fetcher undoes
+	if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return seedDocument{}, err
+		}
+		if b, err = io.ReadAll(io.LimitReader(zr, maxSeedDocBytes+1)); err != nil {
+			return seedDocument{}, err
+		}
+	}
+	if len(b) > maxSeedDocBytes {
+		return seedDocument{}, fmt.Errorf("larger than %d MB", maxSeedDocBytes>>20)
+	}
+	return parseSeedDocument(bytes.NewReader(b))
+}
+
+type sitemapLoc struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+type rssItem struct {
+	Link    string `xml:"link"`
+	GUID    string `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+	Date    string `xml:"date"` // dc:date of RSS 1.0
+}
+
+type atomEntry struct {
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+}
+
+// parseSeedDocument parses a sitemap (<urlset>), sitemap index (<sitemapindex>), RSS
+// 2.0 (<rss>), RSS 1.0 (<rdf:RDF>) or Atom (<feed>) document.
+func parseSeedDocument(r io.Reader) (seedDocument, error) {
+	var doc seedDocument
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return doc, errors.New("empty document")
+		}
+		if err != nil {
+			return doc, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "urlset":
+			var v struct {
+				URLs []sitemapLoc `xml:"url"`
+			}
+			err = dec.DecodeElement(&v, &start)
+			for _, u := range v.URLs {
+				doc.Pages = append(doc.Pages, seedEntry{URL: strings.TrimSpace(u.Loc), LastMod: parseSeedTime(u.LastMod)})
+			}
+		case "sitemapindex":
+			var v struct {
+				Sitemaps []sitemapLoc `xml:"sitemap"`
+			}
+			err = dec.DecodeElement(&v, &start)
+			for _, s := range v.Sitemaps {
+				doc.Sitemaps = append(doc.Sitemaps, seedEntry{URL: strings.TrimSpace(s.Loc), LastMod: parseSeedTime(s.LastMod)})
+			}
+		case "rss", "RDF":
+			var v struct {
+				Items    []rssItem `xml:"channel>item"` // RSS 2.0
+				RDFItems []rssItem `xml:"item"`         // RSS 1.0
+			}
+			err = dec.DecodeElement(&v, &start)
+			for _, it := range append(v.Items, v.RDFItems...) {
+				link := strings.TrimSpace(it.Link)
+				if link == "" && strings.HasPrefix(strings.TrimSpace(it.GUID), "http") {
+					link = strings.TrimSpace(it.GUID)
+				}
+				date := it.PubDate
+				if date == "" {
+					date = it.Date
+				}
+				doc.Pages = append(doc.Pages, seedEntry{URL: link, LastMod: parseSeedTime(date)})
+			}
+		case "feed":
+			var v struct {
+				Entries []atomEntry `xml:"entry"`
+			}
+			err = dec.DecodeElement(&v, &start)
+			for _, e := range v.Entries {
+				link := ""
+				for _, l := range e.Links {
+					if l.Rel == "" || l.Rel == "alternate" {
+						link = l.Href
+						break
+					}
+				}
+				date := e.Updated
+				if date == "" {
+					date = e.Published
+				}
+				doc.Pages = append(doc.Pages, seedEntry{URL: strings.TrimSpace(link), LastMod: parseSeedTime(date)})
+			}
+		default:
+			return doc, fmt.Errorf("<%s> is not a sitemap or feed", start.Name.Local)
+		}
+		return doc, err
+	}
+}
+
+// seedTimeLayouts are the W3C datetime of sitemaps and Atom, and the RFC 822 dates of
+// RSS with their common variations.
+var seedTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func parseSeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range seedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// isFeedType reports whether a <link rel="alternate"> type is an RSS or Atom feed.
+func isFeedType(t string) bool {
+	switch strings.ToLower(strings.TrimSpace(t)) {
+	case "application/rss+xml", "application/atom+xml", "application/rdf+xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+package homework2
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sort"
+	"sync"
+)
+
+// SimilarityIndex is a BK-tree over the pHash of canonical images, so "find similar"
+// and near-duplicate lookups only visit the part of the tree that can be within the
+// requested Hamming distance instead of scanning every image.
+type SimilarityIndex struct {
+	mu   sync.RWMutex
+	root *bkNode
+	size int
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []int64 // images sharing this exact hash
+	children map[int]*bkNode
+}
+
+// SimilarMatch is one result of SimilarityIndex.Query.
+type SimilarMatch struct {
+	ID       int64
+	Distance int
+}
+
+func NewSimilarityIndex() *SimilarityIndex {
+	return &SimilarityIndex{}
+}
+
+// Add indexes image id under pHash. Zero hashes (SVG, undecodable) are ignored.
+func (x *SimilarityIndex) Add(pHash uint64, id int64) {
+	if pHash == 0 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.size++
+	if x.root == nil {
+		x.root = &bkNode{hash: pHash, ids: []int64{id}}
+		return
+	}
+	n := x.root
+	for {
+		d := hamming(n.hash, pHash)
+		if d == 0 {
+			n.ids = append(n.ids, id)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*bkNode)
+			}
+			n.children[d] = &bkNode{hash: pHash, ids: []int64{id}}
+			return
+		}
+		n = child
+	}
+}
+
+// Remove drops id from the index. The tree node stays in place (BK-trees can't
+// delete nodes cheaply) but no longer reports the id.
+func (x *SimilarityIndex) Remove(pHash uint64, id int64) {
+	if pHash == 0 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for n := x.root; n != nil; n = n.children[hamming(n.hash, pHash)] {
+		if n.hash != pHash {
+			continue
+		}
+		for i, v := range n.ids {
+			if v == id {
+				n.ids = append(n.ids[:i], n.ids[i+1:]...)
+				x.size--
+				return
+			}
+		}
+		return
+	}
+}
+
+// Query returns all images within maxDist bits of pHash, closest first.
+func (x *SimilarityIndex) Query(pHash uint64, maxDist int) []SimilarMatch {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var out []SimilarMatch
+	if x.root == nil || pHash == 0 {
+		return out
+	}
+	stack := []*bkNode{x.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := hamming(n.hash, pHash)
+		if d <= maxDist {
+			for _, id := range n.ids {
+				out = append(out, SimilarMatch{ID: id, Distance: d})
+			}
+		}
+		// triangle inequality: only children at distance d±maxDist can hold matches
+		for cd, c := range n.children {
+			if cd >= d-maxDist && cd <= d+maxDist {
+				stack = append(stack, c)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Distance != out[j].Distance {
+			return out[i].Distance < out[j].Distance
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Len returns the number of indexed images.
+func (x *SimilarityIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.size
+}
+
+// indexedStore keeps the in-memory indexes in sync with an ImageStore: the SHA-256
+// and a SimilarityIndex of canonical images, which answer FindDuplicate without a
+// scan of the store, and a TextIndex of every image for full-text search.
+type indexedStore struct {
+	ImageStore
+	sim  *SimilarityIndex
+	text *TextIndex
+
+	shaMu sync.RWMutex
+	bySHA map[string]int64 // SHA-256 -> canonical image, the lowest id if several
+}
+
+// withIndexes loads every image of store into new indexes and returns a store that
+// updates them on Insert, Update and Delete.
+func withIndexes(ctx context.Context, store ImageStore) (*indexedStore, error) {
+	s := &indexedStore{ImageStore: store, sim: NewSimilarityIndex(), text: NewTextIndex(), bySHA: map[string]int64{}}
+	err := store.ForEach(ctx, func(im ImageMeta) error {
+		if im.DuplicateOf == 0 {
+			s.sim.Add(im.PHash, im.ID)
+			s.addSHA(im.SHA256, im.ID)
+		}
+		s.text.Add(&im)
+		return nil
+	})
+	return s, err
+}
+
+func (s *indexedStore) Insert(ctx context.Context, im *ImageMeta) (int64, error) {
+	id, err := s.ImageStore.Insert(ctx, im)
+	if err != nil {
+		return id, err
+	}
+	if im.DuplicateOf == 0 {
+		s.sim.Add(im.PHash, id)
+		s.addSHA(im.SHA256, id)
+	}
+	s.text.Add(im)
+	return id, nil
+}
+
+func (s *indexedStore) Update(ctx context.Context, im *ImageMeta) error {
+	old, err := s.ImageStore.Get(ctx, im.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.ImageStore.Update(ctx, im); err != nil {
+		return err
+	}
+	s.sim.Remove(old.PHash, im.ID)
+	s.removeSHA(ctx, old.SHA256, im.ID)
+	if im.DuplicateOf == 0 {
+		s.sim.Add(im.PHash, im.ID)
+		s.addSHA(im.SHA256, im.ID)
+	}
+	s.text.Add(im)
+	return nil
+}
+
+func (s *indexedStore) Delete(ctx context.Context, id int64) error {
+	im, err := s.ImageStore.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.ImageStore.Delete(ctx, id); err != nil {
+		return err
+	}
+	s.sim.Remove(im.PHash, id)
+	s.removeSHA(ctx, im.SHA256, id)
+	s.text.Remove(id)
+	return nil
+}
+
+// addSHA records canonical image id under its SHA-256.
+func (s *indexedStore) addSHA(sha string, id int64) {
+	if sha == "" {
+		return
+	}
+	s.shaMu.Lock()
+	defer s.shaMu.Unlock()
+	if cur, ok := s.bySHA[sha]; !ok || id < cur {
+		s.bySHA[sha] = id
+	}
+}
+
+// removeSHA forgets image id under sha, if it is recorded there, and records the
+// next canonical image with that SHA-256 instead, if the store has one.
+func (s *indexedStore) removeSHA(ctx context.Context, sha string, id int64) {
+	s.shaMu.Lock()
+	defer s.shaMu.Unlock()
+	if cur, ok := s.bySHA[sha]; !ok || cur != id {
+		return
+	}
+	delete(s.bySHA, sha)
+	if next, err := s.ImageStore.FindDuplicate(ctx, sha, 0, -1); err == nil {
+		s.bySHA[sha] = next.ID
+	}
+}
+
+// TextSearch returns the images matching query, best BM25 score first, that also
+// satisfy f. With f.CanonicalOnly a hit on a duplicate (found on another page, with
+// other alt text) ranks its canonical image.
+func (s *indexedStore) TextSearch(ctx context.Context, query string, f ImageFilter) ([]ImageMeta, error) {
+	imgs := []ImageMeta{}
+	seen := map[int64]bool{}
+	matches := s.text.Search(query)
+	for len(matches) > 0 && len(imgs) < f.limit() {
+		// the hits are read from the store a batch at a time, in rank order
+		batch := matches[:min(len(matches), textSearchBatch)]
+		matches = matches[len(batch):]
+		ids := make([]int64, len(batch))
+		for i, m := range batch {
+			ids[i] = m.ID
+		}
+		hits, err := s.GetMany(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		if f.CanonicalOnly {
+			var canon []int64
+			for _, im := range hits {
+				if _, ok := hits[im.DuplicateOf]; im.DuplicateOf != 0 && !ok {
+					canon = append(canon, im.DuplicateOf)
+				}
+			}
+			more, err := s.GetMany(ctx, canon)
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(hits, more)
+		}
+		for _, id := range ids {
+			if len(imgs) >= f.limit() {
+				break
+			}
+			im, ok := hits[id]
+			if ok && f.CanonicalOnly && im.DuplicateOf != 0 {
+				im, ok = hits[im.DuplicateOf]
+			}
+			if !ok || seen[im.ID] || !f.matches(&im) {
+				continue
+			}
+			seen[im.ID] = true
+			imgs = append(imgs, im)
+		}
+	}
+	return imgs, nil
+}
+
+// textSearchBatch is the number of text matches TextSearch reads with one GetMany.
+const textSearchBatch = 500
+
+// maxSortedTextMatches bounds the text matches read when a text search is ordered by
+// something other than relevance, since they all have to be sorted.
+const maxSortedTextMatches = 5000
+
+// Page returns one page of at most limit results for the search page and the API,
+// and the cursor of the next page ("" on the last one). cursor is "" or the cursor
+// returned for the previous page of the same query and filter. Text searches in
+// SortRelevance order page by offset, everything else by keyset.
+func (s *indexedStore) Page(ctx context.Context, query string, f ImageFilter, limit int, cursor string) ([]ImageMeta, string, error) {
+	var cur searchCursor
+	if cursor != "" {
+		var err error
+		if cur, err = decodeCursor(cursor); err != nil {
+			return nil, "", err
+		}
+		byOffset := query != "" && f.Sort == SortRelevance
+		if cur.Sort != f.Sort || (cur.Offset > 0) != byOffset {
+			return nil, "", errBadCursor
+		}
+		if !byOffset {
+			f.After = cur.after()
+		}
+	}
+
+	// one extra result tells whether there is a next page
+	var imgs []ImageMeta
+	var err error
+	switch {
+	case query == "":
+		f.Limit = limit + 1
+		imgs, err = s.Search(ctx, f)
+	case f.Sort == SortRelevance:
+		f.Limit = cur.Offset + limit + 1
+		imgs, err = s.TextSearch(ctx, query, f)
+		if len(imgs) > cur.Offset {
+			imgs = imgs[cur.Offset:]
+		} else {
+			imgs = nil
+		}
+	default:
+		f.Limit = maxSortedTextMatches
+		imgs, err = s.TextSearch(ctx, query, f)
+		sort.Slice(imgs, func(i, j int) bool { return f.less(&imgs[i], &imgs[j]) })
+	}
+	if err != nil || len(imgs) <= limit {
+		return imgs, "", err
+	}
+	imgs = imgs[:limit]
+	next := cursorAfter(f, &imgs[limit-1])
+	if query != "" && f.Sort == SortRelevance {
+		next = searchCursor{Sort: f.Sort, Offset: cur.Offset + limit}
+	}
+	return imgs, next.encode(), nil
+}
+
+func (s *indexedStore) FindDuplicate(ctx context.Context, sha string, pHash uint64, maxDist int) (ImageMeta, error) {
+	s.shaMu.RLock()
+	id, ok := s.bySHA[sha]
+	s.shaMu.RUnlock()
+	if ok {
+		im, err := s.ImageStore.Get(ctx, id)
+		if err == nil && im.SHA256 == sha && im.DuplicateOf == 0 {
+			return im, nil
+		}
+		if err != nil && !errors.Is(err, ErrImageNotFound) {
+			return im, err
+		}
+		// changed behind the index's back, ask the store
+		if im, err = s.ImageStore.FindDuplicate(ctx, sha, 0, -1); !errors.Is(err, ErrImageNotFound) {
+			return im, err
+		}
+	}
+	if maxDist < 0 {
+		return ImageMeta{}, ErrImageNotFound
+	}
+	for _, m := range s.sim.Query(pHash, maxDist) {
+		im, err := s.ImageStore.Get(ctx, m.ID)
+		if errors.Is(err, ErrImageNotFound) {
+			continue
+		}
+		return im, err
+	}
+	return ImageMeta{}, ErrImageNotFound
+}
+
+// Similar returns canonical images within maxDist bits of image id, closest first,
+// excluding id itself.
+func (s *indexedStore) Similar(ctx context.Context, id int64, maxDist, limit int) ([]ImageMeta, error) {
+	im, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if im.DuplicateOf != 0 {
+		if im, err = s.Get(ctx, im.DuplicateOf); err != nil {
+			return nil, err
+		}
+	}
+	imgs := []ImageMeta{}
+	for _, m := range s.sim.Query(im.PHash, maxDist) {
+		if m.ID == im.ID {
+			continue
+		}
+		if len(imgs) >= limit {
+			break
+		}
+		other, err := s.Get(ctx, m.ID)
+		if errors.Is(err, ErrImageNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, other)
+	}
+	return imgs, nil
+}
@@ -0,0 +1,980 @@
+package homework2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrImageNotFound is returned by ImageStore.Get and Delete for unknown ids.
+var ErrImageNotFound = errors.New("image not found")
+
+// ErrPageNotFound is returned by ImageStore.GetPage for pages never crawled.
+var ErrPageNotFound = errors.New("page not found")
+
+// PageMeta is what a crawl remembers about a page for the next one (recrawl.go): the
+// validators and content hash of the version it saw, and the links and feeds that are
+// followed again if the page turns out unchanged.
+type PageMeta struct {
+	URL          string
+	Base         string // the URL links and images were resolved against, after redirects
+	ETag         string
+	LastModified string // Last-Modified header, sent back verbatim
+	SHA256       string // of the HTML
+	Links        []string
+	Feeds        []string
+	Redirects    []string  // the URLs the page was redirected from, its own URL first
+	FetchedAt    time.Time // last download of the page
+	CheckedAt    time.Time // last download or 304
+}
+
+// ImageFilter holds the search criteria understood by every ImageStore.
+type ImageFilter struct {
+	Format    string
+	Filename  string // substring match
+	MinWidth  int
+	MinHeight int
+	Limit     int
+
+	CanonicalOnly bool  // hide images that are duplicates of another record
+	DuplicateOf   int64 // only the duplicates of this canonical image
+
+	PageURL   string // only the images found on this page
+	HideStale bool   // hide images their page no longer has
+
+	HasGPS     bool
+	TakenAfter time.Time // zero = any date
+	Copyright  string    // substring match, case-insensitive
+
+	// Color (#rrggbb) keeps images where palette colors within ColorDelta (CIELAB ΔE)
+	// of it cover at least ColorShare of the pixels.
+	Color      string
+	ColorDelta float64
+	ColorShare float64
+
+	Sort string // one of the Sort* orders
+
+	// After continues a previous search with the images that sort after this one
+	// (keyset pagination). Only the fields the sort order looks at need to be set,
+	// see searchCursor.
+	After *ImageMeta
+}
+
+// Result orders for ImageFilter.Sort. Every order ends with newest first, so ties
+// and keyset pagination are stable.
+const (
+	SortRelevance = ""         // BM25 rank for text searches, otherwise the same as SortNewest
+	SortNewest    = "newest"   // crawled_at DESC
+	SortLargest   = "size"     // width*height DESC
+	SortFormat    = "format"   // format ASC
+	SortColorful  = "colorful" // colorfulness DESC
+)
+
+// Defaults for the color filter.
+const (
+	DefaultColorDelta = 20
+	DefaultColorShare = 0.25
+)
+
+// ImageStore persists image metadata produced by the crawler and serves the search UI.
+type ImageStore interface {
+	Insert(ctx context.Context, im *ImageMeta) (int64, error)
+	Search(ctx context.Context, f ImageFilter) ([]ImageMeta, error)
+	Get(ctx context.Context, id int64) (ImageMeta, error)
+	// GetMany returns the stored images among ids by id; missing ones are left out.
+	GetMany(ctx context.Context, ids []int64) (map[int64]ImageMeta, error)
+	Delete(ctx context.Context, id int64) error
+	// Update replaces the stored image with id im.ID.
+	Update(ctx context.Context, im *ImageMeta) error
+	// FindDuplicate returns the canonical image with the given SHA-256 or, if maxDist >= 0
+	// and pHash != 0, one whose pHash is within maxDist bits. ErrImageNotFound if none.
+	FindDuplicate(ctx context.Context, sha string, pHash uint64, maxDist int) (ImageMeta, error)
+	// ForEach calls fn for every stored image in id order, stopping at the first error.
+	ForEach(ctx context.Context, fn func(ImageMeta) error) error
+	// GetPage returns what the last crawl of pageURL recorded, ErrPageNotFound if none.
+	GetPage(ctx context.Context, pageURL string) (PageMeta, error)
+	// PutPage records p, replacing an earlier record of the same URL.
+	PutPage(ctx context.Context, p PageMeta) error
+	Close() error
+}
+
+// OpenImageStore creates the store selected by the -store flag.
+// kind is one of "mysql", "file" or "memory"; dsn is the MySQL DSN or the file path.
+func OpenImageStore(kind, dsn string) (ImageStore, error) {
+	switch kind {
+	case "mysql":
+		return NewMySQLStore(dsn)
+	case "file":
+		return NewFileStore(dsn)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q (want mysql, file or memory)", kind)
+	}
+}
+
+const defaultSearchLimit = 500
+
+// matches reports whether im satisfies f. Used by the in-process stores.
+func (f ImageFilter) matches(im *ImageMeta) bool {
+	if f.Format != "" && im.Format != f.Format {
+		return false
+	}
+	if f.Filename != "" && !strings.Contains(im.Filename, f.Filename) {
+		return false
+	}
+	if im.Width < f.MinWidth || im.Height < f.MinHeight {
+		return false
+	}
+	if f.CanonicalOnly && im.DuplicateOf != 0 {
+		return false
+	}
+	if f.DuplicateOf != 0 && im.DuplicateOf != f.DuplicateOf {
+		return false
+	}
+	if f.PageURL != "" && im.PageURL != f.PageURL {
+		return false
+	}
+	if f.HideStale && !im.StaleSince.IsZero() {
+		return false
+	}
+	if f.HasGPS && !im.HasGPS {
+		return false
+	}
+	if !f.TakenAfter.IsZero() && !im.TakenAt.After(f.TakenAfter) {
+		return false
+	}
+	if f.Copyright != "" && !strings.Contains(strings.ToLower(im.Copyright), strings.ToLower(f.Copyright)) {
+		return false
+	}
+	if f.After != nil && !f.less(f.After, im) {
+		return false
+	}
+	return f.matchesColor(im)
+}
+
+// matchesColor is the part of matches no SQL store can evaluate itself.
+func (f ImageFilter) matchesColor(im *ImageMeta) bool {
+	if f.Color == "" {
+		return true
+	}
+	target, ok := parseHexColor(f.Color)
+	if !ok {
+		return true
+	}
+	delta, share := f.ColorDelta, f.ColorShare
+	if delta <= 0 {
+		delta = DefaultColorDelta
+	}
+	if share <= 0 {
+		share = DefaultColorShare
+	}
+	return colorCoverage(im.Palette, target, delta) >= share
+}
+
+// less orders two matching images according to f.Sort.
+func (f ImageFilter) less(a, b *ImageMeta) bool {
+	switch f.Sort {
+	case SortLargest:
+		if pa, pb := a.Width*a.Height, b.Width*b.Height; pa != pb {
+			return pa > pb
+		}
+	case SortFormat:
+		if a.Format != b.Format {
+			return a.Format < b.Format
+		}
+	case SortColorful:
+		if a.Colorfulness != b.Colorfulness {
+			return a.Colorfulness > b.Colorfulness
+		}
+	}
+	if !a.CrawledAt.Equal(b.CrawledAt) {
+		return a.CrawledAt.After(b.CrawledAt)
+	}
+	return a.ID > b.ID
+}
+
+func (f ImageFilter) limit() int {
+	if f.Limit <= 0 {
+		return defaultSearchLimit
+	}
+	return f.Limit
+}
+
+// sqlSortKey returns the SQL expression f.Sort orders by before crawled_at and id,
+// whether it is descending, and the value of that key for im. expr is "" for the
+// plain newest-first order.
+func (f ImageFilter) sqlSortKey(im *ImageMeta) (expr string, desc bool, val interface{}) {
+	switch f.Sort {
+	case SortLargest:
+		return "width * height", true, im.Width * im.Height
+	case SortFormat:
+		return "format", false, im.Format
+	case SortColorful:
+		return "colorfulness", true, im.Colorfulness
+	}
+	return "", false, nil
+}
+
+// searchCursor is a position in a result list, handed to clients base64-encoded:
+// the sort keys of the last image shown for keyset pagination, or an offset for
+// relevance-ranked text searches.
+type searchCursor struct {
+	Sort         string    `json:"s,omitempty"`
+	ID           int64     `json:"id,omitempty"`
+	CrawledAt    time.Time `json:"t,omitempty"`
+	Width        int       `json:"w,omitempty"`
+	Height       int       `json:"h,omitempty"`
+	Format       string    `json:"f,omitempty"`
+	Colorfulness float64   `json:"c,omitempty"`
+	Offset       int       `json:"o,omitempty"`
+}
+
+var errBadCursor = errors.New("cursor: invalid or from a different query")
+
+// cursorAfter returns the cursor that continues f's results after im.
+func cursorAfter(f ImageFilter, im *ImageMeta) searchCursor {
+	return searchCursor{Sort: f.Sort, ID: im.ID, CrawledAt: im.CrawledAt, Width: im.Width, Height: im.Height,
+		Format: im.Format, Colorfulness: im.Colorfulness}
+}
+
+// after is the partial image to put in ImageFilter.After.
+func (c searchCursor) after() *ImageMeta {
+	return &ImageMeta{ID: c.ID, CrawledAt: c.CrawledAt, Width: c.Width, Height: c.Height, Format: c.Format, Colorfulness: c.Colorfulness}
+}
+
+func (c searchCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || (c.ID == 0 && c.Offset <= 0) {
+		return c, errBadCursor
+	}
+	return c, nil
+}
+
+// ---- MySQL ----
+
+// MySQLStore keeps images in the MySQL table described at the top of indexingAndSearchingImages.go.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+const imageColumns = "id, url, filename, thumbnail_path, alt_text, title_text, width, height, format, crawled_at, " +
+	"sha256, ahash, dhash, phash, duplicate_of, source, alternates, thumbnails, frames, duration_ms, " +
+	"camera_make, camera_model, lens, taken_at, gps_lat, gps_lon, creator, copyright, keywords, " +
+	"page_url, page_title, caption, context, palette, avg_color, colorfulness, " +
+	"etag, last_modified, checked_at, stale_since"
+
+// imageWriteColumns are the columns set by Insert and Update, see imageValues.
+var imageWriteColumns = []string{"url", "filename", "thumbnail_path", "alt_text", "title_text", "width", "height", "format",
+	"sha256", "ahash", "dhash", "phash", "duplicate_of", "source", "alternates", "thumbnails", "frames", "duration_ms",
+	"camera_make", "camera_model", "lens", "taken_at", "gps_lat", "gps_lon", "creator", "copyright", "keywords",
+	"page_url", "page_title", "caption", "context", "palette", "avg_color", "colorfulness",
+	"etag", "last_modified", "checked_at", "stale_since"}
+
+func NewMySQLStore(dsn string) (*MySQLStore, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &MySQLStore{db: db}, nil
+}
+
+// imageValues returns the values of imageWriteColumns for im.
+func imageValues(im *ImageMeta) []interface{} {
+	var dupOf sql.NullInt64
+	if im.DuplicateOf != 0 {
+		dupOf = sql.NullInt64{Int64: im.DuplicateOf, Valid: true}
+	}
+	takenAt := nullTime(im.TakenAt)
+	var lat, lon sql.NullFloat64
+	if im.HasGPS {
+		lat = sql.NullFloat64{Float64: im.GPSLat, Valid: true}
+		lon = sql.NullFloat64{Float64: im.GPSLon, Valid: true}
+	}
+	return []interface{}{im.URL, im.Filename, im.Thumbnail, im.Alt, im.Title, im.Width, im.Height, im.Format, im.SHA256, im.AHash, im.DHash, im.PHash, dupOf,
+		im.Source, strings.Join(im.Alternates, "\n"), encodeThumbnails(im.Thumbnails),
+		im.Frames, im.Duration.Milliseconds(),
+		im.CameraMake, im.CameraModel, im.Lens, takenAt, lat, lon, im.Creator, im.Copyright, strings.Join(im.Keywords, "\n"),
+		im.PageURL, im.PageTitle, im.Caption, im.Context,
+		encodePalette(im.Palette), im.AvgColor, im.Colorfulness,
+		im.ETag, im.LastModified, nullTime(im.CheckedAt), nullTime(im.StaleSince)}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s *MySQLStore) Insert(ctx context.Context, im *ImageMeta) (int64, error) {
+	query := fmt.Sprintf("INSERT INTO images (%s) VALUES (?%s)",
+		strings.Join(imageWriteColumns, ", "), strings.Repeat(", ?", len(imageWriteColumns)-1))
+	res, err := s.db.ExecContext(ctx, query, imageValues(im)...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	im.ID = id
+	return id, nil
+}
+
+// Bounds of a color search in MySQL, whose color distance is computed in Go: the
+// images matching the other filters are read colorScanBatch at a time, in order, and
+// the search stops after maxColorScan of them even if fewer than the limit matched.
+const (
+	colorScanBatch = 1000
+	maxColorScan   = 20000
+)
+
+func (s *MySQLStore) Search(ctx context.Context, f ImageFilter) ([]ImageMeta, error) {
+	if f.Color == "" {
+		return s.searchRows(ctx, f, f.limit())
+	}
+	imgs := []ImageMeta{}
+	for scanned := 0; scanned < maxColorScan && len(imgs) < f.limit(); {
+		batch, err := s.searchRows(ctx, f, colorScanBatch)
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			if len(imgs) < f.limit() && f.matchesColor(&batch[i]) {
+				imgs = append(imgs, batch[i])
+			}
+		}
+		scanned += len(batch)
+		if len(batch) < colorScanBatch {
+			break
+		}
+		f.After = &batch[len(batch)-1]
+	}
+	return imgs, nil
+}
+
+// searchRows returns at most limit images matching f, the color filter aside.
+func (s *MySQLStore) searchRows(ctx context.Context, f ImageFilter, limit int) ([]ImageMeta, error) {
+	where := []string{"1=1"}
+	params := []interface{}{}
+	if f.Format != "" {
+		where = append(where, "format = ?")
+		params = append(params, f.Format)
+	}
+	if f.Filename != "" {
+		where = append(where, "filename LIKE ?")
+		params = append(params, "%"+f.Filename+"%")
+	}
+	if f.MinWidth > 0 {
+		where = append(where, "width >= ?")
+		params = append(params, f.MinWidth)
+	}
+	if f.MinHeight > 0 {
+		where = append(where, "height >= ?")
+		params = append(params, f.MinHeight)
+	}
+	if f.CanonicalOnly {
+		where = append(where, "duplicate_of IS NULL")
+	}
+	if f.HasGPS {
+		where = append(where, "gps_lat IS NOT NULL")
+	}
+	if !f.TakenAfter.IsZero() {
+		where = append(where, "taken_at > ?")
+		params = append(params, f.TakenAfter)
+	}
+	if f.Copyright != "" {
+		// the utf8mb4_general_ci collation makes LIKE case-insensitive
+		where = append(where, "copyright LIKE ?")
+		params = append(params, "%"+f.Copyright+"%")
+	}
+	if f.DuplicateOf != 0 {
+		where = append(where, "duplicate_of = ?")
+		params = append(params, f.DuplicateOf)
+	}
+	if f.PageURL != "" {
+		where = append(where, "page_url = ?")
+		params = append(params, f.PageURL)
+	}
+	if f.HideStale {
+		where = append(where, "stale_since IS NULL")
+	}
+	order := "crawled_at DESC, id DESC"
+	expr, desc, _ := f.sqlSortKey(&ImageMeta{})
+	if expr != "" {
+		dir := " ASC"
+		if desc {
+			dir = " DESC"
+		}
+		order = expr + dir + ", " + order
+	}
+	if a := f.After; a != nil {
+		// row comparison spelled out, so MySQL can still use the sort index
+		after := "(crawled_at < ? OR (crawled_at = ? AND id < ?))"
+		keys := []interface{}{a.CrawledAt, a.CrawledAt, a.ID}
+		if expr != "" {
+			_, _, val := f.sqlSortKey(a)
+			op := " > ?"
+			if desc {
+				op = " < ?"
+			}
+			after = "(" + expr + op + " OR (" + expr + " = ? AND " + after + "))"
+			keys = append([]interface{}{val, val}, keys...)
+		}
+		where = append(where, after)
+		params = append(params, keys...)
+	}
+	query := fmt.Sprintf("SELECT %s FROM images WHERE %s ORDER BY %s LIMIT %d", imageColumns, strings.Join(where, " AND "), order, limit)
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imgs := []ImageMeta{}
+	for rows.Next() {
+		im, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, im)
+	}
+	return imgs, rows.Err()
+}
+
+func (s *MySQLStore) Get(ctx context.Context, id int64) (ImageMeta, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+imageColumns+" FROM images WHERE id = ?", id)
+	im, err := scanImage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImageMeta{}, ErrImageNotFound
+	}
+	return im, err
+}
+
+// maxGetMany bounds the ids of one SELECT ... WHERE id IN query of GetMany.
+const maxGetMany = 1000
+
+func (s *MySQLStore) GetMany(ctx context.Context, ids []int64) (map[int64]ImageMeta, error) {
+	imgs := make(map[int64]ImageMeta, len(ids))
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), maxGetMany)]
+		ids = ids[len(batch):]
+		params := make([]interface{}, len(batch))
+		for i, id := range batch {
+			params[i] = id
+		}
+		query := "SELECT " + imageColumns + " FROM images WHERE id IN (?" + strings.Repeat(", ?", len(batch)-1) + ")"
+		rows, err := s.db.QueryContext(ctx, query, params...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			im, err := scanImage(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			imgs[im.ID] = im
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return imgs, nil
+}
+
+// Update doesn't report ErrImageNotFound: MySQL counts only the rows it changed.
+func (s *MySQLStore) Update(ctx context.Context, im *ImageMeta) error {
+	query := "UPDATE images SET " + strings.Join(imageWriteColumns, " = ?, ") + " = ?, crawled_at = ? WHERE id = ?"
+	crawledAt := im.CrawledAt
+	if crawledAt.IsZero() {
+		crawledAt = time.Now()
+	}
+	_, err := s.db.ExecContext(ctx, query, append(imageValues(im), crawledAt, im.ID)...)
+	return err
+}
+
+func (s *MySQLStore) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM images WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrImageNotFound
+	}
+	return nil
+}
+
+func (s *MySQLStore) FindDuplicate(ctx context.Context, sha string, pHash uint64, maxDist int) (ImageMeta, error) {
+	query := "SELECT " + imageColumns + " FROM images WHERE duplicate_of IS NULL AND (sha256 = ?"
+	params := []interface{}{sha}
+	if maxDist >= 0 && pHash != 0 {
+		query += " OR (phash <> 0 AND BIT_COUNT(phash ^ ?) <= ?)"
+		params = append(params, pHash, maxDist)
+	}
+	// prefer the exact match, then the closest one
+	query += ") ORDER BY sha256 = ? DESC, BIT_COUNT(phash ^ ?), id LIMIT 1"
+	params = append(params, sha, pHash)
+	im, err := scanImage(s.db.QueryRowContext(ctx, query, params...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImageMeta{}, ErrImageNotFound
+	}
+	return im, err
+}
+
+func (s *MySQLStore) ForEach(ctx context.Context, fn func(ImageMeta) error) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+imageColumns+" FROM images ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		im, err := scanImage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(im); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const pageColumns = "url, base_url, etag, last_modified, sha256, links, feeds, redirects, fetched_at, checked_at"
+
+func (s *MySQLStore) GetPage(ctx context.Context, pageURL string) (PageMeta, error) {
+	var p PageMeta
+	var base, etag, lastMod, sha, links, feeds, redirects sql.NullString
+	var fetchedAt, checkedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT "+pageColumns+" FROM pages WHERE url_sha256 = ?", sha256Hex([]byte(pageURL))).
+		Scan(&p.URL, &base, &etag, &lastMod, &sha, &links, &feeds, &redirects, &fetchedAt, &checkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrPageNotFound
+	}
+	p.Base, p.ETag, p.LastModified, p.SHA256 = base.String, etag.String, lastMod.String, sha.String
+	if links.String != "" {
+		p.Links = strings.Split(links.String, "\n")
+	}
+	if feeds.String != "" {
+		p.Feeds = strings.Split(feeds.String, "\n")
+	}
+	if redirects.String != "" {
+		p.Redirects = strings.Split(redirects.String, "\n")
+	}
+	p.FetchedAt, p.CheckedAt = fetchedAt.Time, checkedAt.Time
+	return p, err
+}
+
+func (s *MySQLStore) PutPage(ctx context.Context, p PageMeta) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO pages (url_sha256, `+pageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE base_url = VALUES(base_url), etag = VALUES(etag), last_modified = VALUES(last_modified),
+		sha256 = VALUES(sha256), links = VALUES(links), feeds = VALUES(feeds), redirects = VALUES(redirects),
+		fetched_at = VALUES(fetched_at), checked_at = VALUES(checked_at)`,
+		sha256Hex([]byte(p.URL)), p.URL, p.Base, p.ETag, p.LastModified, p.SHA256,
+		strings.Join(p.Links, "\n"), strings.Join(p.Feeds, "\n"), strings.Join(p.Redirects, "\n"),
+		nullTime(p.FetchedAt), nullTime(p.CheckedAt))
+	return err
+}
+
+func (s *MySQLStore) Close() error {
+	return s.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanImage(r rowScanner) (ImageMeta, error) {
+	var im ImageMeta
+	var thumb, alt, title, format, sha, source, alternates, thumbs sql.NullString
+	var width, height, dupOf sql.NullInt64
+	var durationMS int64
+	var camMake, camModel, lens, creator, copyright, keywords sql.NullString
+	var pageURL, pageTitle, caption, surrounding sql.NullString
+	var palette, avgColor sql.NullString
+	var etag, lastMod sql.NullString
+	var takenAt, checkedAt, staleSince sql.NullTime
+	var lat, lon sql.NullFloat64
+	err := r.Scan(&im.ID, &im.URL, &im.Filename, &thumb, &alt, &title, &width, &height, &format, &im.CrawledAt,
+		&sha, &im.AHash, &im.DHash, &im.PHash, &dupOf, &source, &alternates, &thumbs, &im.Frames, &durationMS,
+		&camMake, &camModel, &lens, &takenAt, &lat, &lon, &creator, &copyright, &keywords,
+		&pageURL, &pageTitle, &caption, &surrounding,
+		&palette, &avgColor, &im.Colorfulness,
+		&etag, &lastMod, &checkedAt, &staleSince)
+	im.Thumbnail = thumb.String
+	im.Alt = alt.String
+	im.Title = title.String
+	im.Width = int(width.Int64)
+	im.Height = int(height.Int64)
+	im.Format = format.String
+	im.SHA256 = sha.String
+	im.DuplicateOf = dupOf.Int64
+	im.Source = source.String
+	im.Duration = time.Duration(durationMS) * time.Millisecond
+	im.CameraMake = camMake.String
+	im.CameraModel = camModel.String
+	im.Lens = lens.String
+	im.TakenAt = takenAt.Time
+	im.HasGPS = lat.Valid && lon.Valid
+	im.GPSLat, im.GPSLon = lat.Float64, lon.Float64
+	im.Creator = creator.String
+	im.Copyright = copyright.String
+	if keywords.String != "" {
+		im.Keywords = strings.Split(keywords.String, "\n")
+	}
+	im.PageURL = pageURL.String
+	im.PageTitle = pageTitle.String
+	im.Caption = caption.String
+	im.Context = surrounding.String
+	im.Palette = decodePalette(palette.String)
+	im.AvgColor = avgColor.String
+	im.ETag = etag.String
+	im.LastModified = lastMod.String
+	im.CheckedAt = checkedAt.Time
+	im.StaleSince = staleSince.Time
+	if alternates.String != "" {
+		im.Alternates = strings.Split(alternates.String, "\n")
+	}
+	if thumbs.String != "" {
+		// a malformed value only loses the extra sizes, Thumbnail still works
+		json.Unmarshal([]byte(thumbs.String), &im.Thumbnails)
+	}
+	return im, err
+}
+
+// encodeThumbnails stores the thumbnails map as JSON ({"200":"path"}), NULL if empty.
+func encodeThumbnails(t map[int]string) sql.NullString {
+	if len(t) == 0 {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(t)
+	return sql.NullString{String: string(b), Valid: true}
+}
+
+// ---- memory ----
+
+// MemoryStore keeps everything in a map. Useful for tests and one-off crawls.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	images map[int64]ImageMeta
+	pages  map[string]PageMeta
+	nextID int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{images: make(map[int64]ImageMeta), pages: make(map[string]PageMeta), nextID: 1}
+}
+
+func (s *MemoryStore) Insert(ctx context.Context, im *ImageMeta) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insertLocked(im)
+	return im.ID, nil
+}
+
+func (s *MemoryStore) insertLocked(im *ImageMeta) {
+	im.ID = s.nextID
+	s.nextID++
+	if im.CrawledAt.IsZero() {
+		im.CrawledAt = time.Now()
+	}
+	s.images[im.ID] = *im
+}
+
+func (s *MemoryStore) Search(ctx context.Context, f ImageFilter) ([]ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	imgs := []ImageMeta{}
+	for _, im := range s.images {
+		if f.matches(&im) {
+			imgs = append(imgs, im)
+		}
+	}
+	// same order as the MySQL query
+	sort.Slice(imgs, func(i, j int) bool { return f.less(&imgs[i], &imgs[j]) })
+	if len(imgs) > f.limit() {
+		imgs = imgs[:f.limit()]
+	}
+	return imgs, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id int64) (ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	im, ok := s.images[id]
+	if !ok {
+		return ImageMeta{}, ErrImageNotFound
+	}
+	return im, nil
+}
+
+func (s *MemoryStore) GetMany(ctx context.Context, ids []int64) (map[int64]ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	imgs := make(map[int64]ImageMeta, len(ids))
+	for _, id := range ids {
+		if im, ok := s.images[id]; ok {
+			imgs[id] = im
+		}
+	}
+	return imgs, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, im *ImageMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(im)
+}
+
+func (s *MemoryStore) updateLocked(im *ImageMeta) error {
+	if _, ok := s.images[im.ID]; !ok {
+		return ErrImageNotFound
+	}
+	if im.CrawledAt.IsZero() {
+		im.CrawledAt = time.Now()
+	}
+	s.images[im.ID] = *im
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteLocked(id)
+}
+
+func (s *MemoryStore) deleteLocked(id int64) error {
+	if _, ok := s.images[id]; !ok {
+		return ErrImageNotFound
+	}
+	delete(s.images, id)
+	return nil
+}
+
+func (s *MemoryStore) FindDuplicate(ctx context.Context, sha string, pHash uint64, maxDist int) (ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var best ImageMeta
+	bestDist := -1
+	for _, im := range s.images {
+		if im.DuplicateOf != 0 {
+			continue
+		}
+		dist := -1
+		if sha != "" && im.SHA256 == sha {
+			dist = 0
+		} else if maxDist >= 0 && pHash != 0 && im.PHash != 0 {
+			if d := hamming(im.PHash, pHash); d <= maxDist {
+				dist = d
+			}
+		}
+		if dist < 0 {
+			continue
+		}
+		if bestDist < 0 || dist < bestDist || (dist == bestDist && im.ID < best.ID) {
+			best, bestDist = im, dist
+		}
+	}
+	if bestDist < 0 {
+		return ImageMeta{}, ErrImageNotFound
+	}
+	return best, nil
+}
+
+func (s *MemoryStore) ForEach(ctx context.Context, fn func(ImageMeta) error) error {
+	s.mu.RLock()
+	imgs := make([]ImageMeta, 0, len(s.images))
+	for _, im := range s.images {
+		imgs = append(imgs, im)
+	}
+	s.mu.RUnlock()
+	// fn runs without the lock so it may call back into the store
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].ID < imgs[j].ID })
+	for _, im := range imgs {
+		if err := fn(im); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetPage(ctx context.Context, pageURL string) (PageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.pages[pageURL]
+	if !ok {
+		return PageMeta{}, ErrPageNotFound
+	}
+	return p, nil
+}
+
+func (s *MemoryStore) PutPage(ctx context.Context, p PageMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[p.URL] = p
+	return nil
+}
+
+func (s *MemoryStore) Close() error { return nil }
+
+// ---- file ----
+
+// FileStore is a MemoryStore backed by an append-only JSON lines log, so the index
+// survives restarts without a database server. The log is replayed on open.
+type FileStore struct {
+	*MemoryStore
+	f *os.File
+	w *bufio.Writer
+}
+
+// fileRecord is one line of the FileStore log.
+type fileRecord struct {
+	Op    string     `json:"op"` // "put", "del" or "page"
+	ID    int64      `json:"id,omitempty"`
+	Image *ImageMeta `json:"image,omitempty"`
+	Page  *PageMeta  `json:"page,omitempty"`
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{MemoryStore: NewMemoryStore(), f: f}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	var torn error
+	for sc.Scan() {
+		line++
+		if torn != nil {
+			// a torn last line after a crash is expected; anything else is not
+			f.Close()
+			return nil, torn
+		}
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			torn = fmt.Errorf("%s:%d: %v", path, line, err)
+			continue
+		}
+		switch rec.Op {
+		case "put":
+			if rec.Image == nil {
+				continue
+			}
+			s.images[rec.Image.ID] = *rec.Image
+			if rec.Image.ID >= s.nextID {
+				s.nextID = rec.Image.ID + 1
+			}
+		case "del":
+			delete(s.images, rec.ID)
+		case "page":
+			if rec.Page != nil {
+				s.pages[rec.Page.URL] = *rec.Page
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.w = bufio.NewWriter(f)
+	if torn != nil {
+		log.Printf("file store: ignoring torn record: %v", torn)
+		// terminate the torn line so the next record starts cleanly
+		s.w.WriteByte('\n')
+	}
+	return s, nil
+}
+
+func (s *FileStore) Insert(ctx context.Context, im *ImageMeta) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insertLocked(im)
+	stored := s.images[im.ID]
+	if err := s.appendLocked(fileRecord{Op: "put", Image: &stored}); err != nil {
+		delete(s.images, im.ID)
+		return 0, err
+	}
+	return im.ID, nil
+}
+
+func (s *FileStore) Update(ctx context.Context, im *ImageMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.images[im.ID]
+	if !ok {
+		return ErrImageNotFound
+	}
+	s.updateLocked(im)
+	stored := s.images[im.ID]
+	if err := s.appendLocked(fileRecord{Op: "put", Image: &stored}); err != nil {
+		s.images[im.ID] = old
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) PutPage(ctx context.Context, p PageMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.appendLocked(fileRecord{Op: "page", Page: &p}); err != nil {
+		return err
+	}
+	s.pages[p.URL] = p
+	return nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[id]; !ok {
+		return ErrImageNotFound
+	}
+	// logged first, so a failed write leaves memory as the log has it
+	if err := s.appendLocked(fileRecord{Op: "del", ID: id}); err != nil {
+		return err
+	}
+	return s.deleteLocked(id)
+}
+
+func (s *FileStore) appendLocked(rec fileRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
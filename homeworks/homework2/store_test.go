@@ -0,0 +1,26 @@
+package homework2
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreDeleteFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "images.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Insert(ctx, &ImageMeta{URL: "http://example.com/a.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.f.Close() // every later write to the log fails
+	if err := s.Delete(ctx, id); err == nil {
+		t.Fatal("Delete succeeded without writing the log")
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		t.Errorf("image gone from memory after a failed Delete: %v", err)
+	}
+}
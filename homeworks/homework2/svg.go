@@ -0,0 +1,936 @@
+package homework2
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/vector"
+)
+
+// A small, pure-Go SVG renderer for thumbnails. It understands the root viewBox and
+// size, <g> with transforms, rect/circle/ellipse/line/polyline/polygon/path (all path
+// commands incl. arcs), fill/stroke/stroke-width/opacity as attributes or style, and
+// approximates gradient fills by the average of their stop colors. Text, images,
+// <use>, clipping, masks and filters are ignored. Fills use the non-zero rule.
+
+const (
+	svgDefaultWidth  = 300 // CSS default size of a replaced element without dimensions
+	svgDefaultHeight = 150
+	svgCurveSteps    = 16 // line segments per Bézier curve
+)
+
+type svgNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []svgNode  `xml:",any"`
+}
+
+func (n *svgNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// svgMatrix is the affine transform [a c e; b d f].
+type svgMatrix [6]float64
+
+var svgIdentity = svgMatrix{1, 0, 0, 1, 0, 0}
+
+func (m svgMatrix) mul(n svgMatrix) svgMatrix {
+	return svgMatrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m svgMatrix) apply(p svgPoint) svgPoint {
+	return svgPoint{m[0]*p.X + m[2]*p.Y + m[4], m[1]*p.X + m[3]*p.Y + m[5]}
+}
+
+// scale is the average scale factor, used for stroke widths.
+func (m svgMatrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+type svgPoint struct{ X, Y float64 }
+
+// svgPath is a flattened subpath.
+type svgPath struct {
+	pts    []svgPoint
+	closed bool
+}
+
+type svgPaint struct {
+	none bool
+	c    color.NRGBA
+}
+
+type svgStyle struct {
+	fill, stroke                        svgPaint
+	strokeWidth                         float64
+	opacity, fillOpacity, strokeOpacity float64
+}
+
+// maxSVGSide bounds the intrinsic width and height an SVG may declare.
+const maxSVGSide = 1 << 24
+
+// rasterizeSVG renders an SVG document to an RGBA image that fits in a maxSize x maxSize
+// box (or at its intrinsic size if smaller), keeping the aspect ratio. It also returns
+// the intrinsic size.
+func rasterizeSVG(b []byte, maxSize int) (img *image.RGBA, width, height int, err error) {
+	root, err := parseSVG(b)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	w, h, vb := svgRootGeometry(root)
+	if !(w > 0 && h > 0) {
+		return nil, 0, 0, errors.New("svg: empty size")
+	}
+	if w > maxSVGSide || h > maxSVGSide {
+		return nil, 0, 0, fmt.Errorf("svg: size %gx%g is too large", w, h)
+	}
+	width, height = max(int(math.Round(w)), 1), max(int(math.Round(h)), 1)
+	// both sides are bounded, not just the width: a 1x200000000 document is 100 bytes
+	scale := math.Min(1, float64(maxSize)/math.Max(w, h))
+	outW := max(int(math.Round(w*scale)), 1)
+	outH := max(int(math.Round(h*scale)), 1)
+	// viewBox -> pixels, preserveAspectRatio="xMidYMid meet"
+	s := math.Min(float64(outW)/vb[2], float64(outH)/vb[3])
+	tx := (float64(outW) - vb[2]*s) / 2
+	ty := (float64(outH) - vb[3]*s) / 2
+	m := svgMatrix{s, 0, 0, s, tx - vb[0]*s, ty - vb[1]*s}
+
+	r := &svgRenderer{
+		dst:       image.NewRGBA(image.Rect(0, 0, outW, outH)),
+		rast:      vector.NewRasterizer(outW, outH),
+		gradients: map[string]svgPaint{},
+	}
+	r.collectGradients(root)
+	style := svgStyle{
+		fill:        svgPaint{c: color.NRGBA{0, 0, 0, 255}},
+		stroke:      svgPaint{none: true},
+		strokeWidth: 1,
+		opacity:     1, fillOpacity: 1, strokeOpacity: 1,
+	}
+	r.renderChildren(root, m.mul(svgParseTransform(root.attr("transform"))), style)
+	return r.dst, width, height, nil
+}
+
+func parseSVG(b []byte) (*svgNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	var root svgNode
+	if err := dec.Decode(&root); err != nil {
+		return nil, fmt.Errorf("svg: %v", err)
+	}
+	if root.XMLName.Local != "svg" {
+		return nil, fmt.Errorf("svg: root element is <%s>", root.XMLName.Local)
+	}
+	return &root, nil
+}
+
+// svgRootGeometry returns the intrinsic size and the viewBox (x, y, w, h) of the root.
+func svgRootGeometry(root *svgNode) (w, h float64, vb [4]float64) {
+	hasVB := false
+	if f := svgNumbers(root.attr("viewBox")); len(f) == 4 && f[2] > 0 && f[3] > 0 {
+		copy(vb[:], f)
+		hasVB = true
+	}
+	w, wok := svgLength(root.attr("width"), 0)
+	h, hok := svgLength(root.attr("height"), 0)
+	switch {
+	case wok && hok:
+	case hasVB && wok:
+		h = w * vb[3] / vb[2]
+	case hasVB && hok:
+		w = h * vb[2] / vb[3]
+	case hasVB:
+		w, h = vb[2], vb[3]
+	default:
+		if !wok {
+			w = svgDefaultWidth
+		}
+		if !hok {
+			h = svgDefaultHeight
+		}
+	}
+	if !hasVB {
+		vb = [4]float64{0, 0, w, h}
+	}
+	return w, h, vb
+}
+
+type svgRenderer struct {
+	dst       *image.RGBA
+	rast      *vector.Rasterizer
+	gradients map[string]svgPaint
+}
+
+// collectGradients records the average stop color of every gradient by id.
+func (r *svgRenderer) collectGradients(n *svgNode) {
+	for i := range n.Nodes {
+		c := &n.Nodes[i]
+		switch c.XMLName.Local {
+		case "linearGradient", "radialGradient":
+			var sr, sg, sb, sa, cnt float64
+			for j := range c.Nodes {
+				stop := &c.Nodes[j]
+				if stop.XMLName.Local != "stop" {
+					continue
+				}
+				props := svgProps(stop)
+				p, ok := svgParsePaint(props["stop-color"], nil)
+				if !ok || p.none {
+					continue
+				}
+				a := float64(p.c.A)
+				if op, err := strconv.ParseFloat(props["stop-opacity"], 64); err == nil {
+					a *= clamp01(op)
+				}
+				sr += float64(p.c.R)
+				sg += float64(p.c.G)
+				sb += float64(p.c.B)
+				sa += a
+				cnt++
+			}
+			if id := c.attr("id"); id != "" && cnt > 0 {
+				r.gradients[id] = svgPaint{c: color.NRGBA{uint8(sr / cnt), uint8(sg / cnt), uint8(sb / cnt), uint8(sa / cnt)}}
+			}
+		default:
+			r.collectGradients(c)
+		}
+	}
+}
+
+func (r *svgRenderer) renderChildren(n *svgNode, m svgMatrix, style svgStyle) {
+	for i := range n.Nodes {
+		r.render(&n.Nodes[i], m, style)
+	}
+}
+
+func (r *svgRenderer) render(n *svgNode, parent svgMatrix, inherited svgStyle) {
+	switch n.XMLName.Local {
+	case "defs", "clipPath", "mask", "symbol", "pattern", "marker", "linearGradient", "radialGradient",
+		"title", "desc", "metadata", "style", "script", "text", "image", "use", "foreignObject":
+		return
+	}
+	props := svgProps(n)
+	if props["display"] == "none" || props["visibility"] == "hidden" {
+		return
+	}
+	style := r.applyStyle(inherited, props)
+	m := parent.mul(svgParseTransform(n.attr("transform")))
+
+	var paths []svgPath
+	switch n.XMLName.Local {
+	case "g", "svg", "a", "switch":
+		r.renderChildren(n, m, style)
+		return
+	case "rect":
+		paths = svgRectPath(n)
+	case "circle":
+		rad := svgAttrNum(n, "r")
+		paths = svgEllipsePath(svgAttrNum(n, "cx"), svgAttrNum(n, "cy"), rad, rad)
+	case "ellipse":
+		paths = svgEllipsePath(svgAttrNum(n, "cx"), svgAttrNum(n, "cy"), svgAttrNum(n, "rx"), svgAttrNum(n, "ry"))
+	case "line":
+		paths = []svgPath{{pts: []svgPoint{
+			{svgAttrNum(n, "x1"), svgAttrNum(n, "y1")},
+			{svgAttrNum(n, "x2"), svgAttrNum(n, "y2")},
+		}}}
+		style.fill.none = true
+	case "polyline", "polygon":
+		f := svgNumbers(n.attr("points"))
+		var pts []svgPoint
+		for i := 0; i+1 < len(f); i += 2 {
+			pts = append(pts, svgPoint{f[i], f[i+1]})
+		}
+		paths = []svgPath{{pts: pts, closed: n.XMLName.Local == "polygon"}}
+	case "path":
+		paths = svgParsePathData(n.attr("d"))
+	default:
+		return
+	}
+	for i := range paths {
+		for j := range paths[i].pts {
+			paths[i].pts[j] = m.apply(paths[i].pts[j])
+		}
+	}
+	if !style.fill.none {
+		r.fill(paths, style.fill.c, style.opacity*style.fillOpacity)
+	}
+	if !style.stroke.none && style.strokeWidth > 0 {
+		r.stroke(paths, style.stroke.c, style.opacity*style.strokeOpacity, style.strokeWidth*m.scale())
+	}
+}
+
+// svgProps merges presentation attributes with the style attribute (style wins).
+func svgProps(n *svgNode) map[string]string {
+	props := map[string]string{}
+	for _, a := range n.Attrs {
+		props[a.Name.Local] = strings.TrimSpace(a.Value)
+	}
+	for _, decl := range strings.Split(n.attr("style"), ";") {
+		k, v, ok := strings.Cut(decl, ":")
+		if ok {
+			props[strings.TrimSpace(k)] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "!important"))
+		}
+	}
+	return props
+}
+
+func (r *svgRenderer) applyStyle(s svgStyle, props map[string]string) svgStyle {
+	if v, ok := props["fill"]; ok {
+		if p, ok := svgParsePaint(v, r.gradients); ok {
+			s.fill = p
+		}
+	}
+	if v, ok := props["stroke"]; ok {
+		if p, ok := svgParsePaint(v, r.gradients); ok {
+			s.stroke = p
+		}
+	}
+	if v, ok := svgLength(props["stroke-width"], 0); ok {
+		s.strokeWidth = v
+	}
+	if v, err := strconv.ParseFloat(props["fill-opacity"], 64); err == nil {
+		s.fillOpacity = clamp01(v)
+	}
+	if v, err := strconv.ParseFloat(props["stroke-opacity"], 64); err == nil {
+		s.strokeOpacity = clamp01(v)
+	}
+	// opacity isn't inherited but applies to the whole subtree; multiplying it in is a
+	// good approximation without group compositing
+	if v, err := strconv.ParseFloat(props["opacity"], 64); err == nil {
+		s.opacity *= clamp01(v)
+	}
+	return s
+}
+
+func (r *svgRenderer) fill(paths []svgPath, c color.NRGBA, opacity float64) {
+	r.rast.Reset(r.dst.Bounds().Dx(), r.dst.Bounds().Dy())
+	any := false
+	for _, p := range paths {
+		if len(p.pts) < 3 {
+			continue
+		}
+		r.addPolygon(p.pts, false)
+		any = true
+	}
+	if any {
+		r.draw(c, opacity)
+	}
+}
+
+// stroke outlines every segment with a rectangle and every vertex with a disc. All
+// pieces are added with the same orientation so the non-zero rule unions them.
+func (r *svgRenderer) stroke(paths []svgPath, c color.NRGBA, opacity, width float64) {
+	r.rast.Reset(r.dst.Bounds().Dx(), r.dst.Bounds().Dy())
+	hw := width / 2
+	any := false
+	for _, p := range paths {
+		pts := p.pts
+		if p.closed && len(pts) > 1 {
+			pts = append(append([]svgPoint(nil), pts...), pts[0])
+		}
+		for i := 0; i+1 < len(pts); i++ {
+			a, b := pts[i], pts[i+1]
+			dx, dy := b.X-a.X, b.Y-a.Y
+			l := math.Hypot(dx, dy)
+			if l == 0 {
+				continue
+			}
+			nx, ny := -dy/l*hw, dx/l*hw
+			r.addPolygon([]svgPoint{
+				{a.X + nx, a.Y + ny}, {b.X + nx, b.Y + ny},
+				{b.X - nx, b.Y - ny}, {a.X - nx, a.Y - ny},
+			}, true)
+			any = true
+		}
+		if hw >= 0.75 {
+			// round joins; below ~1.5px they are invisible
+			for _, pt := range pts {
+				r.addPolygon(svgEllipsePath(pt.X, pt.Y, hw, hw)[0].pts, true)
+			}
+		}
+	}
+	if any {
+		r.draw(c, opacity)
+	}
+}
+
+// svgCoordMargin is how far outside the canvas, in canvas sizes, points are clamped
+// to. The rasterizer works in fixed point and panics on coordinates far out of range,
+// and a few bytes of SVG can ask for 1e300.
+const svgCoordMargin = 4
+
+// addPolygon adds a closed polygon to the rasterizer. With orient the polygon is
+// reversed if needed so that all stroke pieces wind the same way. Polygons with a NaN
+// or infinite point are left out.
+func (r *svgRenderer) addPolygon(pts []svgPoint, orient bool) {
+	size := r.dst.Bounds().Size()
+	lim := svgCoordMargin * float64(max(size.X, size.Y))
+	clamped := make([]svgPoint, len(pts))
+	for i, p := range pts {
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			return
+		}
+		clamped[i] = svgPoint{math.Max(-lim, math.Min(lim, p.X)), math.Max(-lim, math.Min(lim, p.Y))}
+	}
+	pts = clamped
+	if orient {
+		area := 0.0
+		for i := range pts {
+			j := (i + 1) % len(pts)
+			area += pts[i].X*pts[j].Y - pts[j].X*pts[i].Y
+		}
+		if area > 0 {
+			slices.Reverse(pts)
+		}
+	}
+	r.rast.MoveTo(float32(pts[0].X), float32(pts[0].Y))
+	for _, p := range pts[1:] {
+		r.rast.LineTo(float32(p.X), float32(p.Y))
+	}
+	r.rast.ClosePath()
+}
+
+func (r *svgRenderer) draw(c color.NRGBA, opacity float64) {
+	c.A = uint8(float64(c.A) * clamp01(opacity))
+	if c.A == 0 {
+		return
+	}
+	r.rast.DrawOp = draw.Over
+	r.rast.Draw(r.dst, r.dst.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// ---- shapes ----
+
+func svgAttrNum(n *svgNode, name string) float64 {
+	v, _ := svgLength(n.attr(name), 0)
+	return v
+}
+
+func svgRectPath(n *svgNode) []svgPath {
+	x, y := svgAttrNum(n, "x"), svgAttrNum(n, "y")
+	w, h := svgAttrNum(n, "width"), svgAttrNum(n, "height")
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+	rx, rxok := svgLength(n.attr("rx"), w)
+	ry, ryok := svgLength(n.attr("ry"), h)
+	if !rxok {
+		rx = ry
+	}
+	if !ryok {
+		ry = rx
+	}
+	rx = math.Min(math.Max(rx, 0), w/2)
+	ry = math.Min(math.Max(ry, 0), h/2)
+	if rx == 0 || ry == 0 {
+		return []svgPath{{pts: []svgPoint{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}, closed: true}}
+	}
+	var pts []svgPoint
+	corner := func(cx, cy, start float64) {
+		for i := 0; i <= 8; i++ {
+			a := start + float64(i)*math.Pi/16
+			pts = append(pts, svgPoint{cx + rx*math.Cos(a), cy + ry*math.Sin(a)})
+		}
+	}
+	corner(x+w-rx, y+ry, -math.Pi/2)
+	corner(x+w-rx, y+h-ry, 0)
+	corner(x+rx, y+h-ry, math.Pi/2)
+	corner(x+rx, y+ry, math.Pi)
+	return []svgPath{{pts: pts, closed: true}}
+}
+
+func svgEllipsePath(cx, cy, rx, ry float64) []svgPath {
+	if rx <= 0 || ry <= 0 {
+		return []svgPath{{}}
+	}
+	const steps = 48
+	pts := make([]svgPoint, steps)
+	for i := range pts {
+		a := 2 * math.Pi * float64(i) / steps
+		pts[i] = svgPoint{cx + rx*math.Cos(a), cy + ry*math.Sin(a)}
+	}
+	return []svgPath{{pts: pts, closed: true}}
+}
+
+// ---- path data ----
+
+// svgParsePathData flattens SVG path data into polylines. Parsing stops at the first
+// error, keeping what was parsed so far (as browsers do).
+func svgParsePathData(d string) []svgPath {
+	var paths []svgPath
+	var cur *svgPath
+	var pos, start, lastCtrl svgPoint
+	var prevCmd byte
+	s := svgScanner{s: d}
+
+	lineTo := func(p svgPoint) {
+		if cur == nil {
+			paths = append(paths, svgPath{pts: []svgPoint{pos}})
+			cur = &paths[len(paths)-1]
+		}
+		cur.pts = append(cur.pts, p)
+		pos = p
+	}
+	cubic := func(c1, c2, p svgPoint) {
+		p0 := pos
+		for i := 1; i <= svgCurveSteps; i++ {
+			t := float64(i) / svgCurveSteps
+			mt := 1 - t
+			lineTo(svgPoint{
+				mt*mt*mt*p0.X + 3*mt*mt*t*c1.X + 3*mt*t*t*c2.X + t*t*t*p.X,
+				mt*mt*mt*p0.Y + 3*mt*mt*t*c1.Y + 3*mt*t*t*c2.Y + t*t*t*p.Y,
+			})
+		}
+		lastCtrl = c2
+	}
+	quad := func(c, p svgPoint) {
+		p0 := pos
+		for i := 1; i <= svgCurveSteps; i++ {
+			t := float64(i) / svgCurveSteps
+			mt := 1 - t
+			lineTo(svgPoint{
+				mt*mt*p0.X + 2*mt*t*c.X + t*t*p.X,
+				mt*mt*p0.Y + 2*mt*t*c.Y + t*t*p.Y,
+			})
+		}
+		lastCtrl = c
+	}
+
+	var cmd byte
+	for {
+		s.skipSep()
+		if s.done() {
+			break
+		}
+		if c := s.peek(); isPathCommand(c) {
+			cmd = c
+			s.i++
+		} else if cmd == 0 {
+			break
+		} else if cmd == 'M' {
+			cmd = 'L' // extra coordinate pairs after moveto are linetos
+		} else if cmd == 'm' {
+			cmd = 'l'
+		}
+		rel := cmd >= 'a'
+		off := svgPoint{}
+		if rel {
+			off = pos
+		}
+		ok := true
+		num := func() float64 {
+			v, err := s.number()
+			if err != nil {
+				ok = false
+			}
+			return v
+		}
+		pt := func() svgPoint {
+			x := num()
+			y := num()
+			return svgPoint{x + off.X, y + off.Y}
+		}
+		switch cmd {
+		case 'M', 'm':
+			p := pt()
+			if !ok {
+				break
+			}
+			paths = append(paths, svgPath{pts: []svgPoint{p}})
+			cur = &paths[len(paths)-1]
+			pos, start = p, p
+		case 'L', 'l':
+			if p := pt(); ok {
+				lineTo(p)
+			}
+		case 'H', 'h':
+			if x := num(); ok {
+				lineTo(svgPoint{x + off.X, pos.Y})
+			}
+		case 'V', 'v':
+			if y := num(); ok {
+				lineTo(svgPoint{pos.X, y + off.Y})
+			}
+		case 'C', 'c':
+			c1, c2, p := pt(), pt(), pt()
+			if ok {
+				cubic(c1, c2, p)
+			}
+		case 'S', 's':
+			c2, p := pt(), pt()
+			if ok {
+				c1 := pos
+				if prevCmd == 'C' || prevCmd == 'S' {
+					c1 = svgPoint{2*pos.X - lastCtrl.X, 2*pos.Y - lastCtrl.Y}
+				}
+				cubic(c1, c2, p)
+			}
+		case 'Q', 'q':
+			c, p := pt(), pt()
+			if ok {
+				quad(c, p)
+			}
+		case 'T', 't':
+			if p := pt(); ok {
+				c := pos
+				if prevCmd == 'Q' || prevCmd == 'T' {
+					c = svgPoint{2*pos.X - lastCtrl.X, 2*pos.Y - lastCtrl.Y}
+				}
+				quad(c, p)
+			}
+		case 'A', 'a':
+			rx, ry, rot := num(), num(), num()
+			large, sweep := s.flag(&ok), s.flag(&ok)
+			p := pt()
+			if ok {
+				for _, q := range svgArc(pos, p, rx, ry, rot, large, sweep) {
+					lineTo(q)
+				}
+			}
+		case 'Z', 'z':
+			if cur != nil {
+				cur.closed = true
+			}
+			pos = start
+			cur = nil
+		}
+		if !ok {
+			break
+		}
+		prevCmd = cmd &^ 0x20 // upper case
+	}
+	return paths
+}
+
+func isPathCommand(c byte) bool {
+	return strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0
+}
+
+// svgArc flattens an elliptical arc using the endpoint-to-center conversion from the
+// SVG spec (appendix F.6.5).
+func svgArc(p0, p1 svgPoint, rx, ry, rotDeg float64, large, sweep bool) []svgPoint {
+	if p0 == p1 {
+		return nil
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		return []svgPoint{p1}
+	}
+	phi := rotDeg * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (p0.X-p1.X)/2, (p0.Y-p1.Y)/2
+	x1 := cos*dx + sin*dy
+	y1 := -sin*dx + cos*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx *= math.Sqrt(l)
+		ry *= math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+	cx := cos*cx1 - sin*cy1 + (p0.X+p1.X)/2
+	cy := sin*cx1 + cos*cy1 + (p0.Y+p1.Y)/2
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta1 := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	dtheta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && dtheta > 0 {
+		dtheta -= 2 * math.Pi
+	} else if sweep && dtheta < 0 {
+		dtheta += 2 * math.Pi
+	}
+	steps := int(math.Ceil(math.Abs(dtheta) / (math.Pi / 16)))
+	if steps < 1 {
+		steps = 1
+	}
+	pts := make([]svgPoint, 0, steps)
+	for i := 1; i <= steps; i++ {
+		t := theta1 + dtheta*float64(i)/float64(steps)
+		x, y := rx*math.Cos(t), ry*math.Sin(t)
+		pts = append(pts, svgPoint{cos*x - sin*y + cx, sin*x + cos*y + cy})
+	}
+	pts[len(pts)-1] = p1
+	return pts
+}
+
+// svgScanner reads numbers and flags from path data and number lists.
+type svgScanner struct {
+	s string
+	i int
+}
+
+func (s *svgScanner) done() bool { return s.i >= len(s.s) }
+func (s *svgScanner) peek() byte { return s.s[s.i] }
+
+func (s *svgScanner) skipSep() {
+	for s.i < len(s.s) && (isSpace(s.s[s.i]) || s.s[s.i] == ',') {
+		s.i++
+	}
+}
+
+// number parses "-1.5e3", ".5", "1.5.5" (= 1.5 then .5) etc.
+func (s *svgScanner) number() (float64, error) {
+	s.skipSep()
+	start := s.i
+	if s.i < len(s.s) && (s.s[s.i] == '+' || s.s[s.i] == '-') {
+		s.i++
+	}
+	dot := false
+	for s.i < len(s.s) {
+		c := s.s[s.i]
+		if c >= '0' && c <= '9' {
+			s.i++
+		} else if c == '.' && !dot {
+			dot = true
+			s.i++
+		} else {
+			break
+		}
+	}
+	if s.i < len(s.s) && (s.s[s.i] == 'e' || s.s[s.i] == 'E') {
+		j := s.i + 1
+		if j < len(s.s) && (s.s[j] == '+' || s.s[j] == '-') {
+			j++
+		}
+		if j < len(s.s) && s.s[j] >= '0' && s.s[j] <= '9' {
+			for j < len(s.s) && s.s[j] >= '0' && s.s[j] <= '9' {
+				j++
+			}
+			s.i = j
+		}
+	}
+	return strconv.ParseFloat(s.s[start:s.i], 64)
+}
+
+// flag reads an arc flag, which may be written without separators ("a1 1 0 00 1 1").
+func (s *svgScanner) flag(ok *bool) bool {
+	s.skipSep()
+	if s.done() || (s.peek() != '0' && s.peek() != '1') {
+		*ok = false
+		return false
+	}
+	s.i++
+	return s.s[s.i-1] == '1'
+}
+
+func svgNumbers(str string) []float64 {
+	s := svgScanner{s: str}
+	var out []float64
+	for {
+		s.skipSep()
+		if s.done() {
+			return out
+		}
+		v, err := s.number()
+		if err != nil {
+			return out
+		}
+		out = append(out, v)
+	}
+}
+
+// svgLength parses a length with an optional unit. Percentages are relative to ref.
+func svgLength(v string, ref float64) (float64, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"px", 1}, {"pt", 96.0 / 72}, {"pc", 16}, {"mm", 96 / 25.4}, {"cm", 96 / 2.54},
+		{"in", 96}, {"em", 16}, {"ex", 8}, {"%", ref / 100},
+	}
+	factor := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			if u.suffix == "%" && ref == 0 {
+				return 0, false
+			}
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f * factor, true
+}
+
+// svgParseTransform parses a transform list such as "translate(10 20) rotate(45)".
+func svgParseTransform(t string) svgMatrix {
+	m := svgIdentity
+	for {
+		open := strings.IndexByte(t, '(')
+		end := strings.IndexByte(t, ')')
+		if open < 0 || end < open {
+			return m
+		}
+		name := strings.TrimSpace(strings.Trim(strings.TrimSpace(t[:open]), ","))
+		a := svgNumbers(t[open+1 : end])
+		t = t[end+1:]
+		arg := func(i int, def float64) float64 {
+			if i < len(a) {
+				return a[i]
+			}
+			return def
+		}
+		var n svgMatrix
+		switch name {
+		case "matrix":
+			if len(a) != 6 {
+				continue
+			}
+			copy(n[:], a)
+		case "translate":
+			n = svgMatrix{1, 0, 0, 1, arg(0, 0), arg(1, 0)}
+		case "scale":
+			sx := arg(0, 1)
+			n = svgMatrix{sx, 0, 0, arg(1, sx), 0, 0}
+		case "rotate":
+			r := arg(0, 0) * math.Pi / 180
+			cx, cy := arg(1, 0), arg(2, 0)
+			n = svgMatrix{1, 0, 0, 1, cx, cy}.
+				mul(svgMatrix{math.Cos(r), math.Sin(r), -math.Sin(r), math.Cos(r), 0, 0}).
+				mul(svgMatrix{1, 0, 0, 1, -cx, -cy})
+		case "skewX":
+			n = svgMatrix{1, 0, math.Tan(arg(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			n = svgMatrix{1, math.Tan(arg(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		m = m.mul(n)
+	}
+}
+
+// ---- colors ----
+
+var svgNamedColors = map[string]color.NRGBA{
+	"black": {0, 0, 0, 255}, "white": {255, 255, 255, 255}, "red": {255, 0, 0, 255},
+	"green": {0, 128, 0, 255}, "lime": {0, 255, 0, 255}, "blue": {0, 0, 255, 255},
+	"yellow": {255, 255, 0, 255}, "cyan": {0, 255, 255, 255}, "aqua": {0, 255, 255, 255},
+	"magenta": {255, 0, 255, 255}, "fuchsia": {255, 0, 255, 255}, "gray": {128, 128, 128, 255},
+	"grey": {128, 128, 128, 255}, "silver": {192, 192, 192, 255}, "maroon": {128, 0, 0, 255},
+	"olive": {128, 128, 0, 255}, "navy": {0, 0, 128, 255}, "purple": {128, 0, 128, 255},
+	"teal": {0, 128, 128, 255}, "orange": {255, 165, 0, 255}, "pink": {255, 192, 203, 255},
+	"brown": {165, 42, 42, 255}, "gold": {255, 215, 0, 255}, "darkgray": {169, 169, 169, 255},
+	"darkgrey": {169, 169, 169, 255}, "lightgray": {211, 211, 211, 255}, "lightgrey": {211, 211, 211, 255},
+	"darkblue": {0, 0, 139, 255}, "darkred": {139, 0, 0, 255}, "darkgreen": {0, 100, 0, 255},
+	"transparent": {0, 0, 0, 0},
+}
+
+// svgParsePaint parses a fill/stroke value. ok is false for values that should be
+// ignored (keeping the inherited paint), e.g. "inherit".
+func svgParsePaint(v string, gradients map[string]svgPaint) (svgPaint, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch {
+	case v == "" || v == "inherit":
+		return svgPaint{}, false
+	case v == "none":
+		return svgPaint{none: true}, true
+	case v == "currentcolor":
+		return svgPaint{c: color.NRGBA{0, 0, 0, 255}}, true
+	case strings.HasPrefix(v, "url("):
+		id := strings.TrimPrefix(v, "url(")
+		if i := strings.IndexByte(id, ')'); i >= 0 {
+			id = id[:i]
+		}
+		id = strings.TrimPrefix(strings.Trim(id, `"' `), "#")
+		for k, p := range gradients {
+			if strings.EqualFold(k, id) {
+				return p, true
+			}
+		}
+		return svgPaint{c: color.NRGBA{128, 128, 128, 255}}, true
+	case strings.HasPrefix(v, "#"):
+		hex := v[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			var sb strings.Builder
+			for _, c := range hex {
+				sb.WriteRune(c)
+				sb.WriteRune(c)
+			}
+			hex = sb.String()
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 8 {
+			return svgPaint{}, false
+		}
+		return svgPaint{c: color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}}, true
+	case strings.HasPrefix(v, "rgb"):
+		open, end := strings.IndexByte(v, '('), strings.IndexByte(v, ')')
+		if open < 0 || end < open {
+			return svgPaint{}, false
+		}
+		parts := strings.FieldsFunc(v[open+1:end], func(r rune) bool { return r == ',' || r == ' ' || r == '/' })
+		if len(parts) < 3 {
+			return svgPaint{}, false
+		}
+		var ch [4]float64
+		ch[3] = 1
+		for i := 0; i < len(parts) && i < 4; i++ {
+			p := parts[i]
+			f, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+			if err != nil {
+				return svgPaint{}, false
+			}
+			if strings.HasSuffix(p, "%") {
+				f = f / 100
+				if i < 3 {
+					f *= 255
+				}
+			}
+			ch[i] = f
+		}
+		return svgPaint{c: color.NRGBA{
+			uint8(math.Min(255, math.Max(0, ch[0]))),
+			uint8(math.Min(255, math.Max(0, ch[1]))),
+			uint8(math.Min(255, math.Max(0, ch[2]))),
+			uint8(255 * clamp01(ch[3])),
+		}}, true
+	}
+	if c, ok := svgNamedColors[v]; ok {
+		return svgPaint{c: c}, true
+	}
+	return svgPaint{}, false
+}
+
+func clamp01(f float64) float64 {
+	return math.Min(1, math.Max(0, f))
+}
@@ -0,0 +1,170 @@
+package homework2
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestRasterizeSVG(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantErr    bool
+		w, h       int // intrinsic size
+		outW, outH int
+	}{
+		{`<svg width="100" height="50"><rect width="10" height="10"/></svg>`, false, 100, 50, 100, 50},
+		{`<svg viewBox="0 0 400 200"><circle cx="10" cy="10" r="5"/></svg>`, false, 400, 200, 256, 128},
+		{`<svg width="1" height="200000000"/>`, true, 0, 0, 0, 0},
+		{`<svg width="0" height="10"/>`, true, 0, 0, 0, 0},
+		{`<svg width="10" height="10"><path d="M0 0 L`, true, 0, 0, 0, 0},
+		{`not svg at all`, true, 0, 0, 0, 0},
+
+		// coordinates far outside the canvas made the rasterizer divide by zero
+		{`<svg width="100" height="100"><polygon points="0 0 5e7 5e7 -5e7 5"/></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><path d="M0 0 L1e300 1e300 L-1e300 5 Z"/></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><path d="M0 0 L1e300 1e300 L-1e300 5 Z" stroke="red" stroke-width="3"/></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><path d="M0 0 L1e400 1 L-1e300 5 Z" stroke="red" stroke-width="1e300"/></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><circle cx="50" cy="50" r="1e300" stroke="red"/></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><g transform="scale(1e300)"><rect width="1" height="1"/></g></svg>`, false, 100, 100, 100, 100},
+		{`<svg width="100" height="100"><path d="M0 0 A1e300 1e300 0 1 1 50 50"/></svg>`, false, 100, 100, 100, 100},
+	}
+	for _, tt := range tests {
+		img, w, h, err := rasterizeSVG([]byte(tt.in), 256)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rasterizeSVG(%q): err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if w != tt.w || h != tt.h || img.Bounds().Dx() != tt.outW || img.Bounds().Dy() != tt.outH {
+			t.Errorf("rasterizeSVG(%q) = %dx%d image of %dx%d, want %dx%d of %dx%d", tt.in,
+				img.Bounds().Dx(), img.Bounds().Dy(), w, h, tt.outW, tt.outH, tt.w, tt.h)
+		}
+	}
+}
+
+func TestSVGParsePathData(t *testing.T) {
+	tests := []struct {
+		in     string
+		paths  int
+		pts    []int // per path
+		closed bool  // of the first path
+	}{
+		{"", 0, nil, false},
+		{"M0 0 L10 0 L10 10 Z", 1, []int{3}, true},
+		{"M0,0 10,0 10,10", 1, []int{3}, false}, // implicit lineto after moveto
+		{"m0 0 l10 0 l0 10 z m20 0 h5 v5", 2, []int{3, 3}, true},
+		{"M0 0 L10 0 L", 1, []int{2}, false}, // stops at the error, keeps the rest
+		{"M0 0 L10 0 X 5 5", 1, []int{2}, false},
+		{"L10 10", 1, []int{2}, false}, // no initial moveto: starts at the origin
+		{"garbage", 0, nil, false},
+		{"M0 0 A5 5 0 1 1", 1, []int{1}, false},
+		{"M0 0 A5 5 0 2 1 10 10", 1, []int{1}, false}, // flags are 0 or 1
+		{"M0 0 L1e999 0", 1, []int{1}, false},         // out of float64 range
+		{"M0 0 L.5.5", 1, []int{2}, false},            // ".5.5" is two numbers
+		{"M0 0 C1 1 2 2 3 3", 1, []int{1 + svgCurveSteps}, false},
+	}
+	for _, tt := range tests {
+		paths := svgParsePathData(tt.in)
+		if len(paths) != tt.paths {
+			t.Errorf("svgParsePathData(%q): %d paths, want %d", tt.in, len(paths), tt.paths)
+			continue
+		}
+		for i, p := range paths {
+			if len(p.pts) != tt.pts[i] {
+				t.Errorf("svgParsePathData(%q): path %d has %d points, want %d", tt.in, i, len(p.pts), tt.pts[i])
+			}
+		}
+		if len(paths) > 0 && paths[0].closed != tt.closed {
+			t.Errorf("svgParsePathData(%q): closed = %v, want %v", tt.in, paths[0].closed, tt.closed)
+		}
+	}
+}
+
+func TestSVGLength(t *testing.T) {
+	tests := []struct {
+		in   string
+		ref  float64
+		want float64
+		ok   bool
+	}{
+		{"10", 0, 10, true},
+		{" 10px ", 0, 10, true},
+		{"1in", 0, 96, true},
+		{"72pt", 0, 96, true},
+		{"50%", 200, 100, true},
+		{"50%", 0, 0, false},
+		{"", 0, 0, false},
+		{"px", 0, 0, false},
+		{"10furlongs", 0, 0, false},
+		{"-5", 0, -5, true},
+	}
+	for _, tt := range tests {
+		got, ok := svgLength(tt.in, tt.ref)
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("svgLength(%q, %v) = %v, %v, want %v, %v", tt.in, tt.ref, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSVGParseTransform(t *testing.T) {
+	tests := []struct {
+		in   string
+		want svgMatrix
+	}{
+		{"", svgIdentity},
+		{"translate(10 20)", svgMatrix{1, 0, 0, 1, 10, 20}},
+		{"translate(10)", svgMatrix{1, 0, 0, 1, 10, 0}},
+		{"scale(2)", svgMatrix{2, 0, 0, 2, 0, 0}},
+		{"scale(2, 3) translate(1,1)", svgMatrix{2, 0, 0, 3, 2, 3}},
+		{"matrix(1 2 3 4 5 6)", svgMatrix{1, 2, 3, 4, 5, 6}},
+		{"matrix(1 2 3)", svgIdentity},     // wrong arity is ignored
+		{"wobble(5) scale(2", svgIdentity}, // unknown and unterminated
+		{"rotate(90", svgIdentity},
+		{")(", svgIdentity},
+	}
+	for _, tt := range tests {
+		got := svgParseTransform(tt.in)
+		for i := range got {
+			if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+				t.Errorf("svgParseTransform(%q) = %v, want %v", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+	// rotating by 90 degrees maps (1, 0) to (0, 1)
+	if p := svgParseTransform("rotate(90)").apply(svgPoint{1, 0}); math.Abs(p.X) > 1e-9 || math.Abs(p.Y-1) > 1e-9 {
+		t.Errorf("rotate(90) maps (1, 0) to %v", p)
+	}
+}
+
+func TestSVGParsePaint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want svgPaint
+		ok   bool
+	}{
+		{"red", svgPaint{c: color.NRGBA{255, 0, 0, 255}}, true},
+		{" RED ", svgPaint{c: color.NRGBA{255, 0, 0, 255}}, true},
+		{"#0f0", svgPaint{c: color.NRGBA{0, 255, 0, 255}}, true},
+		{"#11223380", svgPaint{c: color.NRGBA{0x11, 0x22, 0x33, 0x80}}, true},
+		{"rgb(10, 20, 30)", svgPaint{c: color.NRGBA{10, 20, 30, 255}}, true},
+		{"rgb(100%, 0%, 500, 0.5)", svgPaint{c: color.NRGBA{255, 0, 255, 127}}, true},
+		{"none", svgPaint{none: true}, true},
+		{"inherit", svgPaint{}, false},
+		{"#12345", svgPaint{}, false},
+		{"#gggggg", svgPaint{}, false},
+		{"rgb(1, 2)", svgPaint{}, false},
+		{"rgb(1, 2, 3", svgPaint{}, false},
+		{"rgb(a, b, c)", svgPaint{}, false},
+		{"chartreuse-ish", svgPaint{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := svgParsePaint(tt.in, nil)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("svgParsePaint(%q) = %+v, %v, want %+v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
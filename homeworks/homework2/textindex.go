@@ -0,0 +1,517 @@
+package homework2
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TextIndex is an in-memory inverted index over the text found with each image (alt,
+// title, caption, page title, surrounding text, keywords, filename), ranked with BM25.
+// Words are lower-cased, stop words dropped and stemmed: Cyrillic words with a light
+// Bulgarian stemmer, everything else with the Porter stemmer.
+type TextIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int64]float64 // term -> image id -> weighted term frequency
+	docLen   map[int64]float64
+	docTerms map[int64][]string // for Remove
+	totalLen float64
+}
+
+// TextMatch is one result of TextIndex.Search.
+type TextMatch struct {
+	ID    int64
+	Score float64
+}
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+func NewTextIndex() *TextIndex {
+	return &TextIndex{
+		postings: make(map[string]map[int64]float64),
+		docLen:   make(map[int64]float64),
+		docTerms: make(map[int64][]string),
+	}
+}
+
+// textFields returns the indexed text of im with the weight of each field; a word in
+// the alt text counts three times as much as one in the surrounding text.
+func textFields(im *ImageMeta) []struct {
+	text   string
+	weight float64
+} {
+	return []struct {
+		text   string
+		weight float64
+	}{
+		{im.Alt, 3},
+		{im.Title, 2},
+		{im.Caption, 2},
+		{strings.Join(im.Keywords, " "), 2},
+		{im.PageTitle, 1},
+		{im.Filename, 1},
+		{im.Context, 1},
+	}
+}
+
+// Add indexes im under im.ID, replacing a previous version.
+func (x *TextIndex) Add(im *ImageMeta) {
+	tf := map[string]float64{}
+	length := 0.0
+	for _, f := range textFields(im) {
+		for _, t := range analyze(f.text) {
+			tf[t] += f.weight
+			length += f.weight
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(im.ID)
+	if len(tf) == 0 {
+		return
+	}
+	terms := make([]string, 0, len(tf))
+	for t, n := range tf {
+		p := x.postings[t]
+		if p == nil {
+			p = make(map[int64]float64)
+			x.postings[t] = p
+		}
+		p[im.ID] = n
+		terms = append(terms, t)
+	}
+	x.docTerms[im.ID] = terms
+	x.docLen[im.ID] = length
+	x.totalLen += length
+}
+
+// Remove drops image id from the index.
+func (x *TextIndex) Remove(id int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+}
+
+func (x *TextIndex) removeLocked(id int64) {
+	terms, ok := x.docTerms[id]
+	if !ok {
+		return
+	}
+	for _, t := range terms {
+		delete(x.postings[t], id)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+		}
+	}
+	x.totalLen -= x.docLen[id]
+	delete(x.docLen, id)
+	delete(x.docTerms, id)
+}
+
+// Search ranks the images matching any word of query by BM25, best first.
+func (x *TextIndex) Search(query string) []TextMatch {
+	terms := uniqueStrings(analyze(query))
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	n := float64(len(x.docLen))
+	if n == 0 || len(terms) == 0 {
+		return nil
+	}
+	avg := x.totalLen / n
+	scores := map[int64]float64{}
+	for _, t := range terms {
+		p := x.postings[t]
+		if len(p) == 0 {
+			continue
+		}
+		df := float64(len(p))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range p {
+			norm := tf + bm25K1*(1-bm25B+bm25B*x.docLen[id]/avg)
+			scores[id] += idf * tf * (bm25K1 + 1) / norm
+		}
+	}
+	out := make([]TextMatch, 0, len(scores))
+	for id, s := range scores {
+		out = append(out, TextMatch{ID: id, Score: s})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Len returns the number of indexed images.
+func (x *TextIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docLen)
+}
+
+// ---- text helpers ----
+
+// collapseSpace trims s and replaces runs of white space with one space.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// textWindow returns about n bytes of text on each side of pos, cut at word
+// boundaries, with white space collapsed.
+func textWindow(text string, pos, n int) string {
+	start, end := pos-n, pos+n
+	if start <= 0 {
+		start = 0
+	} else {
+		for start < pos && !isSpace(text[start]) {
+			start++
+		}
+	}
+	if end >= len(text) {
+		end = len(text)
+	} else {
+		for end > pos && !isSpace(text[end]) {
+			end--
+		}
+	}
+	// never split a UTF-8 sequence
+	for start < end && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	return collapseSpace(text[start:end])
+}
+
+// analyze splits text into lower-case words, drops stop words and stems the rest.
+func analyze(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, w := range words {
+		if stopWords[w] || utf8.RuneCountInString(w) < 2 && !unicode.IsDigit([]rune(w)[0]) {
+			continue
+		}
+		if isCyrillic(w) {
+			w = stemBulgarian(w)
+		} else {
+			w = stemPorter(w)
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+func isCyrillic(w string) bool {
+	for _, r := range w {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return true
+		}
+	}
+	return false
+}
+
+var stopWords = func() map[string]bool {
+	m := map[string]bool{}
+	for _, w := range strings.Fields(`a an and are as at be by for from has in is it its of on or that the
+		this to was were will with jpg jpeg png gif webp svg
+		и в во на за от по с със да се не е са ще като но или че към при до след
+		това този тази тези то той тя те ние вие аз ти му ми си го ги ѝ им ни ви бе беше`) {
+		m[w] = true
+	}
+	return m
+}()
+
+// ---- English: Porter stemmer (M.F. Porter, 1980) ----
+
+func stemPorter(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word // digits, accents: leave alone
+		}
+	}
+	w := []byte(word)
+	w = porterStep1a(w)
+	w = porterStep1b(w)
+	w = porterStep1c(w)
+	w = porterStep2(w)
+	w = porterStep3(w)
+	w = porterStep4(w)
+	w = porterStep5(w)
+	return string(w)
+}
+
+// isConsonant reports whether w[i] is a consonant in Porter's sense.
+func isConsonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure returns m in [C](VC){m}[V] for w.
+func measure(w []byte) int {
+	m, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i == len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC: consonant-vowel-consonant where the last is not w, x or y.
+func endsCVC(w []byte) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	c := w[n-1]
+	return c != 'w' && c != 'x' && c != 'y'
+}
+
+func hasSuffix(w []byte, s string) bool {
+	return len(w) >= len(s) && string(w[len(w)-len(s):]) == s
+}
+
+// replaceSuffix replaces suffix s with r if the stem before s has measure > m.
+func replaceSuffix(w []byte, s, r string, m int) ([]byte, bool) {
+	if !hasSuffix(w, s) {
+		return w, false
+	}
+	stem := w[:len(w)-len(s)]
+	if measure(stem) > m {
+		return append(stem, r...), true
+	}
+	return w, true
+}
+
+func porterStep1a(w []byte) []byte {
+	switch {
+	case hasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case hasSuffix(w, "ies"):
+		return w[:len(w)-2]
+	case hasSuffix(w, "ss"):
+		return w
+	case hasSuffix(w, "s"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+func porterStep1b(w []byte) []byte {
+	if hasSuffix(w, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+	var stem []byte
+	switch {
+	case hasSuffix(w, "ed") && hasVowel(w[:len(w)-2]):
+		stem = w[:len(w)-2]
+	case hasSuffix(w, "ing") && hasVowel(w[:len(w)-3]):
+		stem = w[:len(w)-3]
+	default:
+		return w
+	}
+	switch {
+	case hasSuffix(stem, "at"), hasSuffix(stem, "bl"), hasSuffix(stem, "iz"):
+		return append(stem, 'e')
+	case endsDoubleConsonant(stem):
+		c := stem[len(stem)-1]
+		if c != 'l' && c != 's' && c != 'z' {
+			return stem[:len(stem)-1]
+		}
+	case measure(stem) == 1 && endsCVC(stem):
+		return append(stem, 'e')
+	}
+	return stem
+}
+
+func porterStep1c(w []byte) []byte {
+	if hasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		w[len(w)-1] = 'i'
+	}
+	return w
+}
+
+var porterStep2Rules = []struct{ s, r string }{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+	{"abli", "able"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+	{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+	{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+var porterStep3Rules = []struct{ s, r string }{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var porterStep4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent", "ion",
+	"ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func porterRules(w []byte, rules []struct{ s, r string }) []byte {
+	// the longest matching suffix decides; if its condition fails nothing changes
+	best := -1
+	for i, r := range rules {
+		if hasSuffix(w, r.s) && (best < 0 || len(r.s) > len(rules[best].s)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		w, _ = replaceSuffix(w, rules[best].s, rules[best].r, 0)
+	}
+	return w
+}
+
+func porterStep2(w []byte) []byte { return porterRules(w, porterStep2Rules) }
+func porterStep3(w []byte) []byte { return porterRules(w, porterStep3Rules) }
+
+func porterStep4(w []byte) []byte {
+	best := ""
+	for _, s := range porterStep4Suffixes {
+		if hasSuffix(w, s) && len(s) > len(best) {
+			best = s
+		}
+	}
+	if best == "" {
+		return w
+	}
+	stem := w[:len(w)-len(best)]
+	if measure(stem) <= 1 {
+		return w
+	}
+	if best == "ion" && !(hasSuffix(stem, "s") || hasSuffix(stem, "t")) {
+		return w
+	}
+	return stem
+}
+
+func porterStep5(w []byte) []byte {
+	if hasSuffix(w, "e") {
+		stem := w[:len(w)-1]
+		if m := measure(stem); m > 1 || m == 1 && !endsCVC(stem) {
+			w = stem
+		}
+	}
+	if measure(w) > 1 && endsDoubleConsonant(w) && hasSuffix(w, "l") {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// ---- Bulgarian: light stemmer (J. Savoy, "Searching strategies for the Bulgarian
+// language", 2007) - strips the definite article and plural endings. ----
+
+func stemBulgarian(word string) string {
+	w := []rune(word)
+	n := len(w)
+	if n < 4 {
+		return word
+	}
+	ends := func(s string) bool {
+		r := []rune(s)
+		return n >= len(r) && string(w[n-len(r):n]) == s
+	}
+	if n > 5 && ends("ища") {
+		return string(w[:n-3])
+	}
+
+	// article
+	switch {
+	case n > 6 && ends("ият"):
+		n -= 3
+	case n > 5 && (ends("ът") || ends("то") || ends("те") || ends("та") || ends("ия")):
+		n -= 2
+	case n > 4 && ends("ят"):
+		n -= 2
+	}
+
+	// plural
+	switch {
+	case n > 6 && ends("овци"):
+		n -= 3
+	case n > 6 && ends("ове"):
+		n -= 3
+	case n > 6 && ends("еве"):
+		w[n-3] = 'й'
+		n -= 2
+	case n > 5 && ends("ища"):
+		n -= 3
+	case n > 5 && ends("та"):
+		n -= 2
+	case n > 5 && ends("ци"):
+		w[n-2] = 'к'
+		n--
+	case n > 5 && ends("зи"):
+		w[n-2] = 'г'
+		n--
+	case n > 5 && w[n-3] == 'е' && w[n-1] == 'и':
+		w[n-3] = 'я'
+		n--
+	case n > 4 && ends("си"):
+		w[n-2] = 'х'
+		n--
+	case n > 4 && ends("и"):
+		n--
+	}
+
+	if n > 3 {
+		if ends("я") {
+			n--
+		}
+		if ends("а") || ends("о") || ends("е") {
+			n--
+		}
+	}
+	if n > 4 && ends("ен") {
+		w[n-2] = 'н'
+		n--
+	}
+	if n > 5 && w[n-2] == 'ъ' {
+		w[n-2] = w[n-1]
+		n--
+	}
+	return string(w[:n])
+}
@@ -0,0 +1,194 @@
+package homework2
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStemPorter(t *testing.T) {
+	// from Porter's paper and the reference vocabulary
+	tests := []struct {
+		in, want string
+	}{
+		{"caresses", "caress"},
+		{"ponies", "poni"},
+		{"ties", "ti"},
+		{"caress", "caress"},
+		{"cats", "cat"},
+		{"feed", "feed"},
+		{"agreed", "agre"},
+		{"plastered", "plaster"},
+		{"bled", "bled"},
+		{"motoring", "motor"},
+		{"sing", "sing"},
+		{"conflated", "conflat"},
+		{"troubled", "troubl"},
+		{"sized", "size"},
+		{"hopping", "hop"},
+		{"tanned", "tan"},
+		{"falling", "fall"},
+		{"hissing", "hiss"},
+		{"fizzed", "fizz"},
+		{"failing", "fail"},
+		{"filing", "file"},
+		{"happy", "happi"},
+		{"sky", "sky"},
+		{"relational", "relat"},
+		{"conditional", "condit"},
+		{"rational", "ration"},
+		{"digitizer", "digit"},
+		{"hopefulness", "hope"},
+		{"goodness", "good"},
+		{"callousness", "callous"},
+		{"triplicate", "triplic"},
+		{"formative", "form"},
+		{"electrical", "electr"},
+		{"allowance", "allow"},
+		{"inference", "infer"},
+		{"airliner", "airlin"},
+		{"adjustment", "adjust"},
+		{"dependent", "depend"},
+		{"adoption", "adopt"},
+		{"communism", "commun"},
+		{"effective", "effect"},
+		{"probate", "probat"},
+		{"rate", "rate"},
+		{"cease", "ceas"},
+		{"controll", "control"},
+		{"roll", "roll"},
+		{"generalizations", "gener"},
+		{"oscillators", "oscil"},
+
+		// short words and numbers are left alone
+		{"is", "is"},
+		{"a", "a"},
+		{"", ""},
+		{"2024", "2024"},
+	}
+	for _, tt := range tests {
+		if got := stemPorter(tt.in); got != tt.want {
+			t.Errorf("stemPorter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStemBulgarian(t *testing.T) {
+	// singular, plural and definite forms of a word share a stem
+	tests := []struct {
+		in, want string
+	}{
+		{"котка", "котк"},
+		{"котки", "котк"},
+		{"котката", "котк"},
+		{"котките", "котк"},
+		{"град", "град"},
+		{"града", "град"},
+		{"градът", "град"},
+		{"градове", "град"},
+		{"градовете", "град"},
+		{"книга", "книг"},
+		{"книги", "книг"},
+		{"книгата", "книг"},
+		{"снимка", "снимк"},
+		{"снимки", "снимк"},
+		{"снимките", "снимк"},
+		{"планина", "планин"},
+		{"планини", "планин"},
+		{"планините", "планин"},
+		{"село", "сел"},
+		{"селата", "сел"},
+		{"море", "мор"},
+		{"морета", "мор"},
+		{"момче", "момч"},
+		{"момчета", "момч"},
+		{"човек", "човек"},
+		{"човекът", "човек"},
+
+		// words of up to three letters are left alone
+		{"път", "път"},
+		{"ям", "ям"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := stemBulgarian(tt.in); got != tt.want {
+			t.Errorf("stemBulgarian(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"The Cats of Rome", []string{"cat", "rome"}},
+		{"sunset_over-the-sea.JPG", []string{"sunset", "over", "sea"}},
+		{"IMG 2024 a b 7", []string{"img", "2024", "7"}},
+		{"Котките на Витоша", []string{"котк", "витош"}},
+		{"Sofia, София!", []string{"sofia", "софи"}},
+		{"...", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := analyze(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("analyze(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTextIndexSearch(t *testing.T) {
+	x := NewTextIndex()
+	for _, im := range []*ImageMeta{
+		{ID: 1, Context: "a red car parked by the beach"},
+		{ID: 2, Alt: "red car"},
+		{ID: 3, Alt: "beach at sunset"},
+		{ID: 4, Alt: "beach", Context: strings.Repeat("sand and waves ", 20)},
+		{ID: 5, Alt: "beach"},
+		{ID: 6, Alt: "Котките на Витоша"},
+		{ID: 7, Alt: "beach"},
+	} {
+		x.Add(im)
+	}
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		// a word in the alt text beats one in the surrounding text
+		{"red car", []int64{2, 1}},
+		// the rarer word ranks first, then shorter texts, then ties by id; the
+		// long text of 4 outweighs its alt text
+		{"sunset beach", []int64{3, 5, 7, 1, 4}},
+		{"beaches", []int64{5, 7, 3, 1, 4}},
+		{"котка", []int64{6}},
+		{"the", nil},
+		{"bicycle", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, m := range x.Search(tt.query) {
+			got = append(got, m.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// re-adding replaces the old text, removing drops it
+	x.Add(&ImageMeta{ID: 3, Alt: "mountain"})
+	x.Remove(5)
+	if got := x.Search("beach"); len(got) != 3 {
+		t.Errorf("Search(beach) after update = %v", got)
+	}
+	if got := x.Search("mountain"); len(got) != 1 || got[0].ID != 3 {
+		t.Errorf("Search(mountain) = %v", got)
+	}
+	if x.Len() != 6 {
+		t.Errorf("Len = %d, want 6", x.Len())
+	}
+	x.Add(&ImageMeta{ID: 7})
+	if x.Len() != 5 {
+		t.Errorf("Len after adding an image without text = %d, want 5", x.Len())
+	}
+}
@@ -0,0 +1,316 @@
+package homework2
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ThumbnailOptions controls which thumbnails processImage writes for each image.
+type ThumbnailOptions struct {
+	Sizes       []int  // maximum widths, e.g. 100, 200, 400; images are never upscaled
+	Filter      string // resampling filter, see resampleFilters
+	JPEGQuality int
+}
+
+// DefaultThumbnailOptions produces the sizes used by the UI's responsive grid.
+func DefaultThumbnailOptions() ThumbnailOptions {
+	return ThumbnailOptions{Sizes: []int{100, MaxThumbnailWidth, 400}, Filter: "lanczos", JPEGQuality: 85}
+}
+
+// parseThumbnailSizes parses a comma separated list such as "100,200,400".
+func parseThumbnailSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad thumbnail size %q", f)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no thumbnail sizes in %q", s)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// maxSize returns the largest configured thumbnail width.
+func (o ThumbnailOptions) maxSize() int {
+	m := 0
+	for _, s := range o.Sizes {
+		if s > m {
+			m = s
+		}
+	}
+	if m == 0 {
+		m = MaxThumbnailWidth
+	}
+	return m
+}
+
+// resampleFilter is a separable reconstruction kernel. A nil kernel means exact area
+// averaging (box filter weighted by pixel overlap).
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = map[string]resampleFilter{
+	"area": {support: 0.5},
+	"bilinear": {support: 1, kernel: func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}},
+	"lanczos": {support: 3, kernel: func(x float64) float64 {
+		x = math.Abs(x)
+		if x == 0 {
+			return 1
+		}
+		if x >= 3 {
+			return 0
+		}
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}},
+}
+
+// thumbEncoders are the output formats for thumbnails. Another format (WebP, AVIF)
+// only needs an entry here and a case in thumbnailFormat.
+var thumbEncoders = map[string]struct {
+	ext    string
+	encode func(w io.Writer, img image.Image, o ThumbnailOptions) error
+}{
+	"png": {".png", func(w io.Writer, img image.Image, _ ThumbnailOptions) error {
+		return png.Encode(w, img)
+	}},
+	"jpeg": {".jpg", func(w io.Writer, img image.Image, o ThumbnailOptions) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: o.JPEGQuality})
+	}},
+}
+
+// makeThumbnails writes one thumbnail per configured size next to basePath
+// ("<basePath>.thumb-<width>.<ext>") and returns their paths keyed by actual width.
+// format is the source format and decides between JPEG (photos) and PNG (graphics).
+func makeThumbnails(img image.Image, format, basePath string, o ThumbnailOptions) (map[int]string, error) {
+	f, ok := resampleFilters[o.Filter]
+	if !ok {
+		return nil, fmt.Errorf("unknown resampling filter %q", o.Filter)
+	}
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw == 0 || sh == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	// Large sources are first area-averaged down to twice the biggest thumbnail, so
+	// the wide Lanczos kernel doesn't run over thousands of pixels per output pixel.
+	if pre := 2 * o.maxSize(); sw > pre && o.Filter != "area" {
+		src = resample(src, pre, int(math.Max(1, math.Round(float64(sh)*float64(pre)/float64(sw)))), resampleFilters["area"])
+		sw, sh = src.Rect.Dx(), src.Rect.Dy()
+	}
+
+	out := map[int]string{}
+	for _, size := range o.Sizes {
+		w := size
+		if w > sw {
+			w = sw
+		}
+		if _, done := out[w]; done {
+			continue
+		}
+		h := int(math.Max(1, math.Round(float64(sh)*float64(w)/float64(sw))))
+		thumb := src
+		if w != sw {
+			thumb = resample(src, w, h, f)
+		}
+		enc := thumbEncoders[thumbnailFormat(thumb, format)]
+		p := fmt.Sprintf("%s.thumb-%d%s", basePath, w, enc.ext)
+		if err := writeThumbnail(p, thumb, enc.encode, o); err != nil {
+			return out, err
+		}
+		out[w] = p
+	}
+	return out, nil
+}
+
+func writeThumbnail(p string, img image.Image, encode func(io.Writer, image.Image, ThumbnailOptions) error, o ThumbnailOptions) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, img, o); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// thumbnailFormat picks JPEG for photographs and PNG for graphics: anything with
+// transparency or few distinct colors (logos, icons, diagrams, SVG renders).
+func thumbnailFormat(img *image.RGBA, srcFormat string) string {
+	switch srcFormat {
+	case "jpeg":
+		return "jpeg"
+	case "svg", "gif":
+		return "png"
+	}
+	const photoColors = 1024
+	colors := make(map[uint32]struct{}, photoColors)
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		if img.Pix[i+3] != 0xFF {
+			return "png"
+		}
+		if len(colors) <= photoColors {
+			colors[uint32(img.Pix[i])<<16|uint32(img.Pix[i+1])<<8|uint32(img.Pix[i+2])] = struct{}{}
+		}
+	}
+	if len(colors) > photoColors {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// defaultThumbnail returns the thumbnail the UI shows by default: the largest one not
+// wider than MaxThumbnailWidth, or the smallest if all are wider.
+func defaultThumbnail(thumbs map[int]string) string {
+	best, smallest := -1, -1
+	for w := range thumbs {
+		if w <= MaxThumbnailWidth && w > best {
+			best = w
+		}
+		if smallest < 0 || w < smallest {
+			smallest = w
+		}
+	}
+	if best < 0 {
+		best = smallest
+	}
+	return thumbs[best]
+}
+
+// resample scales src to w x h with a separable filter, horizontally then vertically,
+// working on premultiplied RGBA so transparent pixels don't bleed color.
+func resample(src *image.RGBA, w, h int, f resampleFilter) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	xw := resampleWeights(w, sw, f)
+	yw := resampleWeights(h, sh, f)
+
+	// horizontal pass: sh rows of w pixels
+	tmp := make([]float32, w*sh*4)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, c := range xw {
+			var r, g, b, a float32
+			for k, wt := range c.w {
+				p := row[(c.start+k)*4:]
+				r += wt * float32(p[0])
+				g += wt * float32(p[1])
+				b += wt * float32(p[2])
+				a += wt * float32(p[3])
+			}
+			t := tmp[(y*w+x)*4:]
+			t[0], t[1], t[2], t[3] = r, g, b, a
+		}
+	}
+
+	// vertical pass
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, c := range yw {
+		for x := 0; x < w; x++ {
+			var r, g, b, a float32
+			for k, wt := range c.w {
+				t := tmp[((c.start+k)*w+x)*4:]
+				r += wt * t[0]
+				g += wt * t[1]
+				b += wt * t[2]
+				a += wt * t[3]
+			}
+			alpha := clampByte(a)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			// Lanczos over/undershoots; premultiplied channels must not exceed alpha
+			p[0] = minByte(clampByte(r), alpha)
+			p[1] = minByte(clampByte(g), alpha)
+			p[2] = minByte(clampByte(b), alpha)
+			p[3] = alpha
+		}
+	}
+	return dst
+}
+
+// contribution lists the source pixels (from start) and weights for one output pixel.
+type contribution struct {
+	start int
+	w     []float32
+}
+
+func resampleWeights(dst, src int, f resampleFilter) []contribution {
+	scale := float64(src) / float64(dst)
+	fscale := math.Max(scale, 1) // widen the kernel when shrinking
+	support := f.support * fscale
+	out := make([]contribution, dst)
+	for i := range out {
+		center := (float64(i) + 0.5) * scale
+		lo := int(math.Floor(center - support))
+		hi := int(math.Ceil(center + support))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > src {
+			hi = src
+		}
+		ws := make([]float32, 0, hi-lo)
+		var sum float64
+		for j := lo; j < hi; j++ {
+			var wt float64
+			if f.kernel == nil {
+				// exact overlap of source pixel [j, j+1) with the output footprint
+				wt = math.Min(float64(j+1), center+support) - math.Max(float64(j), center-support)
+				if wt < 0 {
+					wt = 0
+				}
+			} else {
+				wt = f.kernel((float64(j) + 0.5 - center) / fscale)
+			}
+			ws = append(ws, float32(wt))
+			sum += wt
+		}
+		if sum != 0 {
+			for k := range ws {
+				ws[k] /= float32(sum)
+			}
+		}
+		out[i] = contribution{start: lo, w: ws}
+	}
+	return out
+}
+
+func clampByte(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func minByte(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}